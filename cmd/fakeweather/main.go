@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/fakeweather"
+)
+
+func main() {
+	addr := flag.String("addr", ":8090", "listen address")
+	seed := flag.Int64("seed", 1, "seed for the synthetic data")
+	fault := flag.String("fault", "", "fault to inject: 429, 500, timeout, malformed")
+	faultRate := flag.Float64("fault-rate", 0, "share of requests that fail, 0..1 (1 if -fault is set and rate is 0)")
+	timeoutDelay := flag.Duration("timeout-delay", 30*time.Second, "how long a timeout fault hangs")
+	flag.Parse()
+
+	srv := fakeweather.New(fakeweather.Options{
+		Seed:         *seed,
+		Fault:        *fault,
+		FaultRate:    *faultRate,
+		TimeoutDelay: *timeoutDelay,
+	})
+
+	log.Printf("fakeweather: listening on %s (seed=%d)", *addr, *seed)
+	if err := http.ListenAndServe(*addr, srv); err != nil {
+		log.Fatalf("fakeweather: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+// Command weatherctl runs operational tasks against the weather service
+// databases: user and subscription management, forced collection runs, email
+// previews and resends, migrations and history export. It reads the same
+// environment as the service.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+
+	weatherAPI "github.com/ilyaytrewq/WeatherServiceAPI/weather_service"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		fmt.Print(weatherAPI.CtlUsage)
+		return
+	}
+
+	// the service logs go to stderr only with -v, stdout is for results
+	if args[0] == "-v" {
+		args = args[1:]
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := weatherAPI.InitWeatherProviders(); err != nil {
+		fail(err)
+	}
+	if err := weatherAPI.InitClickhouse(); err != nil {
+		fail(err)
+	}
+	if err := weatherAPI.InitPostgres(); err != nil {
+		fail(err)
+	}
+
+	if err := weatherAPI.RunCtlCommand(ctx, args, os.Stdout); err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "weatherctl: %v\n", err)
+	os.Exit(1)
+}
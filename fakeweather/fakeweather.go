@@ -0,0 +1,368 @@
+// Package fakeweather is a local stand-in for the OpenWeather endpoints the
+// weather service uses: geo/1.0/direct, data/2.5/weather and
+// data/2.5/forecast/hourly. Responses are synthetic but deterministic for a
+// given seed, coordinates and hour, and faults can be injected at runtime.
+package fakeweather
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fault modes understood by SetFault and the /__fault control endpoint.
+const (
+	FaultNone        = ""
+	FaultRateLimit   = "429"
+	FaultServerError = "500"
+	FaultTimeout     = "timeout"
+	FaultMalformed   = "malformed"
+)
+
+type Options struct {
+	// Seed changes every generated value; the same seed always gives the
+	// same responses for the same request and hour.
+	Seed int64
+	// Fault is injected into FaultRate share of data requests.
+	Fault     string
+	FaultRate float64
+	// TimeoutDelay is how long a "timeout" fault hangs before answering.
+	TimeoutDelay time.Duration
+	// Now is the clock used for observation times, time.Now by default.
+	Now func() time.Time
+}
+
+type Server struct {
+	mu   sync.Mutex
+	opts Options
+	rnd  *rand.Rand
+	mux  *http.ServeMux
+}
+
+func New(opts Options) *Server {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.TimeoutDelay == 0 {
+		opts.TimeoutDelay = 30 * time.Second
+	}
+	if opts.Fault != FaultNone && opts.FaultRate == 0 {
+		opts.FaultRate = 1
+	}
+
+	s := &Server{opts: opts, rnd: rand.New(rand.NewSource(opts.Seed))}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/geo/1.0/direct", s.withFaults(s.handleGeo))
+	s.mux.HandleFunc("/data/2.5/weather", s.withFaults(s.handleWeather))
+	s.mux.HandleFunc("/data/2.5/forecast/hourly", s.withFaults(s.handleForecast))
+	s.mux.HandleFunc("/__fault", s.handleFault)
+	return s
+}
+
+// NewTestServer starts an in-process server; point OPENWEATHER_BASE_URL (or
+// the base URL of the OpenWeather provider in tests) at its URL and close it
+// when done.
+func NewTestServer(opts Options) (*httptest.Server, *Server) {
+	s := New(opts)
+	return httptest.NewServer(s), s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// SetFault changes the injected fault. rate is the share of requests that
+// fail, 1 means every request.
+func (s *Server) SetFault(mode string, rate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.opts.Fault = mode
+	s.opts.FaultRate = rate
+}
+
+func (s *Server) handleFault(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rate := 1.0
+	if v := r.URL.Query().Get("rate"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, "bad rate", http.StatusBadRequest)
+			return
+		}
+		rate = f
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case FaultNone, FaultRateLimit, FaultServerError, FaultTimeout, FaultMalformed:
+	default:
+		http.Error(w, "unknown mode", http.StatusBadRequest)
+		return
+	}
+	s.SetFault(mode, rate)
+	log.Printf("fakeweather: fault set to %q rate=%.2f", mode, rate)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) withFaults(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("appid") == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"cod": 401, "message": "Invalid API key."})
+			return
+		}
+
+		s.mu.Lock()
+		mode := s.opts.Fault
+		hit := mode != FaultNone && s.rnd.Float64() < s.opts.FaultRate
+		delay := s.opts.TimeoutDelay
+		s.mu.Unlock()
+
+		if !hit {
+			next(w, r)
+			return
+		}
+
+		log.Printf("fakeweather: injecting %q into %s", mode, r.URL.Path)
+		switch mode {
+		case FaultRateLimit:
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{"cod": 429, "message": "rate limit exceeded"})
+		case FaultServerError:
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"cod": 500, "message": "internal error"})
+		case FaultTimeout:
+			select {
+			case <-time.After(delay):
+				next(w, r)
+			case <-r.Context().Done():
+			}
+		case FaultMalformed:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"cod":200,"main":{"temp":`)
+		}
+	}
+}
+
+func (s *Server) handleGeo(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"cod": "400", "message": "Nothing to geocode"})
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = 5
+	}
+
+	// Every name resolves to up to three places in different countries, so
+	// callers have to deal with ambiguous names.
+	countries := []struct{ country, state string }{{"FR", "Île-de-France"}, {"US", "Texas"}, {"CA", "Ontario"}}
+	rnd := s.rand(q)
+	n := min(limit, 1+rnd.Intn(len(countries)))
+
+	result := make([]map[string]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		c := countries[i]
+		result = append(result, map[string]interface{}{
+			"name":    q,
+			"lat":     round(rnd.Float64()*140-70, 4),
+			"lon":     round(rnd.Float64()*360-180, 4),
+			"country": c.country,
+			"state":   c.state,
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleWeather(w http.ResponseWriter, r *http.Request) {
+	lat, lon, ok := coords(w, r)
+	if !ok {
+		return
+	}
+
+	// observations refresh every 10 minutes like the real API
+	now := s.opts.Now().UTC().Truncate(10 * time.Minute)
+	p := s.point(lat, lon, now)
+	sunrise, sunset := sunTimes(now, lon)
+
+	resp := map[string]interface{}{
+		"coord":      map[string]float64{"lat": lat, "lon": lon},
+		"weather":    []map[string]interface{}{p.condition()},
+		"base":       "stations",
+		"main":       p.main(),
+		"visibility": p.visibility,
+		"wind":       map[string]interface{}{"speed": p.windSpeed, "deg": p.windDeg, "gust": p.windGust},
+		"clouds":     map[string]int{"all": p.clouds},
+		"dt":         now.Unix(),
+		"sys":        map[string]interface{}{"country": "XX", "sunrise": sunrise.Unix(), "sunset": sunset.Unix()},
+		"timezone":   0,
+		"id":         cityID(lat, lon),
+		"name":       fmt.Sprintf("Fake %.2f,%.2f", lat, lon),
+		"cod":        200,
+	}
+	if p.rain > 0 {
+		resp["rain"] = map[string]float64{"1h": p.rain}
+	}
+	if p.snow > 0 {
+		resp["snow"] = map[string]float64{"1h": p.snow}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request) {
+	lat, lon, ok := coords(w, r)
+	if !ok {
+		return
+	}
+	cnt, err := strconv.Atoi(r.URL.Query().Get("cnt"))
+	if err != nil || cnt < 1 || cnt > 96 {
+		cnt = 96
+	}
+
+	start := s.opts.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	list := make([]map[string]interface{}, 0, cnt)
+	for i := 0; i < cnt; i++ {
+		t := start.Add(time.Duration(i) * time.Hour)
+		p := s.point(lat, lon, t)
+		entry := map[string]interface{}{
+			"dt":         t.Unix(),
+			"main":       p.main(),
+			"weather":    []map[string]interface{}{p.condition()},
+			"clouds":     map[string]int{"all": p.clouds},
+			"wind":       map[string]interface{}{"speed": p.windSpeed, "deg": p.windDeg, "gust": p.windGust},
+			"visibility": p.visibility,
+			"pop":        round(float64(p.clouds)/100, 2),
+			"dt_txt":     t.Format("2006-01-02 15:04:05"),
+		}
+		if p.rain > 0 {
+			entry["rain"] = map[string]float64{"1h": p.rain}
+		}
+		list = append(list, entry)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"cod":  "200",
+		"cnt":  cnt,
+		"list": list,
+		"city": map[string]interface{}{
+			"id":    cityID(lat, lon),
+			"name":  fmt.Sprintf("Fake %.2f,%.2f", lat, lon),
+			"coord": map[string]float64{"lat": lat, "lon": lon},
+		},
+	})
+}
+
+type weatherPoint struct {
+	temp, feelsLike     float64
+	pressure, humidity  int
+	windSpeed, windGust float64
+	windDeg, clouds     int
+	visibility          int
+	rain, snow          float64
+}
+
+// point generates weather for a place and hour: a latitude dependent base
+// temperature, a daily cycle peaking in the afternoon and seeded noise.
+func (s *Server) point(lat, lon float64, t time.Time) weatherPoint {
+	hour := t.Truncate(time.Hour)
+	rnd := s.rand(fmt.Sprintf("%.2f|%.2f|%d", lat, lon, hour.Unix()))
+
+	localHour := math.Mod(float64(hour.Hour())+lon/15+24, 24)
+	base := 30 - math.Abs(lat)*0.6
+	temp := base + 6*math.Sin((localHour-9)/24*2*math.Pi) + rnd.NormFloat64()*1.5
+	wind := math.Abs(3 + rnd.NormFloat64()*2)
+	clouds := rnd.Intn(101)
+
+	p := weatherPoint{
+		temp:       round(temp, 2),
+		feelsLike:  round(temp-wind*0.7, 2),
+		pressure:   1013 + int(rnd.NormFloat64()*8),
+		humidity:   40 + rnd.Intn(55),
+		windSpeed:  round(wind, 2),
+		windGust:   round(wind*1.5, 2),
+		windDeg:    rnd.Intn(360),
+		clouds:     clouds,
+		visibility: 10000 - clouds*50,
+	}
+	if clouds > 80 {
+		if temp < 0 {
+			p.snow = round(rnd.Float64()*2, 2)
+		} else {
+			p.rain = round(rnd.Float64()*3, 2)
+		}
+	}
+	return p
+}
+
+func (p weatherPoint) main() map[string]interface{} {
+	return map[string]interface{}{
+		"temp":       p.temp,
+		"feels_like": p.feelsLike,
+		"temp_min":   round(p.temp-1, 2),
+		"temp_max":   round(p.temp+1, 2),
+		"pressure":   p.pressure,
+		"humidity":   p.humidity,
+	}
+}
+
+func (p weatherPoint) condition() map[string]interface{} {
+	switch {
+	case p.snow > 0:
+		return map[string]interface{}{"id": 600, "main": "Snow", "description": "light snow", "icon": "13d"}
+	case p.rain > 0:
+		return map[string]interface{}{"id": 500, "main": "Rain", "description": "light rain", "icon": "10d"}
+	case p.clouds > 50:
+		return map[string]interface{}{"id": 803, "main": "Clouds", "description": "broken clouds", "icon": "04d"}
+	case p.clouds > 10:
+		return map[string]interface{}{"id": 801, "main": "Clouds", "description": "few clouds", "icon": "02d"}
+	}
+	return map[string]interface{}{"id": 800, "main": "Clear", "description": "clear sky", "icon": "01d"}
+}
+
+func (s *Server) rand(key string) *rand.Rand {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%s", s.opts.Seed, key)
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+func coords(w http.ResponseWriter, r *http.Request) (float64, float64, bool) {
+	lat, errLat := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, errLon := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if errLat != nil || errLon != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"cod": "400", "message": "wrong latitude or longitude"})
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+func sunTimes(day time.Time, lon float64) (time.Time, time.Time) {
+	noon := day.Truncate(24 * time.Hour).Add(12*time.Hour - time.Duration(lon/15*float64(time.Hour)))
+	return noon.Add(-6 * time.Hour), noon.Add(6 * time.Hour)
+}
+
+func cityID(lat, lon float64) int {
+	return int(math.Abs(lat*1000))*1000 + int(math.Abs(lon*10))
+}
+
+func round(v float64, digits int) float64 {
+	p := math.Pow(10, float64(digits))
+	return math.Round(v*p) / p
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("fakeweather: encode response: %v", err)
+	}
+}
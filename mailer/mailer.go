@@ -0,0 +1,82 @@
+// Package mailer turns the email tasks of the weather service into messages
+// and sends them over SMTP. It is shared by smtp_service, which takes the
+// tasks from RabbitMQ, and the mail worker of sqlite mode.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	gomail "gopkg.in/gomail.v2"
+)
+
+// Task is an email as published to the email queue.
+type Task struct {
+	To       string                 `json:"to"`
+	Subject  string                 `json:"subject"`
+	Body     string                 `json:"body"`
+	TextBody string                 `json:"text_body,omitempty"`
+	Type     string                 `json:"type,omitempty"`
+	Meta     map[string]interface{} `json:"meta,omitempty"`
+	Inline   []InlineImage          `json:"inline,omitempty"`
+}
+
+// InlineImage is an image embedded into the HTML part and referenced from it
+// as cid:<CID>.
+type InlineImage struct {
+	CID         string `json:"cid"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// NewMessage builds the message of t. Tasks with a text part are sent as
+// multipart/alternative.
+func NewMessage(from string, t Task) *gomail.Message {
+	m := gomail.NewMessage()
+	m.SetHeader("From", from)
+	m.SetHeader("To", t.To)
+	m.SetHeader("Subject", t.Subject)
+	if t.TextBody != "" {
+		m.SetBody("text/plain", t.TextBody)
+		m.AddAlternative("text/html", t.Body)
+	} else {
+		m.SetBody("text/html", t.Body)
+	}
+
+	for _, img := range t.Inline {
+		data := img.Data
+		m.Embed(img.CID,
+			gomail.SetHeader(map[string][]string{
+				"Content-ID":   {"<" + img.CID + ">"},
+				"Content-Type": {img.ContentType},
+			}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		)
+	}
+	return m
+}
+
+// Send builds the message of t and sends it through d. gomail does not take
+// a context, so when ctx ends first the session is left to finish in the
+// background and a timeout is returned.
+func Send(ctx context.Context, d *gomail.Dialer, from string, t Task) error {
+	if t.To == "" {
+		return fmt.Errorf("task without recipient")
+	}
+	m := NewMessage(from, t)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- d.DialAndSend(m)
+	}()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("send timeout")
+	case err := <-errCh:
+		return err
+	}
+}
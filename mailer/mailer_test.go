@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	gomail "gopkg.in/gomail.v2"
+)
+
+func TestNewMessage(t *testing.T) {
+	task := Task{
+		To:       "user@example.com",
+		Subject:  "Forecast",
+		Body:     `<img src="cid:chart">`,
+		TextBody: "plain forecast",
+		Inline:   []InlineImage{{CID: "chart", ContentType: "image/png", Data: []byte("png data")}},
+	}
+
+	var buf bytes.Buffer
+	if _, err := NewMessage("weather@example.com", task).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	msg := buf.String()
+	for _, want := range []string{
+		"From: weather@example.com",
+		"To: user@example.com",
+		"multipart/alternative",
+		"Content-Type: text/plain",
+		"Content-Type: text/html",
+		"Content-ID: <chart>",
+		"Content-Type: image/png",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestNewMessageWithoutTextPart(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewMessage("weather@example.com", Task{To: "user@example.com", Body: "<p>hi</p>"}).WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if msg := buf.String(); strings.Contains(msg, "multipart/alternative") || !strings.Contains(msg, "Content-Type: text/html") {
+		t.Errorf("want a single HTML part:\n%s", msg)
+	}
+}
+
+func TestSendRejectsTaskWithoutRecipient(t *testing.T) {
+	if err := Send(context.Background(), gomail.NewDialer("localhost", 1, "", ""), "", Task{Subject: "x"}); err == nil {
+		t.Error("Send accepted a task without recipient")
+	}
+}
@@ -1,38 +1,99 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"net/http"
 	"fmt"
+	"os"
 
 	weatherAPI "github.com/ilyaytrewq/WeatherServiceAPI/weather_service"
 )
 
 func main() {
+	defaultMode := os.Getenv("SERVICE_MODE")
+	if defaultMode == "" {
+		defaultMode = "postgres"
+	}
+	mode := flag.String("mode", defaultMode, "storage: postgres (with ClickHouse and RabbitMQ), sqlite or memory")
+	flag.Parse()
+
+	if err := weatherAPI.InitWeatherProviders(); err != nil {
+		fmt.Printf("Failed to initialize weather providers: %v\n", err)
+		return
+	}
+
+	switch *mode {
+	case "postgres":
+		if !initDatabases() {
+			return
+		}
+	case "sqlite":
+		if err := weatherAPI.UseSQLiteStores(context.Background(), os.Getenv("SQLITE_PATH")); err != nil {
+			fmt.Printf("Failed to open SQLite: %v\n", err)
+			return
+		}
+	case "memory":
+		weatherAPI.UseMemoryStores()
+	default:
+		fmt.Printf("Unknown mode %q, want postgres, sqlite or memory\n", *mode)
+		return
+	}
+
+	if err := weatherAPI.StartBackgroundJobs(); err != nil {
+		fmt.Printf("Failed to start background jobs: %v\n", err)
+		return
+	}
+
+	if *mode == "postgres" {
+		if err := weatherAPI.InitRabbit(); err != nil {
+			fmt.Printf("Failed to initialize RabbitMQ: %v\n", err)
+			return
+		} else {
+			fmt.Printf("RabbitMQ publisher started\n")
+		}
+		weatherAPI.StartOutboxRelay()
+	}
+
+	http.HandleFunc("/v1/", weatherAPI.Handler)
+	fmt.Println("Starting server on :8080")
+	if err := http.ListenAndServe(":8080", nil); err != nil {
+		fmt.Printf("Server failed to start: %v\n", err)
+	}
+}
 
+// initDatabases connects to ClickHouse and Postgres and migrates them. It
+// reports false when the service should exit, also after "migrate".
+func initDatabases() bool {
 	if err := weatherAPI.InitClickhouse(); err != nil {
 		fmt.Printf("Failed to initialize ClickHouse: %v\n", err)
-		return
+		return false
 	} else {
 		fmt.Printf("Connected to ClickHouse successfully: %v\n", weatherAPI.ClickhouseConn) 
 	}
 
 	if err := weatherAPI.InitPostgres(); err != nil {
 		fmt.Printf("Failed to initialize Postgres: %v\n", err)
-		return
+		return false
 	} else {
 		fmt.Printf( "Connected to Postgres successfully: %v\n", weatherAPI.DB)
 	}
 
-	if err := weatherAPI.InitRabbit(); err != nil {
-		fmt.Printf("Failed to initialize RabbitMQ: %v\n", err)
-		return
-	} else {
-		fmt.Printf("Connected to RabbitMQ successfully\n")
+	// "migrate [up|status|down <db> [steps]]" only migrates and exits
+	if flag.NArg() > 0 && flag.Arg(0) == "migrate" {
+		if err := weatherAPI.RunMigrateCommand(context.Background(), flag.Args()[1:]); err != nil {
+			fmt.Printf("Migration failed: %v\n", err)
+			os.Exit(1)
+		}
+		return false
 	}
 
-	http.HandleFunc("/v1/", weatherAPI.Handler)
-	fmt.Println("Starting server on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		fmt.Printf("Server failed to start: %v\n", err)
+	if os.Getenv("MIGRATE_ON_START") != "false" {
+		if err := weatherAPI.Migrate(context.Background()); err != nil {
+			fmt.Printf("Failed to migrate databases: %v\n", err)
+			return false
+		}
 	}
+
+	return true
 }
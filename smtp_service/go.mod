@@ -3,8 +3,12 @@ module github.com/ilyaytrewq/WeatherServiceAPI/tree/master/smtp_service
 go 1.22.2
 
 require (
+	github.com/ilyaytrewq/WeatherServiceAPI v0.0.0-00010101000000-000000000000
 	github.com/rabbitmq/amqp091-go v1.4.0
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 )
 
 require gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
+
+// mailer is shared with the mail worker of the weather service
+replace github.com/ilyaytrewq/WeatherServiceAPI => ../
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -11,18 +10,11 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ilyaytrewq/WeatherServiceAPI/mailer"
 	amqp "github.com/rabbitmq/amqp091-go"
 	gomail "gopkg.in/gomail.v2"
 )
 
-type EmailTask struct {
-	To      string                 `json:"to"`
-	Subject string                 `json:"subject"`
-	Body    string                 `json:"body"`
-	Type    string                 `json:"type,omitempty"`
-	Meta    map[string]interface{} `json:"meta,omitempty"`
-}
-
 func main() {
 	rabbitURL := os.Getenv("RABBITMQ_URL")
 	if rabbitURL == "" {
@@ -79,8 +71,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("Invalid SMTP_PORT: %v", err)
 	}
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASSWORD")
+	dialer := gomail.NewDialer(smtpHost, smtpPort, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD"))
 	fromAddr := os.Getenv("SMTP_FROM")
 
 	workerCount := 3
@@ -88,14 +79,14 @@ func main() {
 		go func(id int) {
 			log.Printf("worker %d started", id)
 			for d := range msgs {
-				var t EmailTask
+				var t mailer.Task
 				if err := json.Unmarshal(d.Body, &t); err != nil {
 					log.Printf("worker %d: bad message json: %v", id, err)
 					d.Ack(false)
 					continue
 				}
 				ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-				err := sendMail(ctx, smtpHost, smtpPort, smtpUser, smtpPass, fromAddr, t)
+				err := mailer.Send(ctx, dialer, fromAddr, t)
 				cancel()
 				if err != nil {
 					log.Printf("worker %d: send mail failed for %s: %v", id, t.To, err)
@@ -117,25 +108,3 @@ func main() {
 	conn.Close()
 	time.Sleep(500 * time.Millisecond)
 }
-
-func sendMail(ctx context.Context, host string, port int, user, pass, from string, t EmailTask) error {
-	m := gomail.NewMessage()
-	m.SetHeader("From", from)
-	m.SetHeader("To", t.To)
-	m.SetHeader("Subject", t.Subject)
-	m.SetBody("text/html", t.Body)
-
-	d := gomail.NewDialer(host, port, user, pass)
-
-	errCh := make(chan error, 1)
-	go func() {
-		errCh <- d.DialAndSend(m)
-	}()
-
-	select {
-	case <-ctx.Done():
-		return fmt.Errorf("send timeout")
-	case err := <-errCh:
-		return err
-	}
-}
@@ -0,0 +1,228 @@
+package weatherservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminToken guards /v1/admin/*; the endpoints are disabled when it is empty.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// adminHandler serves the operator endpoints under /v1/admin/. Requests carry
+// the token as "Authorization: Bearer <ADMIN_TOKEN>".
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.URL.Path {
+
+	case "/v1/admin/cities":
+		if r.Method != http.MethodGet {
+			log.Printf("adminHandler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		cities, err := listRegistry(ctx, r.URL.Query().Get("status"))
+		if err != nil {
+			log.Printf("adminHandler: cities error: %v", err)
+			http.Error(w, fmt.Sprintf("cities error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, map[string]interface{}{"cities": cities})
+
+	case "/v1/admin/renameCity":
+		var req struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		city, err := renameCity(ctx, req.ID, req.Name)
+		if err != nil {
+			writeAdminError(w, "renameCity", err)
+			return
+		}
+		writeAdminJSON(w, city)
+
+	case "/v1/admin/mergeCities":
+		var req struct {
+			From string `json:"from"`
+			Into string `json:"into"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		city, err := mergeCities(ctx, req.From, req.Into)
+		if err != nil {
+			writeAdminError(w, "mergeCities", err)
+			return
+		}
+		writeAdminJSON(w, city)
+
+	case "/v1/admin/retireCity":
+		var req struct {
+			ID string `json:"id"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		city, err := retireCity(ctx, req.ID)
+		if err != nil {
+			writeAdminError(w, "retireCity", err)
+			return
+		}
+		writeAdminJSON(w, city)
+
+	case "/v1/admin/jobs":
+		if r.Method != http.MethodGet {
+			log.Printf("adminHandler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		jobs, err := jobScheduler.list(ctx)
+		if err != nil {
+			log.Printf("adminHandler: jobs error: %v", err)
+			http.Error(w, fmt.Sprintf("jobs error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, map[string]interface{}{"replica": replicaID, "jobs": jobs})
+
+	case "/v1/admin/jobRuns":
+		if r.Method != http.MethodGet {
+			log.Printf("adminHandler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 20
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 500 {
+				http.Error(w, "limit must be a number from 1 to 500", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		name := r.URL.Query().Get("job")
+		if _, ok := jobScheduler.job(name); name != "" && !ok {
+			writeAdminError(w, "jobRuns", fmt.Errorf("%w: %s", errUnknownJob, name))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		runs, err := jobRunDB.listRuns(ctx, name, limit)
+		if err != nil {
+			log.Printf("adminHandler: jobRuns error: %v", err)
+			http.Error(w, fmt.Sprintf("jobRuns error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		writeAdminJSON(w, map[string]interface{}{"runs": runs})
+
+	case "/v1/admin/triggerJob":
+		var req struct {
+			Job string `json:"job"`
+		}
+		if !decodeAdminRequest(w, r, &req) {
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		run, err := jobScheduler.trigger(ctx, req.Job)
+		if err != nil {
+			writeAdminError(w, "triggerJob", err)
+			return
+		}
+		response, err := json.MarshalIndent(run, "", "\t")
+		if err != nil {
+			log.Printf("adminHandler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(append(response, '\n'))
+
+	default:
+		log.Printf("adminHandler: not found %s %s", r.Method, r.URL.Path)
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// authorizeAdmin checks the admin token. On failure it writes the response and
+// returns false.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		log.Printf("adminHandler: %s rejected, ADMIN_TOKEN is not set", r.URL.Path)
+		http.Error(w, "Admin API is disabled", http.StatusForbidden)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("adminHandler: %s rejected, bad token from %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// decodeAdminRequest checks that the request is a POST and decodes its JSON
+// body. On failure it writes the response and returns false.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		log.Printf("adminHandler: wrong method %s for %s", r.Method, r.URL.Path)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		log.Printf("adminHandler: %s decode error: %v", r.URL.Path, err)
+		http.Error(w, fmt.Sprintf("decode error: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAdminError(w http.ResponseWriter, handler string, err error) {
+	log.Printf("adminHandler: %s error: %v", handler, err)
+	status := http.StatusBadRequest
+	if errors.Is(err, errCityNotFound) || errors.Is(err, errUnknownJob) {
+		status = http.StatusNotFound
+	}
+	http.Error(w, fmt.Sprintf("%s error: %v", handler, err), status)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	response, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Printf("adminHandler: %v", err)
+		http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(response, '\n'))
+}
@@ -0,0 +1,448 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// A reading is anomalous when it is more than anomalyZThreshold standard
+// deviations from the city's baseline: the same hour of day over the last
+// anomalyBaselineDays for temperature and wind, and all 3-hour changes over
+// that period for pressure.
+var (
+	anomalyZThreshold    = envFloat("ANOMALY_Z_THRESHOLD", 3)
+	anomalyBaselineDays  = envInt("ANOMALY_BASELINE_DAYS", 30)
+	anomalyMinSamples    = envInt("ANOMALY_MIN_SAMPLES", 14)
+	anomalyAlertCooldown = envDuration("ANOMALY_ALERT_COOLDOWN", 6*time.Hour)
+)
+
+const (
+	metricTemp           = "temp"
+	metricWindSpeed      = "wind_speed"
+	metricPressureChange = "pressure_change_3h"
+)
+
+// anomalyMinStddev keeps a very stable baseline from flagging tiny changes.
+var anomalyMinStddev = map[string]float64{
+	metricTemp:           1,
+	metricWindSpeed:      1,
+	metricPressureChange: 1,
+}
+
+type anomaly struct {
+	CityID         string    `json:"city_id"`
+	City           string    `json:"city"`
+	ObservedAt     time.Time `json:"observed_at"`
+	DetectedAt     time.Time `json:"detected_at"`
+	Metric         string    `json:"metric"`
+	Value          float32   `json:"value"`
+	BaselineMean   float32   `json:"baseline_mean"`
+	BaselineStddev float32   `json:"baseline_stddev"`
+	ZScore         float32   `json:"z_score"`
+	Samples        uint32    `json:"samples"`
+	// Alerted marks the anomalies that were emailed to subscribers.
+	Alerted bool `json:"alerted"`
+}
+
+type baselineStats struct {
+	mean    float64
+	stddev  float64
+	samples uint64
+}
+
+// check returns the anomaly for value, if it is one.
+func (b baselineStats) check(metric string, value float64) (anomaly, bool) {
+	if b.samples < uint64(anomalyMinSamples) {
+		return anomaly{}, false
+	}
+	stddev := math.Max(b.stddev, anomalyMinStddev[metric])
+	z := (value - b.mean) / stddev
+	if math.Abs(z) < anomalyZThreshold {
+		return anomaly{}, false
+	}
+	return anomaly{
+		Metric:         metric,
+		Value:          float32(value),
+		BaselineMean:   float32(b.mean),
+		BaselineStddev: float32(stddev),
+		ZScore:         float32(z),
+		Samples:        uint32(b.samples),
+	}, true
+}
+
+// baselineKey is a city and an hour of day in UTC.
+type baselineKey struct {
+	city string
+	hour uint8
+}
+
+// anomalyBaselines are the baselines of some cities over the last
+// anomalyBaselineDays of hourly averages.
+type anomalyBaselines struct {
+	temp map[baselineKey]baselineStats
+	wind map[baselineKey]baselineStats
+	// pressureChange is the baseline of 3-hour pressure changes.
+	pressureChange map[string]baselineStats
+	// pressureBefore is the average pressure of the hour 3 hours ago.
+	pressureBefore map[string]float64
+}
+
+// detectAnomalies compares freshly stored observations with the baselines of
+// their cities.
+func detectAnomalies(ctx context.Context, observations []cityObservation) ([]anomaly, error) {
+	seen := make(map[string]struct{})
+	ids := make([]string, 0, len(observations))
+	for _, r := range observations {
+		if _, ok := seen[r.city.ID]; !ok {
+			seen[r.city.ID] = struct{}{}
+			ids = append(ids, r.city.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	base, err := metricsDB.anomalyBaselines(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("detectAnomalies: %w", err)
+	}
+
+	now := time.Now()
+	var found []anomaly
+	check := func(r cityObservation, metric string, b baselineStats, value float64) {
+		a, ok := b.check(metric, value)
+		if !ok {
+			return
+		}
+		a.CityID, a.City = r.city.ID, r.city.DisplayName()
+		a.ObservedAt, a.DetectedAt = r.obs.Time, now
+		found = append(found, a)
+	}
+	for _, r := range observations {
+		key := baselineKey{city: r.city.ID, hour: uint8(r.obs.Time.UTC().Hour())}
+		check(r, metricTemp, base.temp[key], float64(r.obs.Temp))
+		check(r, metricWindSpeed, base.wind[key], float64(r.obs.WindSpeed))
+		if before, ok := base.pressureBefore[r.city.ID]; ok {
+			check(r, metricPressureChange, base.pressureChange[r.city.ID], float64(r.obs.Pressure)-before)
+		}
+	}
+	return found, nil
+}
+
+// anomalyBaselines builds the baselines from weather_metrics_hourly.
+func (clickhouseStore) anomalyBaselines(ctx context.Context, ids []string) (anomalyBaselines, error) {
+	base := anomalyBaselines{
+		temp:           make(map[baselineKey]baselineStats),
+		wind:           make(map[baselineKey]baselineStats),
+		pressureChange: make(map[string]baselineStats),
+		pressureBefore: make(map[string]float64),
+	}
+
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT city_id, toHour(hour, 'UTC') AS h, avg(t), stddevPop(t), avg(w), stddevPop(w), count()
+		FROM (
+			SELECT city_id, hour, avgMerge(temp_avg) AS t, avgMerge(wind_speed_avg) AS w
+			FROM weather_metrics_hourly
+			WHERE city_id IN (?) AND hour >= now() - INTERVAL ? DAY AND hour < toStartOfHour(now())
+			GROUP BY city_id, hour
+		)
+		GROUP BY city_id, h`, ids, anomalyBaselineDays)
+	if err != nil {
+		return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: hourly: %w", err)
+	}
+	for rows.Next() {
+		var key baselineKey
+		var t, w baselineStats
+		if err := rows.Scan(&key.city, &key.hour, &t.mean, &t.stddev, &w.mean, &w.stddev, &t.samples); err != nil {
+			rows.Close()
+			return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: scan hourly: %w", err)
+		}
+		w.samples = t.samples
+		base.temp[key], base.wind[key] = t, w
+	}
+	rows.Close()
+
+	rows, err = ClickhouseConn.Query(ctx, `
+		SELECT a.city_id, avg(a.p - b.p), stddevPop(a.p - b.p), count()
+		FROM (
+			SELECT city_id, hour, avgMerge(pressure_avg) AS p
+			FROM weather_metrics_hourly
+			WHERE city_id IN (?) AND hour >= now() - INTERVAL ? DAY AND hour < toStartOfHour(now())
+			GROUP BY city_id, hour
+		) AS a
+		INNER JOIN (
+			SELECT city_id, hour + INTERVAL 3 HOUR AS shifted_hour, avgMerge(pressure_avg) AS p
+			FROM weather_metrics_hourly
+			WHERE city_id IN (?) AND hour >= now() - INTERVAL ? DAY
+			GROUP BY city_id, hour
+		) AS b ON a.city_id = b.city_id AND a.hour = b.shifted_hour
+		GROUP BY a.city_id`, ids, anomalyBaselineDays, ids, anomalyBaselineDays)
+	if err != nil {
+		return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: pressure: %w", err)
+	}
+	for rows.Next() {
+		var city string
+		var b baselineStats
+		if err := rows.Scan(&city, &b.mean, &b.stddev, &b.samples); err != nil {
+			rows.Close()
+			return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: scan pressure: %w", err)
+		}
+		base.pressureChange[city] = b
+	}
+	rows.Close()
+
+	rows, err = ClickhouseConn.Query(ctx, `
+		SELECT city_id, avgMerge(pressure_avg)
+		FROM weather_metrics_hourly
+		WHERE city_id IN (?) AND hour = toStartOfHour(now() - INTERVAL 3 HOUR)
+		GROUP BY city_id`, ids)
+	if err != nil {
+		return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: pressure 3h ago: %w", err)
+	}
+	for rows.Next() {
+		var city string
+		var p float64
+		if err := rows.Scan(&city, &p); err != nil {
+			rows.Close()
+			return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: scan pressure 3h ago: %w", err)
+		}
+		base.pressureBefore[city] = p
+	}
+	rows.Close()
+	return base, nil
+}
+
+func (clickhouseStore) saveAnomalies(ctx context.Context, anomalies []anomaly) error {
+	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO anomalies (city_id, observed_at, detected_at, metric, value, baseline_mean, baseline_stddev, z_score, samples, alerted)")
+	if err != nil {
+		return fmt.Errorf("saveAnomalies: prepare batch: %w", err)
+	}
+	for _, a := range anomalies {
+		if err := batch.Append(a.CityID, a.ObservedAt, a.DetectedAt, a.Metric, a.Value, a.BaselineMean, a.BaselineStddev, a.ZScore, a.Samples, a.Alerted); err != nil {
+			return fmt.Errorf("saveAnomalies: append to batch: %w", err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("saveAnomalies: send batch: %w", err)
+	}
+	return nil
+}
+
+// listAnomalies returns anomalies of the last days, newest first, for one city
+// or for all when cityID is empty.
+func listAnomalies(ctx context.Context, cityID string, days int) ([]anomaly, error) {
+	result, err := metricsDB.anomalies(ctx, cityID, days)
+	if err != nil {
+		return nil, fmt.Errorf("listAnomalies: %w", err)
+	}
+
+	ids := make([]string, len(result))
+	for i, a := range result {
+		ids[i] = a.CityID
+	}
+	for i, name := range cityNames(ids) {
+		result[i].City = name
+	}
+	return result, nil
+}
+
+func (clickhouseStore) anomalies(ctx context.Context, cityID string, days int) ([]anomaly, error) {
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT city_id, observed_at, detected_at, metric, value, baseline_mean, baseline_stddev, z_score, samples, alerted
+		FROM anomalies
+		WHERE observed_at >= now() - INTERVAL ? DAY AND (? = '' OR city_id = ?)
+		ORDER BY observed_at DESC
+		LIMIT 1000`, days, cityID, cityID)
+	if err != nil {
+		return nil, fmt.Errorf("anomalies: %w", err)
+	}
+	defer rows.Close()
+
+	result := []anomaly{}
+	for rows.Next() {
+		var a anomaly
+		if err := rows.Scan(&a.CityID, &a.ObservedAt, &a.DetectedAt, &a.Metric, &a.Value,
+			&a.BaselineMean, &a.BaselineStddev, &a.ZScore, &a.Samples, &a.Alerted); err != nil {
+			return nil, fmt.Errorf("anomalies: scan: %w", err)
+		}
+		result = append(result, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("anomalies: rows: %w", err)
+	}
+	return result, nil
+}
+
+// processAnomalies runs after a collection run on the observations it stored.
+func processAnomalies(ctx context.Context, observations []cityObservation) {
+	anomalies, err := detectAnomalies(ctx, observations)
+	if err != nil {
+		log.Printf("processAnomalies: %v", err)
+		return
+	}
+	if len(anomalies) == 0 {
+		return
+	}
+	log.Printf("processAnomalies: %d anomalies detected", len(anomalies))
+
+	if err := markAlerts(ctx, anomalies); err != nil {
+		log.Printf("processAnomalies: %v", err)
+	}
+	if err := metricsDB.saveAnomalies(ctx, anomalies); err != nil {
+		log.Printf("processAnomalies: %v", err)
+		return
+	}
+	if err := sendAnomalyAlerts(anomalies); err != nil {
+		log.Printf("processAnomalies: %v", err)
+	}
+}
+
+// markAlerts sets Alerted on the anomalies to email: one per city and metric,
+// unless that metric was alerted within anomalyAlertCooldown, so a lasting
+// anomaly produces one email per cooldown rather than one per run. The last
+// alerts are read from the saved anomalies, so the cooldown survives restarts
+// and leader changes. If they cannot be read, nothing is alerted.
+func markAlerts(ctx context.Context, anomalies []anomaly) error {
+	ids := make([]string, 0, len(anomalies))
+	for _, a := range anomalies {
+		ids = append(ids, a.CityID)
+	}
+	alerted, err := metricsDB.alertedSince(ctx, ids, time.Now().Add(-anomalyAlertCooldown))
+	if err != nil {
+		return fmt.Errorf("markAlerts: %w", err)
+	}
+
+	for i, a := range anomalies {
+		key := anomalyAlertKey(a.CityID, a.Metric)
+		if alerted[key] {
+			continue
+		}
+		alerted[key] = true
+		anomalies[i].Alerted = true
+	}
+	return nil
+}
+
+func anomalyAlertKey(cityID, metric string) string {
+	return cityID + "|" + metric
+}
+
+func (clickhouseStore) alertedSince(ctx context.Context, cities []string, since time.Time) (map[string]bool, error) {
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT DISTINCT city_id, metric
+		FROM anomalies
+		WHERE alerted = 1 AND detected_at >= ? AND city_id IN (?)`, since, cities)
+	if err != nil {
+		return nil, fmt.Errorf("alertedSince: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]bool)
+	for rows.Next() {
+		var city, metric string
+		if err := rows.Scan(&city, &metric); err != nil {
+			return nil, fmt.Errorf("alertedSince: scan: %w", err)
+		}
+		result[anomalyAlertKey(city, metric)] = true
+	}
+	return result, rows.Err()
+}
+
+// anomalyEmail is the data of the anomaly_alert email template.
+type anomalyEmail struct {
+	Anomalies []anomalyEmailEntry
+}
+
+type anomalyEmailEntry struct {
+	Name       string
+	Metric     string
+	Unit       string
+	Value      float32
+	Mean       float32
+	ZScore     float32
+	ObservedAt time.Time
+}
+
+var anomalyMetricNames = map[string][2]string{
+	metricTemp:           {"Температура", "°C"},
+	metricWindSpeed:      {"Скорость ветра", "м/с"},
+	metricPressureChange: {"Изменение давления за 3 часа", "гПа"},
+}
+
+// anomalyAlertTask renders the alert about the anomalies of byCity in the
+// subscriptions of r. It returns false when none of them concern r.
+func anomalyAlertTask(r recipient, byCity map[string][]anomaly) (EmailTask, bool, error) {
+	var data anomalyEmail
+	for _, city := range r.cities {
+		for _, a := range byCity[city] {
+			names := anomalyMetricNames[a.Metric]
+			data.Anomalies = append(data.Anomalies, anomalyEmailEntry{
+				Name:       subscriptionName(city, r.labels),
+				Metric:     names[0],
+				Unit:       names[1],
+				Value:      a.Value,
+				Mean:       a.BaselineMean,
+				ZScore:     a.ZScore,
+				ObservedAt: a.ObservedAt,
+			})
+		}
+	}
+	if len(data.Anomalies) == 0 {
+		return EmailTask{}, false, nil
+	}
+
+	task, err := newEmailTask(r.email, "Необычная погода", "anomaly_alert", data)
+	if err != nil {
+		return EmailTask{}, false, err
+	}
+	return task, true, nil
+}
+
+// sendAnomalyAlerts emails the anomalies marked by markAlerts to the
+// subscribers of their cities.
+func sendAnomalyAlerts(anomalies []anomaly) error {
+	byCity := make(map[string][]anomaly)
+	for _, a := range anomalies {
+		if a.Alerted {
+			byCity[a.CityID] = append(byCity[a.CityID], a)
+		}
+	}
+	if len(byCity) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(byCity))
+	for id := range byCity {
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	recipients, err := userDB.recipients(ctx, recipientFilter{alertCities: ids})
+	cancel()
+	if err != nil {
+		return fmt.Errorf("sendAnomalyAlerts: %w", err)
+	}
+
+	for _, r := range recipients {
+		task, ok, err := anomalyAlertTask(r, byCity)
+		if err != nil {
+			log.Printf("sendAnomalyAlerts: render error for %s: %v", r.email, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		ctxPub, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = publishEmailTask(ctxPub, task)
+		cancel()
+		if err != nil {
+			log.Printf("sendAnomalyAlerts: publish error for %s: %v", r.email, err)
+			continue
+		}
+		log.Printf("sendAnomalyAlerts: email task published for %s", r.email)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package weatherservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMarkAlertsCooldown(t *testing.T) {
+	oldDB := metricsDB
+	defer func() { metricsDB = oldDB }()
+	store := newMemoryStore()
+	metricsDB = store
+	ctx := context.Background()
+	now := time.Now()
+
+	// alerted two hours ago: temp of city a is in cooldown, wind is not
+	// alerted at all and the old alert of city b has expired
+	store.anomalyList = []anomaly{
+		{CityID: "a", Metric: metricTemp, DetectedAt: now.Add(-2 * time.Hour), Alerted: true},
+		{CityID: "a", Metric: metricWindSpeed, DetectedAt: now.Add(-2 * time.Hour)},
+		{CityID: "b", Metric: metricTemp, DetectedAt: now.Add(-anomalyAlertCooldown - time.Minute), Alerted: true},
+	}
+
+	found := []anomaly{
+		{CityID: "a", Metric: metricTemp, DetectedAt: now},
+		{CityID: "a", Metric: metricWindSpeed, DetectedAt: now},
+		{CityID: "b", Metric: metricTemp, DetectedAt: now},
+		// a second reading of the same metric in one run is alerted once
+		{CityID: "b", Metric: metricTemp, DetectedAt: now},
+	}
+	if err := markAlerts(ctx, found); err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{false, true, true, false}
+	for i, a := range found {
+		if a.Alerted != want[i] {
+			t.Errorf("%s %s #%d: Alerted = %v, want %v", a.CityID, a.Metric, i, a.Alerted, want[i])
+		}
+	}
+
+	// once saved, the new alerts start their own cooldown
+	if err := store.saveAnomalies(ctx, found); err != nil {
+		t.Fatal(err)
+	}
+	again := []anomaly{{CityID: "b", Metric: metricTemp, DetectedAt: now}}
+	if err := markAlerts(ctx, again); err != nil {
+		t.Fatal(err)
+	}
+	if again[0].Alerted {
+		t.Error("anomaly alerted again within the cooldown")
+	}
+}
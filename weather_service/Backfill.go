@@ -0,0 +1,283 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// backfillDays is how much history a newly registered city gets; 0 disables
+// backfills. The history provider keeps at most maxBackfillDays.
+var backfillDays = min(envDays("BACKFILL_DAYS", 7), maxBackfillDays)
+
+const (
+	maxBackfillDays = 92
+	// backfillChunk is the range fetched and committed at once; progress is
+	// saved after every chunk, so a restart resumes from the last one.
+	backfillChunk = 7 * 24 * time.Hour
+	// backfillTimeout bounds one run of a city; an interrupted run is
+	// resumed from its last chunk.
+	backfillTimeout = 30 * time.Minute
+	// a chunk that keeps failing is retried with backoff up to
+	// backfillMaxAttempts times before the backfill is given up
+	backfillMaxAttempts = 10
+	backfillMaxBackoff  = 6 * time.Hour
+
+	backfillPending = "pending"
+	backfillRunning = "running"
+	backfillDone    = "done"
+	backfillFailed  = "failed"
+)
+
+// backfillProgress is a row of backfill_progress.
+type backfillProgress struct {
+	CityID    string    `json:"city_id"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	DoneUntil time.Time `json:"done_until"`
+	Status    string    `json:"status"`
+	Rows      uint64    `json:"rows"`
+	Error     string    `json:"error,omitempty"`
+	// Attempts counts the failed attempts of the current chunk; the next
+	// one is not made before NextAttemptAt.
+	Attempts      int       `json:"attempts,omitempty"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+var backfillQueue = make(chan backfillProgress, 1000)
+
+// scheduleBackfill queues history backfills for newly registered cities. The
+// history ends where live collection begins.
+func scheduleBackfill(ctx context.Context, cities map[string]CityType) {
+	if backfillDays == 0 || len(cities) == 0 {
+		return
+	}
+
+	to := time.Now().Truncate(time.Hour)
+	from := to.AddDate(0, 0, -backfillDays)
+	for id := range cities {
+		p := backfillProgress{CityID: id, From: from, To: to, DoneUntil: from, Status: backfillPending}
+		if err := metricsDB.saveBackfillProgress(ctx, p); err != nil {
+			log.Printf("scheduleBackfill: %v", err)
+			continue
+		}
+		select {
+		case backfillQueue <- p:
+		default:
+			// stays pending in the table and is picked up by the next resume
+			log.Printf("scheduleBackfill: queue full, %s will be resumed later", id)
+		}
+	}
+}
+
+// startBackfillWorker runs queued backfills of newly registered cities. Only
+// the leader of jobBackfill runs them; other replicas leave them pending in the
+// table for resumeBackfills.
+func startBackfillWorker() {
+	log.Println("startBackfillWorker: started")
+
+	go func() {
+		for p := range backfillQueue {
+			if isLeader(jobBackfill) {
+				ctx, cancel := context.WithTimeout(context.Background(), backfillTimeout)
+				runBackfill(ctx, p)
+				cancel()
+			}
+		}
+	}()
+}
+
+// resumeBackfills runs the unfinished backfills, e.g. those interrupted by a
+// restart, queued on another replica or due for a retry.
+func resumeBackfills(ctx context.Context) error {
+	pending, err := metricsDB.listBackfillProgress(ctx, "", backfillPending, backfillRunning)
+	if err != nil {
+		return fmt.Errorf("resumeBackfills: %w", err)
+	}
+	for _, p := range pending {
+		if ctx.Err() != nil {
+			return fmt.Errorf("resumeBackfills: %w", ctx.Err())
+		}
+		if p.NextAttemptAt.After(time.Now()) {
+			continue
+		}
+		runBackfill(ctx, p)
+	}
+	return nil
+}
+
+// backfillMu runs backfills one at a time, so history requests do not compete
+// with live collection for the provider's limits.
+var backfillMu sync.Mutex
+
+func runBackfill(ctx context.Context, p backfillProgress) {
+	backfillMu.Lock()
+	defer backfillMu.Unlock()
+
+	// the queued copy may be stale after a resume already handled the city
+	current, err := metricsDB.listBackfillProgress(ctx, p.CityID)
+	if err == nil && len(current) == 1 {
+		p = current[0]
+	}
+	if p.Status == backfillDone || p.Status == backfillFailed || p.NextAttemptAt.After(time.Now()) {
+		return
+	}
+
+	city, ok := backfillCity(ctx, p.CityID)
+	if !ok {
+		p.Status, p.Error = backfillFailed, "city is not registered"
+		if err := metricsDB.saveBackfillProgress(ctx, p); err != nil {
+			log.Printf("runBackfill: %v", err)
+		}
+		return
+	}
+
+	log.Printf("runBackfill: %s from %s to %s", city.DisplayName(), p.DoneUntil.Format(time.RFC3339), p.To.Format(time.RFC3339))
+	for p.DoneUntil.Before(p.To) {
+		chunkEnd := p.DoneUntil.Add(backfillChunk)
+		if chunkEnd.After(p.To) {
+			chunkEnd = p.To
+		}
+
+		n, err := backfillChunkRange(ctx, city, p.DoneUntil, chunkEnd)
+		if err != nil {
+			if ctx.Err() != nil {
+				// not the chunk's fault: the next resume carries on
+				log.Printf("runBackfill: %s interrupted: %v", city.DisplayName(), err)
+				return
+			}
+			p.Error = err.Error()
+			p.Attempts++
+			if permanentBackfillError(err) || p.Attempts >= backfillMaxAttempts {
+				log.Printf("runBackfill: %s failed after %d attempts: %v", city.DisplayName(), p.Attempts, err)
+				p.Status = backfillFailed
+			} else {
+				retry := backfillBackoff(p.Attempts)
+				log.Printf("runBackfill: %s: retry in %s: %v", city.DisplayName(), retry, err)
+				p.Status, p.NextAttemptAt = backfillPending, time.Now().Add(retry)
+			}
+			// a fresh context: ctx may run out while the chunk is retried
+			saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := metricsDB.saveBackfillProgress(saveCtx, p); err != nil {
+				log.Printf("runBackfill: %v", err)
+			}
+			return
+		}
+
+		p.DoneUntil = chunkEnd
+		p.Rows += uint64(n)
+		p.Status, p.Error, p.Attempts, p.NextAttemptAt = backfillRunning, "", 0, time.Time{}
+		if !p.DoneUntil.Before(p.To) {
+			p.Status = backfillDone
+		}
+		if err := metricsDB.saveBackfillProgress(ctx, p); err != nil {
+			log.Printf("runBackfill: %v", err)
+		}
+	}
+	log.Printf("runBackfill: %s done, %d rows", city.DisplayName(), p.Rows)
+}
+
+// permanentBackfillError reports whether retrying the chunk cannot help: the
+// provider rejected the request itself rather than failing to answer it.
+func permanentBackfillError(err error) bool {
+	var statusErr *upstreamStatusError
+	return errors.As(err, &statusErr) && !statusErr.retryable()
+}
+
+// backfillBackoff is the delay before the next attempt of a chunk that failed
+// attempts times: 5m, 10m, 20m and so on up to backfillMaxBackoff.
+func backfillBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return backfillMaxBackoff
+	}
+	return min(5*time.Minute<<(attempts-1), backfillMaxBackoff)
+}
+
+// backfillCity looks the city up, reloading the cities once if it was
+// registered through another replica.
+func backfillCity(ctx context.Context, id string) (CityType, bool) {
+	mapMu.RLock()
+	city, ok := mapOfCities[id]
+	mapMu.RUnlock()
+	if ok {
+		return city, true
+	}
+
+	if err := loadCities(ctx); err != nil {
+		log.Printf("backfillCity: %v", err)
+	}
+	mapMu.RLock()
+	defer mapMu.RUnlock()
+	city, ok = mapOfCities[id]
+	return city, ok
+}
+
+func backfillChunkRange(ctx context.Context, city CityType, from, to time.Time) (int, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	history, err := historyProvider.History(fetchCtx, city, from, to)
+	if err != nil {
+		return 0, fmt.Errorf("backfillChunkRange: %s: %w", historyProvider.Name(), err)
+	}
+	if len(history) == 0 {
+		return 0, nil
+	}
+
+	observations := make([]cityObservation, 0, len(history))
+	for _, obs := range history {
+		obs.Source = observationSourceBackfill
+		observations = append(observations, cityObservation{city: city, obs: obs})
+	}
+	if err := insertObservations(ctx, observations); err != nil {
+		return 0, fmt.Errorf("backfillChunkRange: %w", err)
+	}
+	return len(observations), nil
+}
+
+func (clickhouseStore) saveBackfillProgress(ctx context.Context, p backfillProgress) error {
+	err := ClickhouseConn.Exec(ctx, `
+		INSERT INTO backfill_progress (city_id, range_from, range_to, done_until, status, rows, error, attempts, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.CityID, p.From, p.To, p.DoneUntil, p.Status, p.Rows, p.Error, uint32(p.Attempts), dateTimeOrEpoch(p.NextAttemptAt))
+	if err != nil {
+		return fmt.Errorf("saveBackfillProgress: %s: %w", p.CityID, err)
+	}
+	return nil
+}
+
+func (clickhouseStore) listBackfillProgress(ctx context.Context, cityID string, statuses ...string) ([]backfillProgress, error) {
+	query := `
+		SELECT city_id, range_from, range_to, done_until, status, rows, error, attempts, next_attempt_at, updated_at
+		FROM backfill_progress FINAL
+		WHERE (? = '' OR city_id = ?)`
+	args := []interface{}{cityID, cityID}
+	if len(statuses) > 0 {
+		query += " AND status IN (?)"
+		args = append(args, statuses)
+	}
+	query += " ORDER BY updated_at DESC"
+
+	rows, err := ClickhouseConn.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listBackfillProgress: %w", err)
+	}
+	defer rows.Close()
+
+	result := []backfillProgress{}
+	for rows.Next() {
+		var p backfillProgress
+		var attempts uint32
+		if err := rows.Scan(&p.CityID, &p.From, &p.To, &p.DoneUntil, &p.Status, &p.Rows, &p.Error, &attempts, &p.NextAttemptAt, &p.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("listBackfillProgress: scan: %w", err)
+		}
+		p.Attempts = int(attempts)
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
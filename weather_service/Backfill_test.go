@@ -0,0 +1,142 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stubHistory is a HistoryProvider that fails with err, or returns an
+// observation per hour when err is nil.
+type stubHistory struct {
+	err *error
+}
+
+func (stubHistory) Name() string { return "stub" }
+
+func (h stubHistory) History(ctx context.Context, city CityType, from, to time.Time) ([]Observation, error) {
+	if *h.err != nil {
+		return nil, *h.err
+	}
+	var history []Observation
+	for t := from; t.Before(to); t = t.Add(time.Hour) {
+		history = append(history, Observation{Time: t})
+	}
+	return history, nil
+}
+
+func TestRunBackfillRetries(t *testing.T) {
+	oldDB, oldHistory := metricsDB, historyProvider
+	defer func() { metricsDB, historyProvider = oldDB, oldHistory }()
+	store := newMemoryStore()
+	metricsDB = store
+	var fetchErr error
+	historyProvider = stubHistory{err: &fetchErr}
+
+	mapMu.Lock()
+	oldCities := mapOfCities
+	mapOfCities = map[string]CityType{"c1": {ID: "c1", Name: "One", Status: cityStatusActive}}
+	mapMu.Unlock()
+	defer func() {
+		mapMu.Lock()
+		mapOfCities = oldCities
+		mapMu.Unlock()
+	}()
+
+	ctx := context.Background()
+	to := time.Now().Truncate(time.Hour)
+	from := to.Add(-2 * backfillChunk)
+	start := backfillProgress{CityID: "c1", From: from, To: to, DoneUntil: from, Status: backfillPending}
+	progress := func() backfillProgress {
+		t.Helper()
+		found, err := store.listBackfillProgress(ctx, "c1")
+		if err != nil || len(found) != 1 {
+			t.Fatalf("listBackfillProgress = %v, %v", found, err)
+		}
+		return found[0]
+	}
+	run := func(ctx context.Context, p backfillProgress) {
+		t.Helper()
+		if err := store.saveBackfillProgress(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		runBackfill(ctx, p)
+	}
+
+	// a transient error leaves the backfill pending until its retry is due
+	fetchErr = &upstreamStatusError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}
+	run(ctx, start)
+	p := progress()
+	if p.Status != backfillPending || p.Attempts != 1 || !p.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("after a 429: status %s, attempts %d, next attempt %s; want a pending retry", p.Status, p.Attempts, p.NextAttemptAt)
+	}
+
+	fetchErr = nil
+	if err := resumeBackfills(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p := progress(); p.Status != backfillPending || p.Rows != 0 {
+		t.Fatalf("resumeBackfills ran a retry before it was due: %+v", p)
+	}
+
+	p.NextAttemptAt = time.Now().Add(-time.Second)
+	if err := store.saveBackfillProgress(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := resumeBackfills(ctx); err != nil {
+		t.Fatal(err)
+	}
+	p = progress()
+	if p.Status != backfillDone || p.Attempts != 0 || p.Error != "" || !p.DoneUntil.Equal(to) {
+		t.Errorf("after the retry: %+v, want done", p)
+	}
+
+	// a request the provider rejects is not retried
+	fetchErr = &upstreamStatusError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+	run(ctx, start)
+	if p := progress(); p.Status != backfillFailed || p.Attempts != 1 {
+		t.Errorf("after a 400: status %s, attempts %d; want failed", p.Status, p.Attempts)
+	}
+
+	// neither is one that keeps failing
+	fetchErr = errors.New("connection reset")
+	last := start
+	last.Attempts = backfillMaxAttempts - 1
+	run(ctx, last)
+	if p := progress(); p.Status != backfillFailed || p.Attempts != backfillMaxAttempts {
+		t.Errorf("after %d attempts: status %s, attempts %d; want failed", backfillMaxAttempts, p.Status, p.Attempts)
+	}
+
+	// a cancelled run is resumed later without counting an attempt
+	if err := store.saveBackfillProgress(ctx, start); err != nil {
+		t.Fatal(err)
+	}
+	fetchErr = context.Canceled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	runBackfill(cancelled, start)
+	if p := progress(); p.Status != backfillPending || p.Attempts != 0 || p.Error != "" {
+		t.Errorf("a cancelled run counted as an attempt: %+v", p)
+	}
+}
+
+func TestBackfillBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{4, 40 * time.Minute},
+		{7, 320 * time.Minute},
+		{8, backfillMaxBackoff},
+		{100, backfillMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backfillBackoff(tt.attempts); got != tt.want {
+			t.Errorf("backfillBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package weatherservice
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+const (
+	chartWidth   = 480
+	chartHeight  = 120
+	chartPadding = 8
+)
+
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartGrid       = color.RGBA{0xe6, 0xe6, 0xe6, 0xff}
+	chartTempColor  = color.RGBA{0xe0, 0x4b, 0x2f, 0xff}
+	chartWindColor  = color.RGBA{0x2f, 0x7d, 0xe0, 0xff}
+)
+
+// renderForecastChart draws a sparkline PNG with the temperature (red) and the
+// wind speed (blue) series. Each series is scaled to its own range so both
+// stay readable; the legend with the actual values lives in the email text.
+func renderForecastChart(temps, winds []float32) ([]byte, error) {
+	if len(temps) < 2 && len(winds) < 2 {
+		return nil, fmt.Errorf("renderForecastChart: not enough points")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	for y := 0; y < chartHeight; y++ {
+		for x := 0; x < chartWidth; x++ {
+			img.Set(x, y, chartBackground)
+		}
+	}
+
+	for i := 0; i <= 4; i++ {
+		y := chartPadding + i*(chartHeight-2*chartPadding)/4
+		for x := chartPadding; x < chartWidth-chartPadding; x++ {
+			img.Set(x, y, chartGrid)
+		}
+	}
+
+	drawSeries(img, winds, chartWindColor)
+	drawSeries(img, temps, chartTempColor)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("renderForecastChart: encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func drawSeries(img *image.RGBA, values []float32, c color.Color) {
+	if len(values) < 2 {
+		return
+	}
+
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo = min(lo, v)
+		hi = max(hi, v)
+	}
+	if hi-lo < 1 {
+		// a flat line in the middle instead of noise blown up to full height
+		mid := (hi + lo) / 2
+		lo, hi = mid-0.5, mid+0.5
+	}
+
+	w := float32(chartWidth - 2*chartPadding)
+	h := float32(chartHeight - 2*chartPadding)
+	point := func(i int) (int, int) {
+		x := chartPadding + int(w*float32(i)/float32(len(values)-1))
+		y := chartPadding + int(h*(hi-values[i])/(hi-lo))
+		return x, y
+	}
+
+	x0, y0 := point(0)
+	for i := 1; i < len(values); i++ {
+		x1, y1 := point(i)
+		drawLine(img, x0, y0, x1, y1, c)
+		x0, y0 = x1, y1
+	}
+}
+
+// drawLine is Bresenham's algorithm with a 2px pen so the line survives
+// downscaling in mail clients.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+
+	for {
+		img.Set(x0, y0, c)
+		img.Set(x0, y0+1, c)
+		img.Set(x0+1, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
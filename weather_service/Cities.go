@@ -0,0 +1,240 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type CityType struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Country string  `json:"country"`
+	State   string  `json:"state,omitempty"`
+	Kind    string  `json:"kind,omitempty"`
+	Lat     float32 `json:"lat"`
+	Lon     float32 `json:"lon"`
+	// Status is one of the cityStatus* values; MergedInto is set for merged
+	// cities and names the city that replaced them.
+	Status     string `json:"status,omitempty"`
+	MergedInto string `json:"merged_into,omitempty"`
+}
+
+// cityNamespace is the UUIDv5 namespace for city IDs. Never change it: the IDs
+// are stored in user_cities and weather_metrics.city_id.
+var cityNamespace = uuid.MustParse("6f1b7c5e-2a44-4c1e-9a52-0e7f3f1f5c11")
+
+// cityMatchDegrees is how far apart, in degrees of latitude and longitude, a
+// geocoded place and a registered city of the same name may lie to be taken
+// for the same city.
+const cityMatchDegrees = 0.1
+
+// cityID derives the ID of a geocoded place from its country, name and
+// coordinates rounded to 0.01°, so places with the same name in one state get
+// different IDs. The state is left out because providers spell it
+// differently ("Île-de-France", "Ile-de-France"). Geocoders may move a city's
+// point between releases, so searchCities gives a place the ID of the
+// registered city it matches before falling back to cityID.
+func cityID(c CityType) string {
+	key := strings.ToLower(strings.Join([]string{
+		"city", strings.TrimSpace(c.Country), strings.TrimSpace(c.Name),
+		fmt.Sprintf("%.2f,%.2f", c.Lat, c.Lon),
+	}, "|"))
+	return uuid.NewSHA1(cityNamespace, []byte(key)).String()
+}
+
+// legacyCityID is the ID migrateLegacyCities gave the cities of the
+// name-keyed schema. The data migrations recompute it, so it must not change.
+func legacyCityID(name string) string {
+	key := strings.ToLower("||" + strings.TrimSpace(name))
+	return uuid.NewSHA1(cityNamespace, []byte(key)).String()
+}
+
+// registeredCityNear returns the registered city with the name and country of
+// c that lies nearest to it within cityMatchDegrees.
+func registeredCityNear(c CityType) (CityType, bool) {
+	mapMu.RLock()
+	defer mapMu.RUnlock()
+
+	var best CityType
+	bestDist := math.Inf(1)
+	for _, r := range mapOfCities {
+		if r.Kind == cityKindPoint || !strings.EqualFold(r.Name, c.Name) || !strings.EqualFold(r.Country, c.Country) {
+			continue
+		}
+		dLat, dLon := math.Abs(float64(r.Lat-c.Lat)), math.Abs(float64(r.Lon-c.Lon))
+		if dLat > cityMatchDegrees || dLon > cityMatchDegrees {
+			continue
+		}
+		if d := dLat + dLon; d < bestDist || (d == bestDist && r.ID < best.ID) {
+			best, bestDist = r, d
+		}
+	}
+	return best, !math.IsInf(bestDist, 1)
+}
+
+// DisplayName is the name shown to users, qualified enough to tell apart
+// places with the same name.
+func (c CityType) DisplayName() string {
+	parts := []string{c.Name}
+	if c.State != "" {
+		parts = append(parts, c.State)
+	}
+	if c.Country != "" {
+		parts = append(parts, c.Country)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// errAmbiguousCity is returned when a city name matches several places. The
+// caller should repeat the request with one of the candidate IDs or with a
+// qualified name such as "Springfield, Illinois, US".
+type errAmbiguousCity struct {
+	Query      string     `json:"query"`
+	Candidates []CityType `json:"candidates"`
+}
+
+func (e *errAmbiguousCity) Error() string {
+	names := make([]string, 0, len(e.Candidates))
+	for _, c := range e.Candidates {
+		names = append(names, c.DisplayName())
+	}
+	return fmt.Sprintf("city %q is ambiguous: %s", e.Query, strings.Join(names, "; "))
+}
+
+var (
+	// candidateCities keeps places returned by searchCities so that their IDs
+	// can be subscribed to before they are registered.
+	candidateCities   = make(map[string]CityType)
+	candidateMu       sync.Mutex
+	maxCandidateCache = 10000
+)
+
+func rememberCandidates(cities []CityType) {
+	candidateMu.Lock()
+	defer candidateMu.Unlock()
+
+	if len(candidateCities)+len(cities) > maxCandidateCache {
+		candidateCities = make(map[string]CityType)
+	}
+	for _, c := range cities {
+		candidateCities[c.ID] = c
+	}
+}
+
+// searchCities geocodes a free-text query into distinct candidates.
+func searchCities(ctx context.Context, query string) ([]CityType, error) {
+	name, state, country := parseCityQuery(query)
+	if name == "" {
+		return nil, fmt.Errorf("searchCities: empty city name")
+	}
+
+	found, err := weatherProvider.Geocode(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("searchCities: %w", err)
+	}
+
+	seen := make(map[string]struct{})
+	result := make([]CityType, 0, len(found))
+	for _, c := range found {
+		if country != "" && !strings.EqualFold(c.Country, country) {
+			continue
+		}
+		if state != "" && !strings.EqualFold(c.State, state) {
+			continue
+		}
+		c.ID = cityID(c)
+		if r, ok := registeredCityNear(c); ok {
+			c.ID = r.ID
+		}
+		c.Kind = cityKindCity
+		// the same place listed twice; distinct places have distinct IDs
+		if _, ok := seen[c.ID]; ok {
+			continue
+		}
+		seen[c.ID] = struct{}{}
+		result = append(result, c)
+	}
+
+	rememberCandidates(result)
+	return result, nil
+}
+
+// resolveCity turns a subscription entry into a city. The entry is either a
+// city ID (registered or returned by searchCities) or a name optionally
+// qualified with state and country: "Paris", "Paris, FR", "Paris, Texas, US".
+// A merged city resolves to the city it was merged into.
+func resolveCity(ctx context.Context, entry string) (CityType, error) {
+	city, err := resolveCityEntry(ctx, entry)
+	if err != nil {
+		return CityType{}, err
+	}
+	return followMerges(city), nil
+}
+
+func resolveCityEntry(ctx context.Context, entry string) (CityType, error) {
+	mapMu.RLock()
+	city, ok := mapOfCities[entry]
+	mapMu.RUnlock()
+	if ok {
+		return city, nil
+	}
+
+	candidateMu.Lock()
+	city, ok = candidateCities[entry]
+	candidateMu.Unlock()
+	if ok {
+		return city, nil
+	}
+
+	if _, err := uuid.Parse(entry); err == nil {
+		return CityType{}, fmt.Errorf("resolveCity: unknown city id %s, search for the city again", entry)
+	}
+
+	candidates, err := searchCities(ctx, entry)
+	if err != nil {
+		return CityType{}, err
+	}
+	switch len(candidates) {
+	case 0:
+		return CityType{}, fmt.Errorf("resolveCity: no results for city %s", entry)
+	case 1:
+		return candidates[0], nil
+	}
+	return CityType{}, &errAmbiguousCity{Query: entry, Candidates: candidates}
+}
+
+func parseCityQuery(query string) (name, state, country string) {
+	parts := strings.Split(query, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	switch len(parts) {
+	case 1:
+		return parts[0], "", ""
+	case 2:
+		return parts[0], "", parts[1]
+	}
+	return parts[0], strings.Join(parts[1:len(parts)-1], ","), parts[len(parts)-1]
+}
+
+// cityNames maps city IDs to display names for emails, keeping unknown IDs as
+// they are.
+func cityNames(ids []string) []string {
+	mapMu.RLock()
+	defer mapMu.RUnlock()
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if c, ok := mapOfCities[id]; ok {
+			names = append(names, c.DisplayName())
+		} else {
+			names = append(names, id)
+		}
+	}
+	return names
+}
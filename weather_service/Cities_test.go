@@ -0,0 +1,175 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCityID(t *testing.T) {
+	paris := CityType{Name: "Paris", State: "Île-de-France", Country: "FR", Lat: 48.8534, Lon: 2.3488}
+	id := cityID(paris)
+	// the IDs are stored: the derivation must never change
+	if id != "584132c9-63b1-5888-a50c-490201810b37" {
+		t.Fatalf("cityID(Paris) = %s, the stored IDs would no longer match", id)
+	}
+	if got := legacyCityID("Moscow"); got != "960e937a-16e6-5ca1-b1e7-e2d023da86a1" {
+		t.Fatalf("legacyCityID(Moscow) = %s, the migrations would no longer match", got)
+	}
+
+	same := []CityType{
+		{Name: " paris ", State: "Île-de-France", Country: "fr ", Lat: 48.8534, Lon: 2.3488},
+		// providers spell the state differently
+		{Name: "Paris", State: "Ile-de-France", Country: "FR", Lat: 48.8534, Lon: 2.3488},
+		{Name: "Paris", Country: "FR", Lat: 48.8534, Lon: 2.3488},
+		{Name: "Paris", Country: "FR", Lat: 48.8512, Lon: 2.3456},
+	}
+	for _, c := range same {
+		if got := cityID(c); got != id {
+			t.Errorf("cityID(%+v) = %s, want the ID of Paris, FR %s", c, got, id)
+		}
+	}
+
+	other := []CityType{
+		{Name: "Paris", State: "Texas", Country: "US", Lat: 33.66, Lon: -95.55},
+		{Name: "Paris", State: "Île-de-France", Country: "CA", Lat: 48.8534, Lon: 2.3488},
+		{Name: "Paris", State: "Île-de-France", Country: "FR", Lat: 48.9, Lon: 2.3488},
+	}
+	for _, c := range other {
+		if cityID(c) == id {
+			t.Errorf("cityID(%+v) = the ID of Paris, FR", c)
+		}
+	}
+}
+
+func TestParseCityQuery(t *testing.T) {
+	tests := []struct {
+		query                string
+		name, state, country string
+	}{
+		{"Paris", "Paris", "", ""},
+		{"  Paris  ", "Paris", "", ""},
+		{"Paris, FR", "Paris", "", "FR"},
+		{"Paris,Texas,US", "Paris", "Texas", "US"},
+		{"Springfield, Illinois, US", "Springfield", "Illinois", "US"},
+		// everything between the name and the country is the state
+		{"Rome, Lazio, Metropolitan City, IT", "Rome", "Lazio,Metropolitan City", "IT"},
+		{"", "", "", ""},
+		{", FR", "", "", "FR"},
+	}
+	for _, tt := range tests {
+		name, state, country := parseCityQuery(tt.query)
+		if name != tt.name || state != tt.state || country != tt.country {
+			t.Errorf("parseCityQuery(%q) = %q, %q, %q; want %q, %q, %q",
+				tt.query, name, state, country, tt.name, tt.state, tt.country)
+		}
+	}
+}
+
+// geocodeProvider is a WeatherProvider that only geocodes.
+type geocodeProvider []CityType
+
+func (geocodeProvider) Name() string { return "geocode" }
+
+func (geocodeProvider) CurrentWeather(context.Context, CityType) (Observation, error) {
+	return Observation{}, errors.New("not supported")
+}
+
+func (geocodeProvider) Forecast(context.Context, CityType) ([]ForecastPoint, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p geocodeProvider) Geocode(context.Context, string) ([]CityType, error) {
+	return p, nil
+}
+
+func TestSearchCities(t *testing.T) {
+	old := weatherProvider
+	defer func() { weatherProvider = old }()
+	weatherProvider = geocodeProvider{
+		{Name: "Springfield", State: "Illinois", Country: "US", Lat: 39.8, Lon: -89.6},
+		{Name: "Springfield", State: "Missouri", Country: "US", Lat: 37.2, Lon: -93.3},
+		// another town of the same name in the same state
+		{Name: "Springfield", State: "Illinois", Country: "US", Lat: 41.1, Lon: -88.1},
+		{Name: "Springfield", State: "Tasmania", Country: "AU", Lat: -41.2, Lon: 147.4},
+		// the first one again, as another source of the provider lists it
+		{Name: "Springfield", State: "IL", Country: "US", Lat: 39.8, Lon: -89.6},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"Springfield", []string{"Illinois", "Missouri", "Illinois", "Tasmania"}},
+		{"Springfield, us", []string{"Illinois", "Missouri", "Illinois"}},
+		{"Springfield, missouri, US", []string{"Missouri"}},
+		{"Springfield, Ohio, US", nil},
+	}
+	for _, tt := range tests {
+		found, err := searchCities(ctx, tt.query)
+		if err != nil {
+			t.Fatalf("searchCities(%q): %v", tt.query, err)
+		}
+		var states []string
+		for _, c := range found {
+			if c.ID != cityID(c) || c.Kind != cityKindCity {
+				t.Errorf("searchCities(%q): candidate %+v without its ID or kind", tt.query, c)
+			}
+			states = append(states, c.State)
+		}
+		if len(states) != len(tt.want) {
+			t.Errorf("searchCities(%q) states = %v, want %v", tt.query, states, tt.want)
+			continue
+		}
+		for i := range states {
+			if states[i] != tt.want[i] {
+				t.Errorf("searchCities(%q) states = %v, want %v", tt.query, states, tt.want)
+				break
+			}
+		}
+	}
+
+	// two towns in one state are ambiguous rather than one of them dropped
+	_, err := resolveCityEntry(ctx, "Springfield, Illinois, US")
+	var ambiguous *errAmbiguousCity
+	if !errors.As(err, &ambiguous) || len(ambiguous.Candidates) != 2 {
+		t.Errorf("resolveCityEntry(Springfield, Illinois, US) = %v, want both towns as candidates", err)
+	}
+
+	if _, err := searchCities(ctx, " , US"); err == nil {
+		t.Error("searchCities accepted a query without a name")
+	}
+}
+
+func TestSearchCitiesKeepsRegisteredIDs(t *testing.T) {
+	old := weatherProvider
+	defer func() { weatherProvider = old }()
+	mapMu.Lock()
+	oldCities := mapOfCities
+	// registered under an ID of an earlier derivation, at a point the
+	// geocoder has since moved
+	mapOfCities = map[string]CityType{
+		"registered": {ID: "registered", Name: "Springfield", State: "Illinois", Country: "US", Kind: cityKindCity, Lat: 39.78, Lon: -89.65},
+	}
+	mapMu.Unlock()
+	defer func() {
+		mapMu.Lock()
+		mapOfCities = oldCities
+		mapMu.Unlock()
+	}()
+	weatherProvider = geocodeProvider{
+		{Name: "Springfield", State: "IL", Country: "US", Lat: 39.8, Lon: -89.6},
+		{Name: "Springfield", State: "Illinois", Country: "US", Lat: 41.1, Lon: -88.1},
+	}
+
+	found, err := searchCities(context.Background(), "Springfield, US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].ID != "registered" || found[1].ID != cityID(found[1]) {
+		t.Errorf("searchCities = %+v, want the registered ID for the first town only", found)
+	}
+}
@@ -18,12 +18,6 @@ var (
 	mapMu          sync.RWMutex
 )
 
-type CityType struct {
-	Name string  `json:"name"`
-	Lat  float32 `json:"lat"`
-	Lon  float32 `json:"lon"`
-}
-
 func InitClickhouse() error {
 	host := os.Getenv("CLICKHOUSE_HOST")
 	port := os.Getenv("CLICKHOUSE_PORT")
@@ -51,168 +45,268 @@ func InitClickhouse() error {
 	}
 
 	ClickhouseConn = conn
-
-	if err := createTables(); err != nil {
-		return fmt.Errorf("failed to create tables: %v", err)
-	}
-
-	startPeriodicDataCollection(10 * 60)
-	log.Println("InitClickhouse: ready and periodic task started")
+	log.Println("InitClickhouse: connected")
 
 	return nil
 }
 
-func createTables() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// clickhouseStore keeps cities and weather data in ClickHouse.
+type clickhouseStore struct{}
 
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS weather_metrics ( 
-                timestamp Datetime, 
-                city String,
-                temp Float32,
-                app_temp Float32,
-                pressure Int16,
-                wind_speed Float32,
-                wind_deg Int16
-            ) ENGINE = MergeTree()
-            PARTITION BY toYYYYMM(timestamp)
-            ORDER BY timestamp`,
-
-		`CREATE TABLE IF NOT EXISTS cities(
-			city String,
-			lat Float32,
-			lon Float32
-		) ENGINE = MergeTree()
-		ORDER BY (city)`,
+// loadCities fills mapOfCities from the city store.
+func loadCities(ctx context.Context) error {
+	cities, err := cityDB.readCities(ctx)
+	if err != nil {
+		return fmt.Errorf("loadCities: %w", err)
 	}
 
-	for _, query := range queries {
-		if err := ClickhouseConn.Exec(ctx, query); err != nil {
-			return fmt.Errorf("failed to create table: %v", err)
-		}
+	mapMu.Lock()
+	defer mapMu.Unlock()
+
+	for _, city := range cities {
+		mapOfCities[city.ID] = city
 	}
 
-	rows, err := ClickhouseConn.Query(ctx, "SELECT city, lat, lon FROM cities")
+	log.Printf("loadCities: loaded %d cities from DB", len(mapOfCities))
+
+	return nil
+}
+
+func (clickhouseStore) readCities(ctx context.Context) ([]CityType, error) {
+	rows, err := ClickhouseConn.Query(ctx, "SELECT id, name, country, state, kind, lat, lon, status, merged_into FROM cities FINAL")
 	if err != nil {
-		return fmt.Errorf("initClickHouse: select cities: %w", err)
+		return nil, fmt.Errorf("select cities: %w", err)
 	}
 	defer rows.Close()
 
+	var cities []CityType
 	for rows.Next() {
-		var city string
-		var lat, lon float32
+		var city CityType
 
-		if err := rows.Scan(&city, &lat, &lon); err != nil {
-			log.Printf("initClickHouse: scan error: %v", err)
+		if err := rows.Scan(&city.ID, &city.Name, &city.Country, &city.State, &city.Kind, &city.Lat, &city.Lon, &city.Status, &city.MergedInto); err != nil {
+			log.Printf("readCities: scan error: %v", err)
 			continue
 		}
 
-		mapOfCities[city] = CityType{
-			Name: city,
-			Lat:  lat,
-			Lon:  lon,
+		cities = append(cities, city)
+	}
+	return cities, rows.Err()
+}
+
+// migrateLegacyCities converts the old cities table, keyed by name only, to
+// the ID-keyed layout. Country and state of legacy rows are unknown, so their
+// IDs are derived from the name alone. The old table is kept as cities_legacy.
+func migrateLegacyCities(ctx context.Context) error {
+	var legacy uint64
+	if err := ClickhouseConn.QueryRow(ctx, `
+		SELECT count() FROM system.columns
+		WHERE database = currentDatabase() AND table = 'cities' AND name = 'city'`).Scan(&legacy); err != nil {
+		return fmt.Errorf("migrateLegacyCities: inspect cities: %w", err)
+	}
+	if legacy == 0 {
+		return nil
+	}
+	log.Println("migrateLegacyCities: converting cities table to id-keyed layout")
+
+	rows, err := ClickhouseConn.Query(ctx, "SELECT city, lat, lon FROM cities")
+	if err != nil {
+		return fmt.Errorf("migrateLegacyCities: select legacy cities: %w", err)
+	}
+	var cities []CityType
+	for rows.Next() {
+		var c CityType
+		if err := rows.Scan(&c.Name, &c.Lat, &c.Lon); err != nil {
+			rows.Close()
+			return fmt.Errorf("migrateLegacyCities: scan: %w", err)
+		}
+		c.ID = legacyCityID(c.Name)
+		cities = append(cities, c)
+	}
+	rows.Close()
+
+	if err := ClickhouseConn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS cities_v2(
+			id String,
+			name String,
+			country String,
+			state String,
+			lat Float32,
+			lon Float32,
+			updated_at DateTime DEFAULT now()
+		) ENGINE = ReplacingMergeTree(updated_at)
+		ORDER BY (id)`); err != nil {
+		return fmt.Errorf("migrateLegacyCities: create cities_v2: %w", err)
+	}
+
+	if len(cities) > 0 {
+		batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO cities_v2 (id, name, country, state, lat, lon)")
+		if err != nil {
+			return fmt.Errorf("migrateLegacyCities: prepare batch: %w", err)
+		}
+		for _, c := range cities {
+			if err := batch.Append(c.ID, c.Name, c.Country, c.State, c.Lat, c.Lon); err != nil {
+				return fmt.Errorf("migrateLegacyCities: append to batch: %w", err)
+			}
+		}
+		if err := batch.Send(); err != nil {
+			return fmt.Errorf("migrateLegacyCities: send batch: %w", err)
 		}
 	}
 
-	log.Printf("initClickHouse: loaded %d cities from DB", len(mapOfCities))
+	if err := ClickhouseConn.Exec(ctx, "RENAME TABLE cities TO cities_legacy, cities_v2 TO cities"); err != nil {
+		return fmt.Errorf("migrateLegacyCities: rename tables: %w", err)
+	}
 
+	log.Printf("migrateLegacyCities: migrated %d cities", len(cities))
 	return nil
 }
 
-func addCitiesToDB(cities []string) ([]string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// backfillMetricsCityIDs fills weather_metrics.city_id for rows written before
+// cities had IDs. Only legacy cities can have such rows and their ID is known
+// from the name, so a single mutation does it. The mutation is waited for, as
+// the rollups backfilled by later migrations skip rows without city_id.
+func backfillMetricsCityIDs(ctx context.Context) error {
+	var legacy uint64
+	if err := ClickhouseConn.QueryRow(ctx, `
+		SELECT count() FROM system.tables
+		WHERE database = currentDatabase() AND name = 'cities_legacy'`).Scan(&legacy); err != nil {
+		return fmt.Errorf("backfillMetricsCityIDs: inspect tables: %w", err)
+	}
+	if legacy == 0 {
+		return nil
+	}
 
-	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO cities (city, lat, lon)")
+	var pending uint64
+	if err := ClickhouseConn.QueryRow(ctx, "SELECT count() FROM weather_metrics WHERE city_id = ''").Scan(&pending); err != nil {
+		return fmt.Errorf("backfillMetricsCityIDs: count rows: %w", err)
+	}
+	if pending == 0 {
+		return nil
+	}
+
+	rows, err := ClickhouseConn.Query(ctx, "SELECT DISTINCT city FROM weather_metrics WHERE city_id = ''")
 	if err != nil {
-		return nil, fmt.Errorf("addCitiesToDB: prepare batch: %w", err)
+		return fmt.Errorf("backfillMetricsCityIDs: select names: %w", err)
 	}
+	var names, ids clickhouse.ArraySet
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("backfillMetricsCityIDs: scan: %w", err)
+		}
+		names = append(names, name)
+		ids = append(ids, legacyCityID(name))
+	}
+	rows.Close()
 
-	tmpMapOfCities := make(map[string]CityType)
+	if err := ClickhouseConn.Exec(ctx,
+		"ALTER TABLE weather_metrics UPDATE city_id = transform(city, ?, ?, '') WHERE city_id = '' SETTINGS mutations_sync = 1",
+		names, ids); err != nil {
+		return fmt.Errorf("backfillMetricsCityIDs: update: %w", err)
+	}
 
+	log.Printf("backfillMetricsCityIDs: updated city_id of %d rows", pending)
+	return nil
+}
+
+// addCitiesToDB resolves subscription entries (IDs or names) into cities,
+// registers the new ones and returns the IDs in the order given.
+func addCitiesToDB(cities []string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 
-	addedCities := make([]string, 0)
-	for _, cityName := range cities {
+	tmpMapOfCities := make(map[string]CityType)
+	addedCities := make([]string, 0, len(cities))
+	seen := make(map[string]struct{})
 
-		city, err := getCoordinates(cityName)
-		if _, ok := mapOfCities[city.Name]; ok {
-			addedCities = append(addedCities, city.Name)
-			continue
-		}
+	for _, entry := range cities {
+		city, err := resolveCity(ctx, entry)
 		if err != nil {
-			return nil, fmt.Errorf("addCitiesToDB: get coordinates for city %s: %w", cityName, err)
+			return nil, fmt.Errorf("addCitiesToDB: resolve city %s: %w", entry, err)
 		}
-		tmpMapOfCities[city.Name] = city
-
-		if err := batch.Append(city.Name, city.Lat, city.Lon); err != nil {
-			return nil, fmt.Errorf("addCitiesToDB: append to batch: %w", err)
+		if _, ok := seen[city.ID]; ok {
+			continue
 		}
+		seen[city.ID] = struct{}{}
+		addedCities = append(addedCities, city.ID)
+		tmpMapOfCities[city.ID] = city
 	}
 
-	if err := batch.Send(); err != nil {
-		return nil, fmt.Errorf("addCitiesToDB: send batch: %w", err)
+	if err := registerCities(ctx, tmpMapOfCities); err != nil {
+		return nil, fmt.Errorf("addCitiesToDB: %w", err)
 	}
 
-	for k, v := range tmpMapOfCities {
-		mapOfCities[k] = v
-		addedCities = append(addedCities, k)
-	}
-	log.Printf("addCitiesToDB: added %d cities to DB and map", len(tmpMapOfCities))
-
 	return addedCities, nil
 }
 
-func insertWeatherData(cities map[string]CityType) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO weather_metrics (timestamp, city, temp, app_temp, pressure, wind_speed, wind_deg)")
-	if err != nil {
-		return fmt.Errorf("insertWeatherResponses: prepare batch: %w", err)
-	}
-
-	for cityName, city := range cities {
-		weatherResp, err := getWeather(city)
-		if err != nil {
-			return fmt.Errorf("insertWeatherResponses: get weather for city %s: %w", cityName, err)
+// registerCities stores cities (or point cells) that are not yet known in the
+// cities table and in mapOfCities, so they are picked up by data collection,
+// and queues a backfill of their history. Known cities that were paused or
+// retired are reactivated; their history is already there.
+func registerCities(ctx context.Context, cities map[string]CityType) error {
+	added := make(map[string]CityType, len(cities))
+	var changed []CityType
+	mapMu.RLock()
+	for id, city := range cities {
+		known, ok := mapOfCities[id]
+		switch {
+		case !ok:
+			city.Status, city.MergedInto = cityStatusActive, ""
+			added[id] = city
+			changed = append(changed, city)
+		case !known.active():
+			known.Status, known.MergedInto = cityStatusActive, ""
+			changed = append(changed, known)
 		}
+	}
+	mapMu.RUnlock()
 
-		t := time.Unix(weatherResp.Dt, 0)
-
-		if err := batch.Append(
-			t,
-			cityName,
-			weatherResp.Main.Temp,
-			weatherResp.Main.FeelsLike,
-			weatherResp.Main.Pressure,
-			weatherResp.Wind.Speed,
-			weatherResp.Wind.Deg,
-		); err != nil {
-			return fmt.Errorf("insertWeatherResponses: append to batch: %w", err)
-		}
+	if len(changed) == 0 {
+		return nil
 	}
 
-	if err := batch.Send(); err != nil {
-		return fmt.Errorf("insertWeatherResponses: send batch: %w", err)
+	if err := saveCities(ctx, changed); err != nil {
+		return fmt.Errorf("registerCities: %w", err)
 	}
+	log.Printf("registerCities: added %d cities, reactivated %d", len(added), len(changed)-len(added))
+
+	scheduleBackfill(ctx, added)
 
 	return nil
 }
 
-func startPeriodicDataCollection(intervalSeconds int) {
-	log.Println("start_periodic_task")
+// saveCities writes new versions of cities to the city store, the copy kept
+// by the user store and mapOfCities.
+func saveCities(ctx context.Context, cities []CityType) error {
+	if err := cityDB.writeCities(ctx, cities); err != nil {
+		return fmt.Errorf("saveCities: %w", err)
+	}
+	if err := userDB.syncCities(ctx, cities); err != nil {
+		return fmt.Errorf("saveCities: %w", err)
+	}
 
-	go func() {
-		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
-		defer ticker.Stop()
+	mapMu.Lock()
+	for _, city := range cities {
+		mapOfCities[city.ID] = city
+	}
+	mapMu.Unlock()
+	return nil
+}
 
-		for range ticker.C {
-			if err := insertWeatherData(mapOfCities); err != nil {
-				log.Printf("Periodic task error: %v", err)
-			} else {
-				log.Println("Periodic task: Weather data inserted successfully")
-			}
+func (clickhouseStore) writeCities(ctx context.Context, cities []CityType) error {
+	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO cities (id, name, country, state, kind, status, merged_into, lat, lon, updated_at)")
+	if err != nil {
+		return fmt.Errorf("writeCities: prepare batch: %w", err)
+	}
+	now := time.Now()
+	for _, city := range cities {
+		if err := batch.Append(city.ID, city.Name, city.Country, city.State, city.Kind, city.Status, city.MergedInto, city.Lat, city.Lon, now); err != nil {
+			return fmt.Errorf("writeCities: append to batch: %w", err)
 		}
-	}()
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("writeCities: send batch: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,297 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	collectorWorkers     = envInt("COLLECTOR_WORKERS", 8)
+	collectorCityTimeout = envDuration("COLLECTOR_CITY_TIMEOUT", 15*time.Second)
+	collectorBatchSize   = envInt("COLLECTOR_BATCH_SIZE", 500)
+)
+
+// collectionReport describes one run of the collector. It is stored in the
+// collection_runs table.
+type collectionReport struct {
+	RunID      string            `json:"run_id"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Total      int               `json:"total"`
+	Succeeded  int               `json:"succeeded"`
+	Unchanged  int               `json:"unchanged"`
+	Failed     int               `json:"failed"`
+	Failures   map[string]string `json:"failures,omitempty"`
+
+	// stored are the observations written by the run
+	stored []cityObservation
+}
+
+type cityObservation struct {
+	city CityType
+	obs  Observation
+	err  error
+}
+
+var (
+	// lastObserved holds the time of the newest stored observation per city.
+	// Providers often return the same observation on consecutive polls;
+	// skipping it here keeps duplicates out of the rollup views, which see
+	// every insert before ReplacingMergeTree collapses anything.
+	lastObserved   = make(map[string]time.Time)
+	lastObservedMu sync.Mutex
+)
+
+// loadLastObserved brings lastObserved up to date with the stored
+// observations. It runs before every collection: while another replica led
+// the collection, or weatherctl collected, this replica's times went stale.
+func loadLastObserved(ctx context.Context) error {
+	observed, err := metricsDB.lastObserved(ctx)
+	if err != nil {
+		return fmt.Errorf("loadLastObserved: %w", err)
+	}
+
+	lastObservedMu.Lock()
+	defer lastObservedMu.Unlock()
+	for id, t := range observed {
+		if t.After(lastObserved[id]) {
+			lastObserved[id] = t
+		}
+	}
+	return nil
+}
+
+func (clickhouseStore) lastObserved(ctx context.Context) (map[string]time.Time, error) {
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT city_id, max(timestamp) FROM weather_metrics
+		WHERE timestamp >= now() - INTERVAL 1 DAY
+		GROUP BY city_id`)
+	if err != nil {
+		return nil, fmt.Errorf("lastObserved: %w", err)
+	}
+	defer rows.Close()
+
+	observed := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, fmt.Errorf("lastObserved: scan: %w", err)
+		}
+		observed[id] = t
+	}
+	return observed, rows.Err()
+}
+
+func isNewObservation(cityID string, t time.Time) bool {
+	lastObservedMu.Lock()
+	defer lastObservedMu.Unlock()
+	return t.After(lastObserved[cityID])
+}
+
+func rememberObservations(observations []cityObservation) {
+	lastObservedMu.Lock()
+	defer lastObservedMu.Unlock()
+	for _, r := range observations {
+		if r.obs.Time.After(lastObserved[r.city.ID]) {
+			lastObserved[r.city.ID] = r.obs.Time
+		}
+	}
+}
+
+// insertWeatherData fetches current weather for every city with a bounded
+// worker pool and a timeout per city. Observations are committed in chunks
+// of collectorBatchSize, so a failing city or chunk does not discard the
+// rest of the run. Observations already stored are counted as unchanged.
+func insertWeatherData(ctx context.Context, cities map[string]CityType) collectionReport {
+	report := collectionReport{
+		RunID:     uuid.NewString(),
+		StartedAt: time.Now(),
+		Total:     len(cities),
+		Failures:  make(map[string]string),
+	}
+
+	jobs := make(chan CityType)
+	results := make(chan cityObservation)
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(collectorWorkers, max(len(cities), 1)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for city := range jobs {
+				cityCtx, cancel := context.WithTimeout(ctx, collectorCityTimeout)
+				obs, err := weatherProvider.CurrentWeather(cityCtx, city)
+				cancel()
+				obs.Source = observationSourceLive
+				results <- cityObservation{city: city, obs: obs, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, city := range cities {
+			select {
+			case jobs <- city:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make([]cityObservation, 0, collectorBatchSize)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := insertObservations(ctx, pending); err != nil {
+			log.Printf("insertWeatherData: %v", err)
+			for _, r := range pending {
+				report.Failures[r.city.ID] = err.Error()
+			}
+		} else {
+			report.Succeeded += len(pending)
+			report.stored = append(report.stored, pending...)
+			rememberObservations(pending)
+		}
+		pending = pending[:0]
+	}
+
+	collected := make(map[string]struct{}, len(cities))
+	for r := range results {
+		collected[r.city.ID] = struct{}{}
+		if r.err != nil {
+			log.Printf("insertWeatherData: get weather for city %s: %v", r.city.Name, r.err)
+			report.Failures[r.city.ID] = r.err.Error()
+			continue
+		}
+		if !isNewObservation(r.city.ID, r.obs.Time) {
+			report.Unchanged++
+			continue
+		}
+		pending = append(pending, r)
+		if len(pending) >= collectorBatchSize {
+			flush()
+		}
+	}
+	flush()
+
+	// cities never handed to a worker because the run was cancelled
+	for _, city := range cities {
+		if _, ok := collected[city.ID]; !ok {
+			report.Failures[city.ID] = fmt.Sprintf("not collected: %v", ctx.Err())
+		}
+	}
+
+	report.Failed = len(report.Failures)
+	report.FinishedAt = time.Now()
+	return report
+}
+
+func insertObservations(ctx context.Context, observations []cityObservation) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return metricsDB.insertObservations(ctx, observations)
+}
+
+func (clickhouseStore) insertObservations(ctx context.Context, observations []cityObservation) error {
+	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO weather_metrics ("+observationColumns+", city, city_id)")
+	if err != nil {
+		return fmt.Errorf("insertObservations: prepare batch: %w", err)
+	}
+
+	for _, r := range observations {
+		if err := batch.Append(append(observationValues(r.obs), r.city.Name, r.city.ID)...); err != nil {
+			return fmt.Errorf("insertObservations: append to batch: %w", err)
+		}
+	}
+
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("insertObservations: send batch: %w", err)
+	}
+	return nil
+}
+
+func (clickhouseStore) saveCollectionReport(ctx context.Context, report collectionReport) error {
+	failedCities := make([]string, 0, len(report.Failures))
+	errs := make([]string, 0, len(report.Failures))
+	for id, e := range report.Failures {
+		failedCities = append(failedCities, id)
+		errs = append(errs, e)
+	}
+
+	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO collection_runs (run_id, started_at, finished_at, total, succeeded, unchanged, failed, failed_cities, errors)")
+	if err != nil {
+		return fmt.Errorf("saveCollectionReport: prepare batch: %w", err)
+	}
+	if err := batch.Append(
+		report.RunID,
+		report.StartedAt,
+		report.FinishedAt,
+		uint32(report.Total),
+		uint32(report.Succeeded),
+		uint32(report.Unchanged),
+		uint32(report.Failed),
+		failedCities,
+		errs,
+	); err != nil {
+		return fmt.Errorf("saveCollectionReport: append to batch: %w", err)
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("saveCollectionReport: send batch: %w", err)
+	}
+	return nil
+}
+
+// runCollection collects weather for a snapshot of the active cities in
+// mapOfCities and stores the run report. The cities are reloaded first and
+// those that lost their subscribers are paused.
+func runCollection(ctx context.Context) collectionReport {
+	// other replicas may have registered cities since the last run
+	if err := loadCities(ctx); err != nil {
+		log.Printf("runCollection: %v", err)
+	}
+	if err := syncCityRegistry(ctx); err != nil {
+		log.Printf("runCollection: %v", err)
+	}
+
+	mapMu.RLock()
+	cities := make(map[string]CityType, len(mapOfCities))
+	for id, city := range mapOfCities {
+		if city.active() {
+			cities[id] = city
+		}
+	}
+	mapMu.RUnlock()
+
+	if err := loadLastObserved(ctx); err != nil {
+		// without it the run may store observations another replica
+		// already stored, which only merges remove
+		log.Printf("runCollection: %v", err)
+	}
+
+	report := insertWeatherData(ctx, cities)
+	log.Printf("runCollection: run %s: %d/%d cities collected, %d unchanged, %d failed in %s",
+		report.RunID, report.Succeeded, report.Total, report.Unchanged, report.Failed, report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond))
+
+	saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := metricsDB.saveCollectionReport(saveCtx, report)
+	cancel()
+	if err != nil {
+		log.Printf("runCollection: %v", err)
+	}
+
+	processAnomalies(ctx, report.stored)
+	return report
+}
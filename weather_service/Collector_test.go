@@ -0,0 +1,61 @@
+package weatherservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLoadLastObservedCatchesUp(t *testing.T) {
+	oldDB := metricsDB
+	defer func() { metricsDB = oldDB }()
+	store := newMemoryStore()
+	metricsDB = store
+	ctx := context.Background()
+
+	lastObservedMu.Lock()
+	oldObserved := lastObserved
+	lastObserved = make(map[string]time.Time)
+	lastObservedMu.Unlock()
+	defer func() {
+		lastObservedMu.Lock()
+		lastObserved = oldObserved
+		lastObservedMu.Unlock()
+	}()
+
+	city := CityType{ID: "c1", Name: "One"}
+	old := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	if err := store.insertObservations(ctx, []cityObservation{{city: city, obs: Observation{Time: old}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadLastObserved(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if isNewObservation("c1", old) {
+		t.Fatal("a stored observation counts as new")
+	}
+
+	// another replica led the collection for a while and stored a newer one
+	newer := old.Add(30 * time.Minute)
+	if err := store.insertObservations(ctx, []cityObservation{{city: city, obs: Observation{Time: newer}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadLastObserved(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if isNewObservation("c1", newer) {
+		t.Error("an observation stored by another replica counts as new after the reload")
+	}
+	if !isNewObservation("c1", newer.Add(time.Minute)) {
+		t.Error("a newer observation counts as stored")
+	}
+
+	// an older view of the store does not move the times back
+	rememberObservations([]cityObservation{{city: city, obs: Observation{Time: newer.Add(time.Minute)}}})
+	if err := loadLastObserved(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if isNewObservation("c1", newer.Add(time.Minute)) {
+		t.Error("the reload forgot an observation this replica stored")
+	}
+}
@@ -0,0 +1,66 @@
+package weatherservice
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// envInt reads a positive integer from the environment, falling back to def
+// when the variable is unset or invalid.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("envInt: invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a Go duration ("30s", "5m") from the environment.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("envDuration: invalid %s=%q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envDays reads a number of days from the environment. Unlike envInt it
+// accepts 0, which callers use for "no limit".
+func envDays(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("envDays: invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envFloat reads a positive number from the environment.
+func envFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 {
+		log.Printf("envFloat: invalid %s=%q, using %g", key, v, def)
+		return def
+	}
+	return f
+}
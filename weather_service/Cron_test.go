@@ -0,0 +1,121 @@
+package weatherservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// 2025-01-15 is a Wednesday
+	tests := []struct {
+		spec, from, want string
+	}{
+		{"*/10 * * * *", "2025-01-15 10:07", "2025-01-15 10:10"},
+		{"*/10 * * * *", "2025-01-15 10:10", "2025-01-15 10:20"},
+		{"0 * * * *", "2025-01-15 10:07", "2025-01-15 11:00"},
+		{"@hourly", "2025-01-15 23:30", "2025-01-16 00:00"},
+		{"30 3 * * *", "2025-01-15 10:07", "2025-01-16 03:30"},
+		{"@daily", "2025-01-15 10:07", "2025-01-16 00:00"},
+		{"@weekly", "2025-01-15 10:07", "2025-01-19 00:00"},
+		{"@monthly", "2025-01-15 10:07", "2025-02-01 00:00"},
+		{"30 8 * * 1-5", "2025-01-17 09:00", "2025-01-20 08:30"},
+		{"0 0 * * 7", "2025-01-15 10:07", "2025-01-19 00:00"},
+		{"0,30 9,17 * * *", "2025-01-15 10:07", "2025-01-15 17:00"},
+		// steps over ranges and from a start value
+		{"10-30/10 * * * *", "2025-01-15 10:07", "2025-01-15 10:10"},
+		{"10-30/10 * * * *", "2025-01-15 10:30", "2025-01-15 11:10"},
+		{"5/20 * * * *", "2025-01-15 10:07", "2025-01-15 10:25"},
+		{"0 */6 * * *", "2025-01-15 10:07", "2025-01-15 12:00"},
+		// both days restricted: either matches
+		{"0 12 13 * 5", "2025-01-15 10:07", "2025-01-17 12:00"},
+		{"0 12 13 * 5", "2025-01-31 13:00", "2025-02-07 12:00"},
+		{"0 12 13 * 5", "2025-02-08 00:00", "2025-02-13 12:00"},
+		// one day field unrestricted: only the other counts
+		{"0 12 13 * *", "2025-01-15 10:07", "2025-02-13 12:00"},
+		{"0 12 * * 5", "2025-01-15 10:07", "2025-01-17 12:00"},
+		// "*/2" is unrestricted for the day rule, so both must match:
+		// an odd day that is a Monday
+		{"0 0 */2 * 1", "2025-01-15 10:07", "2025-01-27 00:00"},
+		// month and year rollover
+		{"0 0 31 * *", "2025-01-31 10:00", "2025-03-31 00:00"},
+		{"59 23 31 12 *", "2025-12-31 23:59", "2026-12-31 23:59"},
+		{"0 0 29 2 *", "2025-01-15 10:07", "2028-02-29 00:00"},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("parseCron(%q).next(%s) = %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04 Mon"), tt.want)
+		}
+	}
+}
+
+func TestParseCronImpossibleDate(t *testing.T) {
+	s, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.next(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("next = %s, want the zero time", got)
+	}
+}
+
+func TestParseCronEvery(t *testing.T) {
+	s, err := parseCron("@every 90s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2025, 1, 15, 10, 7, 13, 0, time.UTC)
+	first := s.next(from)
+	if !first.After(from) || first.Sub(from) > 90*time.Second {
+		t.Errorf("next(%s) = %s, want within the next 90s", from, first)
+	}
+	if got := s.next(first); got.Sub(first) != 90*time.Second {
+		t.Errorf("next(%s) = %s, want 90s later", first, got)
+	}
+	// replicas with different clocks within one interval agree
+	if got := s.next(first.Add(-time.Second)); !got.Equal(first) {
+		t.Errorf("next(%s) = %s, want %s", first.Add(-time.Second), got, first)
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		",5 * * * *",
+		"5-1 * * * *",
+		"1- * * * *",
+		"-5 * * * *",
+		"@every 0s",
+		"@every 500ms",
+		"@every soon",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", spec)
+		}
+	}
+}
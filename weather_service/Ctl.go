@@ -0,0 +1,473 @@
+package weatherservice
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CtlUsage lists the weatherctl commands.
+const CtlUsage = `usage: weatherctl <command> [arguments]
+
+  users list [-limit N]
+  users search <text>
+  users add-cities <email> <city>...
+  users remove-cities <email> <city>...
+  collect
+  digest preview [-weekly] [-html file] [-json file] <email>
+  email send <email> <welcome|daily_forecast|weekly_summary|anomaly_alert>
+  email publish <task.json>
+  migrate [up | status | down <clickhouse|postgres> [steps]]
+  history [-from t] [-to t] [-resolution r] [-format table|csv] <city>
+`
+
+var errCtlUsage = errors.New("bad arguments\n\n" + CtlUsage)
+
+// RunCtlCommand runs a weatherctl command, writing its output to out.
+// ClickHouse and Postgres must be connected. Emails are queued in the outbox
+// and wait there until the relay of a running service publishes them to
+// RabbitMQ.
+func RunCtlCommand(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errCtlUsage
+	}
+	if args[0] == "migrate" {
+		return RunMigrateCommand(ctx, args[1:])
+	}
+
+	if err := loadCities(ctx); err != nil {
+		return err
+	}
+
+	sub := ""
+	if len(args) > 1 {
+		sub = args[1]
+	}
+	switch args[0] + " " + sub {
+	case "users list":
+		return ctlListUsers(ctx, args[2:], out)
+	case "users search":
+		if len(args) != 3 {
+			return errCtlUsage
+		}
+		return ctlPrintUsers(ctx, out, args[2], 1000)
+	case "users add-cities":
+		if len(args) < 4 {
+			return errCtlUsage
+		}
+		return ctlAddCities(ctx, args[2], args[3:], out)
+	case "users remove-cities":
+		if len(args) < 4 {
+			return errCtlUsage
+		}
+		return ctlRemoveCities(ctx, args[2], args[3:], out)
+	case "digest preview":
+		return ctlPreviewDigest(ctx, args[2:], out)
+	case "email send":
+		if len(args) != 4 {
+			return errCtlUsage
+		}
+		return ctlSendEmail(ctx, args[2], args[3], out)
+	case "email publish":
+		if len(args) != 3 {
+			return errCtlUsage
+		}
+		return ctlPublishEmail(ctx, args[2], out)
+	}
+
+	switch args[0] {
+	case "collect":
+		return ctlCollect(ctx, out)
+	case "history":
+		return ctlHistory(ctx, args[1:], out)
+	}
+	return errCtlUsage
+}
+
+func newCtlFlags(name string, out io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	return fs
+}
+
+func ctlListUsers(ctx context.Context, args []string, out io.Writer) error {
+	fs := newCtlFlags("users list", out)
+	limit := fs.Int("limit", 100, "maximum number of users")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return ctlPrintUsers(ctx, out, "", *limit)
+}
+
+// ctlPrintUsers prints the users whose email contains search.
+func ctlPrintUsers(ctx context.Context, out io.Writer, search string, limit int) error {
+	users, err := userDB.recipients(ctx, recipientFilter{search: search, limit: limit})
+	if err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EMAIL\tWEEKLY\tALERTS\tSUBSCRIPTIONS")
+	for _, u := range users {
+		names := make([]string, 0, len(u.cities))
+		for _, id := range u.cities {
+			names = append(names, subscriptionName(id, u.labels))
+		}
+		fmt.Fprintf(w, "%s\t%t\t%t\t%s\n", u.email, u.weeklyDigest, u.anomalyAlerts, strings.Join(names, "; "))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d users\n", len(users))
+	return nil
+}
+
+// ctlUser reads the subscriptions of a user.
+func ctlUser(ctx context.Context, email string) ([]userCity, error) {
+	if _, err := userDB.user(ctx, email); err != nil {
+		if errors.Is(err, errUserNotFound) {
+			return nil, fmt.Errorf("user %s not found", email)
+		}
+		return nil, fmt.Errorf("select user %s: %w", email, err)
+	}
+	return userDB.subscriptions(ctx, email)
+}
+
+// ctlSubscriptionIDs returns the subscribed IDs in order and their nicknames.
+func ctlSubscriptionIDs(subs []userCity) ([]string, pointLabels) {
+	ids := make([]string, 0, len(subs))
+	labels := make(pointLabels)
+	for _, uc := range subs {
+		ids = append(ids, uc.CityID)
+		if uc.Nickname != "" {
+			labels[uc.CityID] = uc.Nickname
+		}
+	}
+	return ids, labels
+}
+
+func ctlAddCities(ctx context.Context, email string, entries []string, out io.Writer) error {
+	subs, err := ctlUser(ctx, email)
+	if err != nil {
+		return fmt.Errorf("add-cities: %w", err)
+	}
+
+	ids, err := addCitiesToDB(entries)
+	if err != nil {
+		var ambiguous *errAmbiguousCity
+		if errors.As(err, &ambiguous) {
+			fmt.Fprintf(out, "%q is ambiguous, use one of the IDs:\n", ambiguous.Query)
+			for _, c := range ambiguous.Candidates {
+				fmt.Fprintf(out, "  %s  %s\n", c.ID, c.DisplayName())
+			}
+		}
+		return fmt.Errorf("add-cities: %w", err)
+	}
+
+	for _, id := range ids {
+		if !slices.ContainsFunc(subs, func(uc userCity) bool { return uc.CityID == id }) {
+			subs = append(subs, userCity{CityID: id, Kind: cityKindCity, Alerts: true})
+		}
+	}
+	if err := userDB.setSubscriptions(ctx, email, subs); err != nil {
+		return fmt.Errorf("add-cities: update %s: %w", email, err)
+	}
+	cities, _ := ctlSubscriptionIDs(subs)
+	fmt.Fprintf(out, "%s: subscribed to %s\n", email, strings.Join(cityNames(cities), "; "))
+	return nil
+}
+
+func ctlRemoveCities(ctx context.Context, email string, entries []string, out io.Writer) error {
+	subs, err := ctlUser(ctx, email)
+	if err != nil {
+		return fmt.Errorf("remove-cities: %w", err)
+	}
+
+	cities, labels := ctlSubscriptionIDs(subs)
+	for _, entry := range entries {
+		id, ok := ctlFindSubscription(cities, labels, entry)
+		if !ok {
+			city, err := resolveCity(ctx, entry)
+			if err != nil {
+				return fmt.Errorf("remove-cities: %w", err)
+			}
+			if id, ok = city.ID, slices.Contains(cities, city.ID); !ok {
+				return fmt.Errorf("remove-cities: %s is not subscribed to %s", email, city.DisplayName())
+			}
+		}
+		cities = slices.DeleteFunc(cities, func(c string) bool { return c == id })
+		subs = slices.DeleteFunc(subs, func(uc userCity) bool { return uc.CityID == id })
+	}
+
+	if err := userDB.setSubscriptions(ctx, email, subs); err != nil {
+		return fmt.Errorf("remove-cities: update %s: %w", email, err)
+	}
+	fmt.Fprintf(out, "%s: subscribed to %s\n", email, strings.Join(cityNames(cities), "; "))
+	return nil
+}
+
+// ctlFindSubscription matches entry against the subscriptions of a user by
+// ID, point label or city name, without asking the geocoder.
+func ctlFindSubscription(cities []string, labels pointLabels, entry string) (string, bool) {
+	mapMu.RLock()
+	defer mapMu.RUnlock()
+
+	for _, id := range cities {
+		city := mapOfCities[id]
+		if id == entry || strings.EqualFold(labels[id], entry) ||
+			strings.EqualFold(city.Name, entry) || strings.EqualFold(city.DisplayName(), entry) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// ctlCollect runs a collection under the leader lock of the collection job,
+// so it never overlaps a scheduled run, and records it in job_runs. When a
+// running service leads the job, the run is requested from it instead.
+func ctlCollect(ctx context.Context, out io.Writer) error {
+	release, err := tryLeaderLock(ctx, jobCollection)
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
+	}
+	if release == nil {
+		run, err := jobRunDB.requestRun(ctx, jobCollection)
+		if err != nil {
+			return fmt.Errorf("collect: %w", err)
+		}
+		fmt.Fprintf(out, "the collection is led by a running service, run %d requested from it (see /v1/admin/jobRuns?job=%s)\n",
+			run.ID, jobCollection)
+		return nil
+	}
+	defer release()
+
+	started := time.Now()
+	runID := startJobRun(jobCollection, jobTriggerManual, 0, started)
+	report := runCollection(ctx)
+	finishJobRun(runID, time.Since(started), collectionError(report))
+	fmt.Fprintf(out, "run %s: %d/%d cities collected, %d unchanged, %d failed in %s\n",
+		report.RunID, report.Succeeded, report.Total, report.Unchanged, report.Failed,
+		report.FinishedAt.Sub(report.StartedAt).Round(time.Millisecond))
+
+	ids := make([]string, 0, len(report.Failures))
+	for id := range report.Failures {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(out, "  %s: %s\n", cityNames([]string{id})[0], report.Failures[id])
+	}
+	return nil
+}
+
+// ctlPreviewDigest renders the daily forecast or the weekly summary of a user
+// without sending it. The JSON output can be sent with "email publish".
+func ctlPreviewDigest(ctx context.Context, args []string, out io.Writer) error {
+	fs := newCtlFlags("digest preview", out)
+	weekly := fs.Bool("weekly", false, "preview the weekly summary instead of the daily forecast")
+	htmlPath := fs.String("html", "", "write the HTML part to this file")
+	jsonPath := fs.String("json", "", "write the whole email task as JSON to this file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errCtlUsage
+	}
+
+	task, err := ctlDigestTask(ctx, fs.Arg(0), *weekly)
+	if err != nil {
+		return fmt.Errorf("digest preview: %w", err)
+	}
+
+	fmt.Fprintf(out, "To: %s\nSubject: %s\nType: %s\nInline images: %d\n\n%s\n", task.To, task.Subject, task.Type, len(task.Inline), task.TextBody)
+	if *htmlPath != "" {
+		if err := os.WriteFile(*htmlPath, []byte(task.Body), 0o644); err != nil {
+			return fmt.Errorf("digest preview: %w", err)
+		}
+	}
+	if *jsonPath != "" {
+		data, err := json.MarshalIndent(task, "", "\t")
+		if err != nil {
+			return fmt.Errorf("digest preview: marshal: %w", err)
+		}
+		if err := os.WriteFile(*jsonPath, append(data, '\n'), 0o644); err != nil {
+			return fmt.Errorf("digest preview: %w", err)
+		}
+	}
+	return nil
+}
+
+func ctlDigestTask(ctx context.Context, email string, weekly bool) (EmailTask, error) {
+	subs, err := ctlUser(ctx, email)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	cities, labels := ctlSubscriptionIDs(subs)
+	if !weekly {
+		return dailyForecastTask(ctx, email, cities, labels, make(map[string][]ForecastPoint))
+	}
+
+	stats, err := metricsDB.weeklyStats(ctx, cities)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	return weeklySummaryTask(recipient{email: email, cities: cities, labels: labels}, stats, time.Now())
+}
+
+// ctlAnomalyAlertTask renders again the alert about the anomalies of the last
+// day that were alerted in the subscriptions of a user with alerts on.
+func ctlAnomalyAlertTask(ctx context.Context, email string) (EmailTask, error) {
+	subs, err := ctlUser(ctx, email)
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	r := recipient{email: email, labels: make(pointLabels)}
+	byCity := make(map[string][]anomaly)
+	for _, uc := range subs {
+		if !uc.Alerts {
+			continue
+		}
+		r.cities = append(r.cities, uc.CityID)
+		if uc.Nickname != "" {
+			r.labels[uc.CityID] = uc.Nickname
+		}
+		found, err := metricsDB.anomalies(ctx, uc.CityID, 1)
+		if err != nil {
+			return EmailTask{}, err
+		}
+		for _, a := range found {
+			if a.Alerted {
+				byCity[uc.CityID] = append(byCity[uc.CityID], a)
+			}
+		}
+	}
+
+	task, ok, err := anomalyAlertTask(r, byCity)
+	if err != nil {
+		return EmailTask{}, err
+	}
+	if !ok {
+		return EmailTask{}, fmt.Errorf("no anomaly was alerted for the subscriptions of %s in the last day", email)
+	}
+	return task, nil
+}
+
+// ctlRelayNote ends the output of the email commands: weatherctl does not
+// publish the tasks itself.
+const ctlRelayNote = "; it waits there until the relay of a running service publishes it to RabbitMQ"
+
+// ctlSendEmail renders an email of the given type for a user again and
+// queues it. The weekly summary is sent without moving the user's
+// weekly_digest_sent_at; the anomaly alert repeats the alerts of the last day.
+func ctlSendEmail(ctx context.Context, email, emailType string, out io.Writer) error {
+	var task EmailTask
+	var err error
+	switch emailType {
+	case "welcome":
+		err = publishWelcomeEmail(ctx, email)
+	case "daily_forecast", "weekly_summary":
+		if task, err = ctlDigestTask(ctx, email, emailType == "weekly_summary"); err == nil {
+			err = publishEmailTask(ctx, task)
+		}
+	case "anomaly_alert":
+		if task, err = ctlAnomalyAlertTask(ctx, email); err == nil {
+			err = publishEmailTask(ctx, task)
+		}
+	default:
+		return fmt.Errorf("email send: unsupported type %q, want welcome, daily_forecast, weekly_summary or anomaly_alert", emailType)
+	}
+	if err != nil {
+		return fmt.Errorf("email send: %w", err)
+	}
+	fmt.Fprintf(out, "%s email for %s queued in email_outbox%s\n", emailType, email, ctlRelayNote)
+	return nil
+}
+
+// ctlPublishEmail queues an email task saved as JSON, e.g. by
+// "digest preview -json".
+func ctlPublishEmail(ctx context.Context, path string, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("email publish: %w", err)
+	}
+	var task EmailTask
+	if err := json.Unmarshal(data, &task); err != nil {
+		return fmt.Errorf("email publish: decode %s: %w", path, err)
+	}
+	if task.To == "" || task.Subject == "" || (task.Body == "" && task.TextBody == "") {
+		return fmt.Errorf("email publish: %s needs to, subject and a body", path)
+	}
+
+	if err := publishEmailTask(ctx, task); err != nil {
+		return fmt.Errorf("email publish: %w", err)
+	}
+	fmt.Fprintf(out, "email %q for %s queued in email_outbox%s\n", task.Subject, task.To, ctlRelayNote)
+	return nil
+}
+
+func ctlHistory(ctx context.Context, args []string, out io.Writer) error {
+	fs := newCtlFlags("history", out)
+	fromFlag := fs.String("from", "", "range start, RFC 3339 or YYYY-MM-DD (default: 24h before -to)")
+	toFlag := fs.String("to", "", "range end, RFC 3339 or YYYY-MM-DD (default: now)")
+	resolution := fs.String("resolution", resolutionAuto, "auto, raw, hourly or daily")
+	format := fs.String("format", "table", "table or csv")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*format != "table" && *format != "csv") {
+		return errCtlUsage
+	}
+
+	to, err := parseHistoryTime(*toFlag, time.Now())
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	from, err := parseHistoryTime(*fromFlag, to.Add(-24*time.Hour))
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+	history, err := getWeatherHistory(ctx, fs.Arg(0), from, to, *resolution)
+	if err != nil {
+		return fmt.Errorf("history: %w", err)
+	}
+
+	header := []string{"time", "temp_min", "temp_max", "temp_avg", "feels_like_avg", "pressure_avg", "humidity_avg",
+		"wind_speed_avg", "wind_speed_max", "wind_gust_max", "rain_1h_avg", "snow_1h_avg", "samples"}
+	record := func(p historyPoint) []string {
+		f := func(v float32) string { return strconv.FormatFloat(float64(v), 'f', 1, 32) }
+		return []string{p.Time.Format(time.RFC3339), f(p.TempMin), f(p.TempMax), f(p.TempAvg), f(p.FeelsLikeAvg),
+			f(p.PressureAvg), f(p.HumidityAvg), f(p.WindSpeedAvg), f(p.WindSpeedMax), f(p.WindGustMax),
+			f(p.Rain1hAvg), f(p.Snow1hAvg), strconv.FormatUint(p.Samples, 10)}
+	}
+
+	if *format == "csv" {
+		w := csv.NewWriter(out)
+		w.Write(header)
+		for _, p := range history.Points {
+			w.Write(record(p))
+		}
+		w.Flush()
+		return w.Error()
+	}
+
+	fmt.Fprintf(out, "%s, %s resolution, %s .. %s\n\n", history.City.DisplayName(), history.Resolution,
+		history.From.Format(time.RFC3339), history.To.Format(time.RFC3339))
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, strings.Join(header, "\t")+"\t")
+	for _, p := range history.Points {
+		fmt.Fprintln(w, strings.Join(record(p), "\t")+"\t")
+	}
+	return w.Flush()
+}
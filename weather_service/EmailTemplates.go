@@ -0,0 +1,104 @@
+package weatherservice
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// emailTemplateVersion selects the directory under templates/ that emails are
+// rendered from. Bump it together with a new templates/vN directory.
+const emailTemplateVersion = "v1"
+
+//go:embed templates
+var templatesFS embed.FS
+
+type emailTemplates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var (
+	templatesOnce sync.Once
+	templatesErr  error
+	templatesSet  map[string]emailTemplates
+	emailTypes    = []string{"welcome", "daily_forecast", "weekly_summary", "anomaly_alert"}
+)
+
+var templateFuncs = map[string]interface{}{
+	"formatTime": func(t time.Time) string { return t.Format("02 Jan 15:04") },
+	"formatDate": func(t time.Time) string { return t.Format("02 Jan 2006") },
+	"mmHg":       func(hPa float32) float32 { return hPa * 0.75 },
+	"cid":        func(id string) htmltemplate.URL { return htmltemplate.URL("cid:" + id) },
+}
+
+func loadEmailTemplates() error {
+	templatesOnce.Do(func() {
+		set := make(map[string]emailTemplates, len(emailTypes))
+		for _, emailType := range emailTypes {
+			base := fmt.Sprintf("templates/%s/%s", emailTemplateVersion, emailType)
+
+			html, err := htmltemplate.New(emailType+".html.tmpl").Funcs(templateFuncs).ParseFS(templatesFS, base+".html.tmpl")
+			if err != nil {
+				templatesErr = fmt.Errorf("loadEmailTemplates: parse %s html: %w", emailType, err)
+				return
+			}
+			text, err := texttemplate.New(emailType+".txt.tmpl").Funcs(templateFuncs).ParseFS(templatesFS, base+".txt.tmpl")
+			if err != nil {
+				templatesErr = fmt.Errorf("loadEmailTemplates: parse %s text: %w", emailType, err)
+				return
+			}
+			set[emailType] = emailTemplates{html: html, text: text}
+		}
+		templatesSet = set
+	})
+	return templatesErr
+}
+
+// renderEmail renders both the HTML and the plain-text part of an email of the
+// given type. All values are escaped by html/template in the HTML part.
+func renderEmail(emailType string, data interface{}) (string, string, error) {
+	if err := loadEmailTemplates(); err != nil {
+		return "", "", err
+	}
+
+	tmpl, ok := templatesSet[emailType]
+	if !ok {
+		return "", "", fmt.Errorf("renderEmail: unknown email type %q", emailType)
+	}
+
+	var htmlBuf, textBuf bytes.Buffer
+	if err := tmpl.html.Execute(&htmlBuf, data); err != nil {
+		return "", "", fmt.Errorf("renderEmail: execute %s html: %w", emailType, err)
+	}
+	if err := tmpl.text.Execute(&textBuf, data); err != nil {
+		return "", "", fmt.Errorf("renderEmail: execute %s text: %w", emailType, err)
+	}
+
+	return htmlBuf.String(), textBuf.String(), nil
+}
+
+// newEmailTask renders the templates for emailType and wraps the result into an
+// EmailTask ready to be published.
+func newEmailTask(to, subject, emailType string, data interface{}) (EmailTask, error) {
+	html, text, err := renderEmail(emailType, data)
+	if err != nil {
+		return EmailTask{}, err
+	}
+
+	return EmailTask{
+		To:       to,
+		Subject:  subject,
+		Body:     html,
+		TextBody: text,
+		Type:     emailType,
+		Meta: map[string]interface{}{
+			"sent_by":          "weather_service",
+			"template_version": emailTemplateVersion,
+		},
+	}, nil
+}
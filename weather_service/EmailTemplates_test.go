@@ -0,0 +1,45 @@
+package weatherservice
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const markup = `<script>alert("x")</script> & Co`
+
+func TestRenderEmailEscapesHTMLOnly(t *testing.T) {
+	daily := dailyForecastEmail{Cities: []cityForecastEmail{{
+		Name:    markup,
+		Entries: []forecastEntryEmail{{Time: time.Now(), Description: "rain & <b>wind</b>"}},
+	}}}
+	alert := anomalyEmail{Anomalies: []anomalyEmailEntry{{Name: markup, Metric: "Температура", Unit: "°C", ObservedAt: time.Now()}}}
+
+	tests := []struct {
+		emailType string
+		data      interface{}
+		raw       []string
+	}{
+		{"daily_forecast", daily, []string{markup, "rain & <b>wind</b>"}},
+		{"anomaly_alert", alert, []string{markup}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.emailType, func(t *testing.T) {
+			html, text, err := renderEmail(tt.emailType, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, raw := range tt.raw {
+				if strings.Contains(html, raw) {
+					t.Errorf("HTML part contains %q unescaped", raw)
+				}
+				if !strings.Contains(text, raw) {
+					t.Errorf("text part lacks %q as is:\n%s", raw, text)
+				}
+			}
+			if !strings.Contains(html, "&lt;script&gt;") || !strings.Contains(html, "&amp; Co") {
+				t.Errorf("HTML part lacks the escaped city name:\n%s", html)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// saveForecast stores a forecast snapshot; lead time is counted in whole
+// hours from the moment it was fetched.
+func saveForecast(cityID string, issuedAt time.Time, forecast []ForecastPoint) error {
+	if len(forecast) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return metricsDB.saveForecast(ctx, cityID, issuedAt, forecast)
+}
+
+// forecastLeadHours is the lead time of a forecast step in whole hours, or
+// false for steps before the forecast was fetched.
+func forecastLeadHours(issuedAt, target time.Time) (uint16, bool) {
+	lead := math.Round(target.Sub(issuedAt).Hours())
+	if lead < 0 {
+		return 0, false
+	}
+	return uint16(lead), true
+}
+
+func (clickhouseStore) saveForecast(ctx context.Context, cityID string, issuedAt time.Time, forecast []ForecastPoint) error {
+	batch, err := ClickhouseConn.PrepareBatch(ctx, "INSERT INTO forecasts (city_id, issued_at, target_time, lead_hours, temp, feels_like, pressure, wind_speed, description, provider)")
+	if err != nil {
+		return fmt.Errorf("saveForecast: prepare batch: %w", err)
+	}
+	for _, p := range forecast {
+		lead, ok := forecastLeadHours(issuedAt, p.Time)
+		if !ok {
+			continue
+		}
+		if err := batch.Append(cityID, issuedAt, p.Time, lead, p.Temp, p.FeelsLike, p.Pressure, p.WindSpeed, p.Description, p.Provider); err != nil {
+			return fmt.Errorf("saveForecast: append to batch: %w", err)
+		}
+	}
+	if err := batch.Send(); err != nil {
+		return fmt.Errorf("saveForecast: send batch: %w", err)
+	}
+	return nil
+}
+
+// forecastAccuracy is the error of forecasts for one city and lead time.
+// Errors are forecast minus observed; the observation is the hourly average
+// of the target hour.
+type forecastAccuracy struct {
+	CityID       string  `json:"city_id"`
+	City         string  `json:"city"`
+	LeadHours    uint16  `json:"lead_hours"`
+	Samples      uint64  `json:"samples"`
+	TempMAE      float64 `json:"temp_mae"`
+	TempBias     float64 `json:"temp_bias"`
+	WindMAE      float64 `json:"wind_speed_mae"`
+	WindBias     float64 `json:"wind_speed_bias"`
+	PressureMAE  float64 `json:"pressure_mae"`
+	PressureBias float64 `json:"pressure_bias"`
+}
+
+// getForecastAccuracy compares forecasts for the last days with the observed
+// weather, for one city or for all when cityID is empty.
+func getForecastAccuracy(ctx context.Context, cityID string, days int) ([]forecastAccuracy, error) {
+	result, err := metricsDB.forecastAccuracy(ctx, cityID, days)
+	if err != nil {
+		return nil, fmt.Errorf("getForecastAccuracy: %w", err)
+	}
+
+	ids := make([]string, len(result))
+	for i, a := range result {
+		ids[i] = a.CityID
+	}
+	for i, name := range cityNames(ids) {
+		result[i].City = name
+	}
+	return result, nil
+}
+
+func (clickhouseStore) forecastAccuracy(ctx context.Context, cityID string, days int) ([]forecastAccuracy, error) {
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT
+			f.city_id,
+			f.lead_hours,
+			count(),
+			avg(abs(f.temp - o.temp)),
+			avg(f.temp - o.temp),
+			avg(abs(f.wind_speed - o.wind_speed)),
+			avg(f.wind_speed - o.wind_speed),
+			avg(abs(f.pressure - o.pressure)),
+			avg(f.pressure - o.pressure)
+		FROM forecasts AS f FINAL
+		INNER JOIN (
+			SELECT
+				city_id,
+				hour,
+				avgMerge(temp_avg) AS temp,
+				avgMerge(wind_speed_avg) AS wind_speed,
+				avgMerge(pressure_avg) AS pressure
+			FROM weather_metrics_hourly
+			WHERE hour >= now() - INTERVAL ? DAY AND (? = '' OR city_id = ?)
+			GROUP BY city_id, hour
+		) AS o ON f.city_id = o.city_id AND f.target_time = o.hour
+		WHERE f.target_time >= now() - INTERVAL ? DAY AND (? = '' OR f.city_id = ?)
+		GROUP BY f.city_id, f.lead_hours
+		ORDER BY f.city_id, f.lead_hours`,
+		days, cityID, cityID, days, cityID, cityID)
+	if err != nil {
+		return nil, fmt.Errorf("forecastAccuracy: %w", err)
+	}
+	defer rows.Close()
+
+	result := []forecastAccuracy{}
+	for rows.Next() {
+		var a forecastAccuracy
+		if err := rows.Scan(&a.CityID, &a.LeadHours, &a.Samples, &a.TempMAE, &a.TempBias,
+			&a.WindMAE, &a.WindBias, &a.PressureMAE, &a.PressureBias); err != nil {
+			return nil, fmt.Errorf("forecastAccuracy: scan: %w", err)
+		}
+		result = append(result, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("forecastAccuracy: rows: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,359 @@
+package weatherservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errCircuitOpen     = errors.New("circuit breaker is open")
+	errBudgetExhausted = errors.New("daily call budget exhausted")
+)
+
+// upstreamStatusError is a non-200 answer from an upstream API.
+type upstreamStatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "non-200 response from API: " + e.Status
+}
+
+func (e *upstreamStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// upstreamRequest describes one call to a weather API.
+type upstreamRequest struct {
+	Caller   string // prefix for logs and errors
+	Provider string // key of the daily budget
+	Endpoint string // key of the circuit breaker
+	URL      string
+	Secret   string // masked in logged URLs
+}
+
+// upstreamClient is shared by all providers. It adds per-attempt deadlines,
+// jittered retries on 5xx/429 honouring Retry-After, a circuit breaker per
+// endpoint and a daily call budget per provider.
+type upstreamClient struct {
+	client      *http.Client
+	callTimeout time.Duration
+	maxRetries  int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+	budgets  map[string]*dailyBudget
+}
+
+var upstream = newUpstreamClient()
+
+func newUpstreamClient() *upstreamClient {
+	return &upstreamClient{
+		client:           &http.Client{},
+		callTimeout:      envDuration("UPSTREAM_CALL_TIMEOUT", 10*time.Second),
+		maxRetries:       envInt("UPSTREAM_MAX_RETRIES", 3),
+		baseBackoff:      envDuration("UPSTREAM_BACKOFF", 500*time.Millisecond),
+		maxBackoff:       envDuration("UPSTREAM_MAX_BACKOFF", 30*time.Second),
+		breakerThreshold: envInt("UPSTREAM_BREAKER_THRESHOLD", 5),
+		breakerCooldown:  envDuration("UPSTREAM_BREAKER_COOLDOWN", 30*time.Second),
+		breakers:         make(map[string]*circuitBreaker),
+		budgets:          make(map[string]*dailyBudget),
+	}
+}
+
+// getJSON performs a GET request and decodes the JSON response into out.
+func getJSON(ctx context.Context, req upstreamRequest, out interface{}) error {
+	data, err := upstream.get(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, out); err != nil {
+		log.Printf("%s: decode error: %v", req.Caller, err)
+		return fmt.Errorf("%s: decode error: %w", req.Caller, err)
+	}
+	return nil
+}
+
+func (c *upstreamClient) get(ctx context.Context, req upstreamRequest) ([]byte, error) {
+	logURL := req.URL
+	if req.Secret != "" {
+		logURL = strings.Replace(req.URL, req.Secret, "***", 1)
+	}
+
+	breaker := c.breaker(req.Endpoint)
+	budget := c.budget(req.Provider)
+
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff(attempt, lastErr)
+			log.Printf("%s: retry %d/%d in %s after: %v", req.Caller, attempt, c.maxRetries, wait, lastErr)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil, fmt.Errorf("%s: %w (last error: %v)", req.Caller, ctx.Err(), lastErr)
+			}
+		}
+
+		if !breaker.allow() {
+			return nil, fmt.Errorf("%s: %s: %w", req.Caller, req.Endpoint, errCircuitOpen)
+		}
+		if !budget.take() {
+			// no call was made, so a probe admitted by allow is still pending
+			breaker.abort()
+			return nil, fmt.Errorf("%s: %s: %w", req.Caller, req.Provider, errBudgetExhausted)
+		}
+
+		log.Printf("%s: URL=%s", req.Caller, logURL)
+		data, err := c.attempt(ctx, req)
+		if err == nil {
+			breaker.success()
+			return data, nil
+		}
+		lastErr = err
+
+		var statusErr *upstreamStatusError
+		if ctx.Err() != nil {
+			breaker.abort()
+			return nil, fmt.Errorf("%s: %w", req.Caller, err)
+		}
+		if errors.As(err, &statusErr) && !statusErr.retryable() {
+			// upstream answered, so it is healthy; the request itself is wrong
+			breaker.success()
+			return nil, fmt.Errorf("%s: %w", req.Caller, err)
+		}
+		breaker.failure()
+	}
+
+	return nil, fmt.Errorf("%s: %w", req.Caller, lastErr)
+}
+
+func (c *upstreamClient) attempt(ctx context.Context, req upstreamRequest) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.callTimeout)
+	defer cancel()
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request: %w", err)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		log.Printf("%s: request error: %v", req.Caller, err)
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	log.Printf("%s: status=%s", req.Caller, resp.Status)
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		return nil, &upstreamStatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body error: %w", err)
+	}
+
+	if len(data) > 0 {
+		sample := string(data)
+		if len(sample) > 200 {
+			sample = sample[:200] + "..."
+		}
+		log.Printf("%s: response sample=%s", req.Caller, sample)
+	}
+	return data, nil
+}
+
+// backoff is exponential with full jitter; a Retry-After from upstream wins
+// when it is longer.
+func (c *upstreamClient) backoff(attempt int, lastErr error) time.Duration {
+	ceiling := c.baseBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > c.maxBackoff {
+		ceiling = c.maxBackoff
+	}
+	wait := time.Duration(rand.Int63n(int64(ceiling)) + 1)
+
+	var statusErr *upstreamStatusError
+	if errors.As(lastErr, &statusErr) && statusErr.RetryAfter > wait {
+		wait = min(statusErr.RetryAfter, c.maxBackoff)
+	}
+	return wait
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (c *upstreamClient) breaker(endpoint string) *circuitBreaker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.breakers[endpoint]
+	if !ok {
+		b = &circuitBreaker{threshold: c.breakerThreshold, cooldown: c.breakerCooldown}
+		c.breakers[endpoint] = b
+	}
+	return b
+}
+
+func (c *upstreamClient) budget(provider string) *dailyBudget {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.budgets[provider]
+	if !ok {
+		// OPENWEATHER_DAILY_BUDGET, OPENMETEO_DAILY_BUDGET...; unset means unlimited
+		b = &dailyBudget{limit: envInt(strings.ToUpper(provider)+"_DAILY_BUDGET", 0)}
+		c.budgets[provider] = b
+	}
+	return b
+}
+
+// circuitBreaker opens after threshold consecutive failures and rejects calls
+// for cooldown. Then a single probe call is let through: success closes the
+// breaker, failure opens it again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abort ends a probe that neither succeeded nor failed, e.g. cancelled.
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return "closed"
+	case b.probing || !time.Now().Before(b.openUntil):
+		return "half-open"
+	}
+	return "open"
+}
+
+// dailyBudget limits calls per UTC day. A zero limit means no limit. The
+// counter lives in memory, so every replica has its own budget.
+type dailyBudget struct {
+	mu    sync.Mutex
+	limit int
+	day   string
+	used  int
+}
+
+func (b *dailyBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	today := time.Now().UTC().Format("2006-01-02")
+	if b.day != today {
+		b.day, b.used = today, 0
+	}
+	if b.limit > 0 && b.used >= b.limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+type budgetState struct {
+	Limit int `json:"limit"`
+	Used  int `json:"used"`
+}
+
+// upstreamState is a snapshot of breakers and budgets for the status endpoint.
+type upstreamState struct {
+	Breakers map[string]string      `json:"breakers"`
+	Budgets  map[string]budgetState `json:"budgets"`
+}
+
+func (c *upstreamClient) state() upstreamState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := upstreamState{
+		Breakers: make(map[string]string, len(c.breakers)),
+		Budgets:  make(map[string]budgetState, len(c.budgets)),
+	}
+	for name, b := range c.breakers {
+		s.Breakers[name] = b.state()
+	}
+	for name, b := range c.budgets {
+		b.mu.Lock()
+		s.Budgets[name] = budgetState{Limit: b.limit, Used: b.used}
+		b.mu.Unlock()
+	}
+	return s
+}
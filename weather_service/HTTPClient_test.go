@@ -0,0 +1,103 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, cooldown: 20 * time.Millisecond}
+
+	b.failure()
+	if !b.allow() {
+		t.Fatal("breaker opened below the threshold")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("breaker let a call through while open")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker did not let the probe through after the cooldown")
+	}
+	if b.allow() {
+		t.Error("breaker let a second call through during the probe")
+	}
+	b.failure()
+	if b.allow() {
+		t.Error("breaker closed after a failed probe")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !b.allow() {
+		t.Fatal("breaker did not let the second probe through")
+	}
+	b.success()
+	if got := b.state(); got != "closed" {
+		t.Errorf("state after a successful probe = %s, want closed", got)
+	}
+}
+
+func TestDailyBudget(t *testing.T) {
+	b := &dailyBudget{limit: 2}
+	if !b.take() || !b.take() {
+		t.Fatal("budget refused a call within the limit")
+	}
+	if b.take() {
+		t.Error("budget let a call over the limit through")
+	}
+
+	// a new day starts a new budget
+	b.day = "2000-01-01"
+	if !b.take() {
+		t.Error("budget was not reset on a new day")
+	}
+
+	if unlimited := (&dailyBudget{}); !unlimited.take() {
+		t.Error("zero limit refused a call")
+	}
+}
+
+func TestUpstreamBudgetExhaustedDuringProbe(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer ts.Close()
+
+	c := newTestUpstreamClient()
+	req := upstreamRequest{Caller: "test", Provider: "test", Endpoint: "test", URL: ts.URL}
+
+	// the breaker is half-open and the budget used up for today
+	breaker := c.breaker(req.Endpoint)
+	breaker.failures = breaker.threshold
+	breaker.openUntil = time.Now().Add(-time.Second)
+	budget := c.budget(req.Provider)
+	budget.limit, budget.used, budget.day = 1, 1, time.Now().UTC().Format("2006-01-02")
+
+	if _, err := c.get(context.Background(), req); !errors.Is(err, errBudgetExhausted) {
+		t.Fatalf("get = %v, want %v", err, errBudgetExhausted)
+	}
+	if hits.Load() != 0 {
+		t.Fatal("the call reached upstream over the budget")
+	}
+
+	// the probe that never ran must not keep the breaker shut
+	budget.mu.Lock()
+	budget.limit = 2
+	budget.mu.Unlock()
+	if _, err := c.get(context.Background(), req); err != nil {
+		t.Fatalf("get after the budget grew: %v", err)
+	}
+	if got := breaker.state(); got != "closed" {
+		t.Errorf("breaker state = %s, want closed", got)
+	}
+}
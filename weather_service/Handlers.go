@@ -1,11 +1,15 @@
 package weatherservice
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func Handler(w http.ResponseWriter, r *http.Request) {
@@ -13,6 +17,11 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Handler: %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
 
+	if strings.HasPrefix(r.URL.Path, "/v1/admin/") {
+		adminHandler(w, r)
+		return
+	}
+
 	switch r.URL.Path {
 
 	case "/v1/createUser":
@@ -23,6 +32,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 	
 		if err := createUser(r); err != nil {
+			if writeAmbiguousCity(w, err) {
+				log.Printf("Handler: createUser ambiguous city: %v", err)
+				return
+			}
 			if err == errUserExist {
 				http.Error(w, fmt.Sprintf("RegisterUser error: %v", err), http.StatusConflict)
 				log.Printf("Handler: createUser conflict: %v", err)
@@ -50,6 +63,10 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if err := changeUserData(r); err != nil {
+			if writeAmbiguousCity(w, err) {
+				log.Printf("Handler: changeUserData ambiguous city: %v", err)
+				return
+			}
 			log.Printf("Handler: changeUserData error: %v", err)
 			http.Error(w, fmt.Sprintf("changeUserData error: %v", err), http.StatusBadRequest)
 			return
@@ -79,9 +96,14 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		}
 		
 		log.Printf("Handler: user data fetched for %s", userData.Email)
-		response := fmt.Sprintf("{\n\t\"message\": %s,\n \t\"cities : [%s]\"\n}\n", userData.Email, strings.Join(userData.Cities, `","`))
+		response, err := json.MarshalIndent(userData, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(response))
+		w.Write(append(response, '\n'))
 
 	case "/v1/deleteUser":
 		if r.Method != http.MethodDelete {
@@ -106,6 +128,277 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write(response)
 
+	case "/v1/searchCities":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+		cities, err := searchCities(ctx, r.URL.Query().Get("q"))
+		if err != nil {
+			log.Printf("Handler: searchCities error: %v", err)
+			http.Error(w, fmt.Sprintf("searchCities error: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		response, err := json.MarshalIndent(map[string]interface{}{"cities": cities}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/getWeather":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+		weather, err := getCurrentWeather(ctx, r.URL.Query().Get("city"))
+		if err != nil {
+			if writeAmbiguousCity(w, err) {
+				log.Printf("Handler: getWeather ambiguous city: %v", err)
+				return
+			}
+			log.Printf("Handler: getWeather error: %v", err)
+			status := http.StatusBadRequest
+			if errors.Is(err, errNoObservations) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("getWeather error: %v", err), status)
+			return
+		}
+
+		response, err := json.MarshalIndent(weather, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/getWeatherHistory":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		to, err := parseHistoryTime(q.Get("to"), time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("getWeatherHistory error: %v", err), http.StatusBadRequest)
+			return
+		}
+		from, err := parseHistoryTime(q.Get("from"), to.Add(-24*time.Hour))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("getWeatherHistory error: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+		history, err := getWeatherHistory(ctx, q.Get("city"), from, to, q.Get("resolution"))
+		if err != nil {
+			if writeAmbiguousCity(w, err) {
+				log.Printf("Handler: getWeatherHistory ambiguous city: %v", err)
+				return
+			}
+			log.Printf("Handler: getWeatherHistory error: %v", err)
+			http.Error(w, fmt.Sprintf("getWeatherHistory error: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		response, err := json.MarshalIndent(history, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/backfillStatus":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		cityID, ok := optionalCityID(ctx, w, r, "backfillStatus")
+		if !ok {
+			return
+		}
+
+		progress, err := metricsDB.listBackfillProgress(ctx, cityID)
+		if err != nil {
+			log.Printf("Handler: backfillStatus error: %v", err)
+			http.Error(w, fmt.Sprintf("backfillStatus error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.MarshalIndent(map[string]interface{}{"backfills": progress}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/forecastAccuracy":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		days := 30
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 365 {
+				http.Error(w, "days must be a number from 1 to 365", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		cityID, ok := optionalCityID(ctx, w, r, "forecastAccuracy")
+		if !ok {
+			return
+		}
+
+		accuracy, err := getForecastAccuracy(ctx, cityID, days)
+		if err != nil {
+			log.Printf("Handler: forecastAccuracy error: %v", err)
+			http.Error(w, fmt.Sprintf("forecastAccuracy error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.MarshalIndent(map[string]interface{}{"days": days, "accuracy": accuracy}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/anomalies":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		days := 7
+		if v := r.URL.Query().Get("days"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 365 {
+				http.Error(w, "days must be a number from 1 to 365", http.StatusBadRequest)
+				return
+			}
+			days = n
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		cityID, ok := optionalCityID(ctx, w, r, "anomalies")
+		if !ok {
+			return
+		}
+
+		anomalies, err := listAnomalies(ctx, cityID, days)
+		if err != nil {
+			log.Printf("Handler: anomalies error: %v", err)
+			http.Error(w, fmt.Sprintf("anomalies error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.MarshalIndent(map[string]interface{}{"days": days, "anomalies": anomalies}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/upstreamStatus":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		response, err := json.MarshalIndent(upstream.state(), "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/leaders":
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+		defer cancel()
+
+		leaders, err := listLeaders(ctx)
+		if err != nil {
+			log.Printf("Handler: leaders error: %v", err)
+			http.Error(w, fmt.Sprintf("leaders error: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		response, err := json.MarshalIndent(map[string]interface{}{"replica": replicaID, "leaders": leaders}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
+	case "/v1/sentEmails":
+		// only memory mode keeps the emails it "sends"
+		if sentEmails == nil {
+			log.Printf("Handler: not found %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		// the emails of every user, so it needs the admin token
+		if !authorizeAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodGet {
+			log.Printf("Handler: wrong method %s for %s", r.Method, r.URL.Path)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		response, err := json.MarshalIndent(map[string]interface{}{"emails": sentEmails.list(r.URL.Query().Get("to"))}, "", "\t")
+		if err != nil {
+			log.Printf("Handler: %v", err)
+			http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(append(response, '\n'))
+
 	default:
 		log.Printf("Handler: not found %s %s", r.Method, r.URL.Path)
 		http.Error(w, "Not found", http.StatusNotFound)
@@ -118,4 +411,47 @@ func beatifulResponse(s string) ([]byte, error) {
 		return nil, fmt.Errorf("beatiful Response error: %v", err)
 	}
 	return append(response, '\n'), nil
-}
\ No newline at end of file
+}
+
+// writeAmbiguousCity answers 300 Multiple Choices with the candidates if err
+// is caused by an ambiguous city name.
+func writeAmbiguousCity(w http.ResponseWriter, err error) bool {
+	var ambiguous *errAmbiguousCity
+	if !errors.As(err, &ambiguous) {
+		return false
+	}
+
+	response, err := json.MarshalIndent(map[string]interface{}{
+		"message":    ambiguous.Error(),
+		"query":      ambiguous.Query,
+		"candidates": ambiguous.Candidates,
+	}, "", "\t")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Marshall error: %v", err), http.StatusInternalServerError)
+		return true
+	}
+	w.WriteHeader(http.StatusMultipleChoices)
+	w.Write(append(response, '\n'))
+	return true
+}
+
+// optionalCityID resolves the "city" query parameter, returning "" when it is
+// absent. On failure it writes the response and returns false.
+func optionalCityID(ctx context.Context, w http.ResponseWriter, r *http.Request, handler string) (string, bool) {
+	entry := r.URL.Query().Get("city")
+	if entry == "" {
+		return "", true
+	}
+
+	city, err := resolveCity(ctx, entry)
+	if err != nil {
+		if writeAmbiguousCity(w, err) {
+			log.Printf("Handler: %s ambiguous city: %v", handler, err)
+			return "", false
+		}
+		log.Printf("Handler: %s error: %v", handler, err)
+		http.Error(w, fmt.Sprintf("%s error: %v", handler, err), http.StatusBadRequest)
+		return "", false
+	}
+	return city.ID, true
+}
@@ -0,0 +1,155 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	resolutionAuto   = "auto"
+	resolutionRaw    = "raw"
+	resolutionHourly = "hourly"
+	resolutionDaily  = "daily"
+)
+
+// Ranges up to these spans are answered from the finer tables.
+const (
+	maxRawHistorySpan    = 48 * time.Hour
+	maxHourlyHistorySpan = 62 * 24 * time.Hour
+)
+
+// historyPoint is one step of a weather history. Raw points are single
+// observations, so min, max and average are the same.
+type historyPoint struct {
+	Time         time.Time `json:"time"`
+	TempMin      float32   `json:"temp_min"`
+	TempMax      float32   `json:"temp_max"`
+	TempAvg      float32   `json:"temp_avg"`
+	FeelsLikeAvg float32   `json:"feels_like_avg"`
+	PressureAvg  float32   `json:"pressure_avg"`
+	HumidityAvg  float32   `json:"humidity_avg"`
+	WindSpeedAvg float32   `json:"wind_speed_avg"`
+	WindSpeedMax float32   `json:"wind_speed_max"`
+	WindGustMax  float32   `json:"wind_gust_max"`
+	Rain1hAvg    float32   `json:"rain_1h_avg"`
+	Snow1hAvg    float32   `json:"snow_1h_avg"`
+	Samples      uint64    `json:"samples"`
+}
+
+// weatherHistory is the answer of GET /v1/getWeatherHistory.
+type weatherHistory struct {
+	City       CityType       `json:"city"`
+	Resolution string         `json:"resolution"`
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	Points     []historyPoint `json:"points"`
+}
+
+var historyQueries = map[string]string{
+	resolutionRaw: `
+		SELECT timestamp, temp, temp, temp, app_temp, toFloat32(pressure), toFloat32(humidity),
+			wind_speed, wind_speed, wind_gust, rain_1h, snow_1h, toUInt64(1)
+		FROM weather_metrics FINAL
+		WHERE city_id = ? AND timestamp >= ? AND timestamp <= ?
+		ORDER BY timestamp`,
+	resolutionHourly: `
+		SELECT hour, min(temp_min), max(temp_max), toFloat32(avgMerge(temp_avg)), toFloat32(avgMerge(app_temp_avg)),
+			toFloat32(avgMerge(pressure_avg)), toFloat32(avgMerge(humidity_avg)), toFloat32(avgMerge(wind_speed_avg)),
+			max(wind_speed_max), max(wind_gust_max), toFloat32(avgMerge(rain_1h_avg)), toFloat32(avgMerge(snow_1h_avg)), sum(samples)
+		FROM weather_metrics_hourly
+		WHERE city_id = ? AND hour >= toStartOfHour(?) AND hour <= ?
+		GROUP BY hour
+		ORDER BY hour`,
+	resolutionDaily: `
+		SELECT toDateTime(day), min(temp_min), max(temp_max), toFloat32(avgMerge(temp_avg)), toFloat32(avgMerge(app_temp_avg)),
+			toFloat32(avgMerge(pressure_avg)), toFloat32(avgMerge(humidity_avg)), toFloat32(avgMerge(wind_speed_avg)),
+			max(wind_speed_max), max(wind_gust_max), toFloat32(avgMerge(rain_1h_avg)), toFloat32(avgMerge(snow_1h_avg)), sum(samples)
+		FROM weather_metrics_daily
+		WHERE city_id = ? AND day >= toDate(?) AND day <= toDate(?)
+		GROUP BY day
+		ORDER BY day`,
+}
+
+// pickResolution chooses the table for a range: the finest one whose span
+// limit fits the range and that still keeps data from the range start.
+func pickResolution(from, to, now time.Time) string {
+	span := to.Sub(from)
+	resolution := resolutionDaily
+	switch {
+	case span <= maxRawHistorySpan:
+		resolution = resolutionRaw
+	case span <= maxHourlyHistorySpan:
+		resolution = resolutionHourly
+	}
+
+	if resolution == resolutionRaw && from.Before(retentionStart(rawRetentionDays, now)) {
+		resolution = resolutionHourly
+	}
+	if resolution == resolutionHourly && from.Before(retentionStart(hourlyRetentionDays, now)) {
+		resolution = resolutionDaily
+	}
+	return resolution
+}
+
+// getWeatherHistory returns the weather of a registered city between from and
+// to, both inclusive, at the given resolution or an automatic one.
+func getWeatherHistory(ctx context.Context, entry string, from, to time.Time, resolution string) (weatherHistory, error) {
+	if !from.Before(to) {
+		return weatherHistory{}, fmt.Errorf("getWeatherHistory: from must be before to")
+	}
+	if resolution == "" || resolution == resolutionAuto {
+		resolution = pickResolution(from, to, time.Now())
+	}
+	if _, ok := historyQueries[resolution]; !ok {
+		return weatherHistory{}, fmt.Errorf("getWeatherHistory: unknown resolution %q, want auto, raw, hourly or daily", resolution)
+	}
+
+	city, err := resolveCity(ctx, entry)
+	if err != nil {
+		return weatherHistory{}, err
+	}
+
+	points, err := metricsDB.history(ctx, city.ID, from, to, resolution)
+	if err != nil {
+		return weatherHistory{}, fmt.Errorf("getWeatherHistory: %w", err)
+	}
+	return weatherHistory{City: city, Resolution: resolution, From: from, To: to, Points: points}, nil
+}
+
+func (clickhouseStore) history(ctx context.Context, cityID string, from, to time.Time, resolution string) ([]historyPoint, error) {
+	rows, err := ClickhouseConn.Query(ctx, historyQueries[resolution], cityID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("history: query %s: %w", resolution, err)
+	}
+	defer rows.Close()
+
+	points := []historyPoint{}
+	for rows.Next() {
+		var p historyPoint
+		if err := rows.Scan(&p.Time, &p.TempMin, &p.TempMax, &p.TempAvg, &p.FeelsLikeAvg, &p.PressureAvg, &p.HumidityAvg,
+			&p.WindSpeedAvg, &p.WindSpeedMax, &p.WindGustMax, &p.Rain1hAvg, &p.Snow1hAvg, &p.Samples); err != nil {
+			return nil, fmt.Errorf("history: scan: %w", err)
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("history: rows: %w", err)
+	}
+	return points, nil
+}
+
+// parseHistoryTime accepts RFC 3339 times and plain dates; empty means def.
+func parseHistoryTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q, want RFC 3339 or YYYY-MM-DD", v)
+	}
+	return t, nil
+}
@@ -0,0 +1,47 @@
+package weatherservice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPickResolution(t *testing.T) {
+	oldRaw, oldHourly := rawRetentionDays, hourlyRetentionDays
+	defer func() { rawRetentionDays, hourlyRetentionDays = oldRaw, oldHourly }()
+
+	now := time.Date(2025, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name           string
+		raw, hourly    int
+		fromAgo, toAgo time.Duration
+		want           string
+	}{
+		{"last day", 90, 730, day, 0, resolutionRaw},
+		{"raw span limit", 90, 730, maxRawHistorySpan, 0, resolutionRaw},
+		{"just over the raw span", 90, 730, maxRawHistorySpan + time.Second, 0, resolutionHourly},
+		{"hourly span limit", 90, 730, maxHourlyHistorySpan, 0, resolutionHourly},
+		{"just over the hourly span", 90, 730, maxHourlyHistorySpan + time.Second, 0, resolutionDaily},
+		{"a year", 90, 730, 365 * day, 0, resolutionDaily},
+
+		// a short range older than the raw TTL is read from the rollups
+		{"short range at the raw TTL", 90, 730, 90 * day, 89 * day, resolutionRaw},
+		{"short range past the raw TTL", 90, 730, 91 * day, 90 * day, resolutionHourly},
+		{"short range past both TTLs", 90, 730, 800 * day, 799 * day, resolutionDaily},
+		{"month past the hourly TTL", 90, 730, 800 * day, 770 * day, resolutionDaily},
+		{"month within the hourly TTL", 90, 730, 400 * day, 370 * day, resolutionHourly},
+
+		// 0 keeps the data forever
+		{"raw kept forever", 0, 730, 1000 * day, 999 * day, resolutionRaw},
+		{"hourly kept forever", 90, 0, 1000 * day, 999 * day, resolutionHourly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rawRetentionDays, hourlyRetentionDays = tt.raw, tt.hourly
+			got := pickResolution(now.Add(-tt.fromAgo), now.Add(-tt.toAgo), now)
+			if got != tt.want {
+				t.Errorf("pickResolution = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Background jobs. Schedules can be overridden with JOB_<NAME>_SCHEDULE.
+const (
+	jobCollection   = "collection"
+	jobDailyEmails  = "daily_emails"
+	jobWeeklyDigest = "weekly_digest"
+	jobBackfill     = "backfill"
+	jobCityGC       = "city_gc"
+	jobRunsGC       = "job_runs_gc"
+)
+
+// StartBackgroundJobs loads the registered cities and starts the scheduler.
+// The schema must be migrated before. With several replicas each job runs on
+// the replica leading it.
+func StartBackgroundJobs() error {
+	if err := checkRetention(); err != nil {
+		return fmt.Errorf("StartBackgroundJobs: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := loadCities(ctx); err != nil {
+		return fmt.Errorf("StartBackgroundJobs: %w", err)
+	}
+
+	jobs := []*job{
+		{Name: jobCollection, Spec: "*/10 * * * *", Leader: true, Timeout: 30 * time.Minute, Run: collectWeather},
+		{Name: jobDailyEmails, Spec: "*/10 * * * *", Leader: true, Run: sendWeatherEmails},
+		// sendWeeklySummaries only sends the summaries that are due
+		{Name: jobWeeklyDigest, Spec: "@hourly", Leader: true, Run: sendWeeklySummaries},
+		{Name: jobBackfill, Spec: "*/5 * * * *", Leader: true, Timeout: backfillTimeout, Run: resumeBackfills},
+		{Name: jobCityGC, Spec: "@hourly", Leader: true, Run: syncCityRegistry},
+		{Name: jobRunsGC, Spec: "30 3 * * *", Leader: true, Run: pruneJobRuns},
+	}
+	for _, j := range jobs {
+		if err := jobScheduler.register(j); err != nil {
+			return fmt.Errorf("StartBackgroundJobs: %w", err)
+		}
+	}
+
+	startBackfillWorker()
+	jobScheduler.start()
+	log.Println("StartBackgroundJobs: scheduler started")
+
+	return nil
+}
+
+// collectWeather runs a collection; it fails only if no city was collected,
+// partial failures are in collection_runs.
+func collectWeather(ctx context.Context) error {
+	report := runCollection(ctx)
+	if report.Failed > 0 {
+		log.Printf("collectWeather: %d of %d cities failed", report.Failed, report.Total)
+	}
+	return collectionError(report)
+}
+
+// collectionError fails the job run when no city was collected.
+func collectionError(report collectionReport) error {
+	if report.Total > 0 && report.Failed == report.Total {
+		return fmt.Errorf("collectWeather: all %d cities failed", report.Total)
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// replicaID names this process in job_leaders.
+	replicaID = defaultReplicaID()
+	// leaderCheckInterval is how often leaders heartbeat and followers try to
+	// take over, so it bounds the failover time.
+	leaderCheckInterval = envDuration("LEADER_CHECK_INTERVAL", 15*time.Second)
+)
+
+// leaderLockClass is the first key of the two-key advisory locks used for
+// elections; the second is a hash of the job name. Two-key locks do not
+// collide with migrationLockKey.
+const leaderLockClass int32 = 0x5753 // "WS"
+
+func defaultReplicaID() string {
+	if id := os.Getenv("REPLICA_ID"); id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// leaderElection keeps a session-level advisory lock for one job. The lock
+// lives as long as its connection: when the leader dies, Postgres drops the
+// session and another replica takes the lock on its next check.
+type leaderElection struct {
+	job   string
+	key   int32
+	mu    sync.Mutex
+	conn  *sql.Conn
+	since time.Time
+}
+
+var (
+	electionsMu sync.Mutex
+	elections   = map[string]*leaderElection{}
+)
+
+// singleProcess turns elections off when the state is not shared with other
+// replicas, as in memory mode: the process leads every job it campaigns for.
+var singleProcess bool
+
+// startLeaderElection starts campaigning for the given jobs.
+func startLeaderElection(jobs ...string) {
+	electionsMu.Lock()
+	defer electionsMu.Unlock()
+
+	for _, job := range jobs {
+		if _, ok := elections[job]; ok {
+			continue
+		}
+		e := &leaderElection{job: job, key: leaderKey(job)}
+		elections[job] = e
+		if singleProcess {
+			e.since = time.Now()
+			continue
+		}
+
+		go func() {
+			ticker := time.NewTicker(leaderCheckInterval)
+			defer ticker.Stop()
+			for {
+				e.check()
+				<-ticker.C
+			}
+		}()
+	}
+	log.Printf("startLeaderElection: replica %s campaigning for %v", replicaID, jobs)
+}
+
+func leaderKey(job string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(job))
+	return int32(h.Sum32())
+}
+
+// tryLeaderLock takes the election lock of job for a process that runs the
+// job once without campaigning, such as weatherctl, so that no replica leads
+// the job meanwhile. It returns a nil release when a replica leads the job.
+func tryLeaderLock(ctx context.Context, job string) (release func(), err error) {
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("tryLeaderLock: get connection: %w", err)
+	}
+	key := leaderKey(job)
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, $2)", leaderLockClass, key).Scan(&acquired); err != nil || !acquired {
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("tryLeaderLock: %s: %w", job, err)
+		}
+		return nil, nil
+	}
+
+	return func() {
+		if err := releaseLockConn(conn, key); err != nil {
+			log.Printf("tryLeaderLock: %s: unlock: %v", job, err)
+		}
+	}, nil
+}
+
+// releaseLockConn unlocks the election lock key held by conn and closes conn.
+// Close hands the session back to the pool, which keeps it unless the driver
+// reported driver.ErrBadConn, so after a failed unlock, e.g. a timeout, the
+// session would keep the lock in the idle pool. The physical connection is
+// dropped instead, which makes Postgres release the lock.
+func releaseLockConn(conn *sql.Conn, key int32) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1, $2)", leaderLockClass, key)
+	if err != nil {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	conn.Close()
+	return err
+}
+
+// isLeader reports whether this replica holds the lock of job. The lock
+// connection is pinged first, so a leader that lost its session since the last
+// check stops at once.
+func isLeader(job string) bool {
+	electionsMu.Lock()
+	e, ok := elections[job]
+	electionsMu.Unlock()
+	if !ok {
+		return false
+	}
+	if singleProcess {
+		return true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.conn.PingContext(ctx); err != nil {
+		e.lose(err)
+		return false
+	}
+	return true
+}
+
+func (e *leaderElection) check() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if e.conn != nil {
+		if err := e.heartbeat(ctx); err != nil {
+			e.lose(err)
+		}
+		return
+	}
+
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		log.Printf("leaderElection: %s: get connection: %v", e.job, err)
+		return
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, $2)", leaderLockClass, e.key).Scan(&acquired); err != nil || !acquired {
+		if err != nil {
+			log.Printf("leaderElection: %s: try lock: %v", e.job, err)
+		}
+		conn.Close()
+		return
+	}
+
+	e.conn, e.since = conn, time.Now()
+	log.Printf("leaderElection: replica %s is now leader of %s", replicaID, e.job)
+	if err := e.heartbeat(ctx); err != nil {
+		e.lose(err)
+		return
+	}
+	interruptStaleRuns(e.job, "", e.since)
+}
+
+// heartbeat records the leadership in job_leaders through the lock
+// connection, which doubles as a check that the session is alive.
+func (e *leaderElection) heartbeat(ctx context.Context) error {
+	_, err := e.conn.ExecContext(ctx, `
+		INSERT INTO job_leaders (job, replica, acquired_at, heartbeat_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (job) DO UPDATE
+		SET replica = EXCLUDED.replica, acquired_at = EXCLUDED.acquired_at, heartbeat_at = EXCLUDED.heartbeat_at`,
+		e.job, replicaID, e.since)
+	if err != nil {
+		return fmt.Errorf("heartbeat: %w", err)
+	}
+	return nil
+}
+
+// lose gives up the leadership after an error on the lock connection. If the
+// unlock fails too, releaseLockConn closes the session with its lock.
+func (e *leaderElection) lose(cause error) {
+	log.Printf("leaderElection: replica %s lost leadership of %s: %v", replicaID, e.job, cause)
+
+	if err := releaseLockConn(e.conn, e.key); err != nil {
+		log.Printf("leaderElection: %s: unlock: %v", e.job, err)
+	}
+	e.conn = nil
+}
+
+// jobLeader is a row of job_leaders as shown by GET /v1/leaders.
+type jobLeader struct {
+	Job         string    `json:"job"`
+	Replica     string    `json:"replica"`
+	AcquiredAt  time.Time `json:"acquired_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+	// Alive is false when the heartbeat is overdue: the leader died and no
+	// replica has taken over yet.
+	Alive bool `json:"alive"`
+}
+
+func listLeaders(ctx context.Context) ([]jobLeader, error) {
+	if singleProcess {
+		electionsMu.Lock()
+		defer electionsMu.Unlock()
+		leaders := []jobLeader{}
+		for _, e := range elections {
+			leaders = append(leaders, jobLeader{Job: e.job, Replica: replicaID, AcquiredAt: e.since, HeartbeatAt: time.Now(), Alive: true})
+		}
+		sort.Slice(leaders, func(i, j int) bool { return leaders[i].Job < leaders[j].Job })
+		return leaders, nil
+	}
+
+	rows, err := DB.QueryContext(ctx, "SELECT job, replica, acquired_at, heartbeat_at FROM job_leaders ORDER BY job")
+	if err != nil {
+		return nil, fmt.Errorf("listLeaders: %w", err)
+	}
+	defer rows.Close()
+
+	leaders := []jobLeader{}
+	for rows.Next() {
+		var l jobLeader
+		if err := rows.Scan(&l.Job, &l.Replica, &l.AcquiredAt, &l.HeartbeatAt); err != nil {
+			return nil, fmt.Errorf("listLeaders: scan: %w", err)
+		}
+		l.Alive = time.Since(l.HeartbeatAt) < 3*leaderCheckInterval
+		leaders = append(leaders, l)
+	}
+	return leaders, rows.Err()
+}
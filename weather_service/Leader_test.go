@@ -0,0 +1,79 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// lockDriver is a database/sql driver whose sessions fail every statement
+// with execErr and count how often they are closed.
+type lockDriver struct {
+	execErr error
+	opened  atomic.Int32
+	closed  atomic.Int32
+}
+
+func (d *lockDriver) Open(string) (driver.Conn, error) {
+	d.opened.Add(1)
+	return lockConn{d}, nil
+}
+
+type lockConn struct{ d *lockDriver }
+
+func (c lockConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c lockConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c lockConn) Close() error {
+	c.d.closed.Add(1)
+	return nil
+}
+
+func (c lockConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	if c.d.execErr != nil {
+		return nil, c.d.execErr
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func TestReleaseLockConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		execErr error
+		// wantClosed is whether the session is closed rather than pooled
+		wantClosed bool
+	}{
+		{"unlocked", nil, false},
+		{"unlock timed out", context.DeadlineExceeded, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &lockDriver{execErr: tt.execErr}
+			name := "lockdriver" + string(rune('a'+i))
+			sql.Register(name, d)
+			db, err := sql.Open(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			conn, err := db.Conn(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := releaseLockConn(conn, 1); (err != nil) != (tt.execErr != nil) {
+				t.Errorf("releaseLockConn = %v, want %v", err, tt.execErr)
+			}
+
+			if closed := d.closed.Load() == 1; closed != tt.wantClosed {
+				t.Errorf("session closed = %v, want %v", closed, tt.wantClosed)
+			}
+			if stats := db.Stats(); stats.Idle != 1-int(d.closed.Load()) {
+				t.Errorf("%d idle sessions in the pool, want %d", stats.Idle, 1-int(d.closed.Load()))
+			}
+		})
+	}
+}
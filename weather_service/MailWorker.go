@@ -0,0 +1,175 @@
+package weatherservice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/mailer"
+	gomail "gopkg.in/gomail.v2"
+)
+
+var (
+	// mailPollInterval is how often the mail worker looks for tasks due for
+	// a retry; new tasks wake it at once.
+	mailPollInterval = envDuration("MAIL_POLL_INTERVAL", 30*time.Second)
+	// mailMaxAttempts is how often a task is tried before it is dropped.
+	mailMaxAttempts = envInt("MAIL_MAX_ATTEMPTS", 5)
+)
+
+// mailWorker is the publisher of sqlite mode and does the job of
+// smtp_service in the process. Tasks are queued in the email_queue table, so
+// they survive restarts, and retried with exponential backoff.
+type mailWorker struct {
+	wake chan struct{}
+	smtp *gomail.Dialer
+	from string
+}
+
+// newMailWorker fails without SMTP_HOST: the emails would only pile up in
+// email_queue. Use memory mode to try the service without a mail server.
+func newMailWorker() (*mailWorker, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, fmt.Errorf("newMailWorker: SMTP_HOST env not set")
+	}
+	return &mailWorker{
+		wake: make(chan struct{}, 1),
+		smtp: gomail.NewDialer(host, envInt("SMTP_PORT", 587), os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASSWORD")),
+		from: os.Getenv("SMTP_FROM"),
+	}, nil
+}
+
+func (w *mailWorker) publish(ctx context.Context, task EmailTask) error {
+	if err := queueSQLiteEmail(ctx, SQLiteDB, task); err != nil {
+		return err
+	}
+	w.notify()
+	return nil
+}
+
+// queueSQLiteEmail writes a task to email_queue through q, which is the
+// transaction of the change the email belongs to or SQLiteDB. The worker has
+// to be woken by notify after the commit.
+func queueSQLiteEmail(ctx context.Context, q sqlQueryer, task EmailTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("publishEmailTask: marshal: %w", err)
+	}
+	now := time.Now()
+	if _, err := q.ExecContext(ctx, "INSERT INTO email_queue (task, next_attempt_at, created_at) VALUES (?, ?, ?)",
+		utc(string(body), now, now)...); err != nil {
+		return fmt.Errorf("publishEmailTask: queue: %w", err)
+	}
+	return nil
+}
+
+func (w *mailWorker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *mailWorker) run() {
+	ticker := time.NewTicker(mailPollInterval)
+	defer ticker.Stop()
+	for {
+		w.sendDue()
+		select {
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+type queuedEmail struct {
+	id       int64
+	task     EmailTask
+	attempts int
+}
+
+// sendDue sends the queued tasks that are due, oldest first.
+func (w *mailWorker) sendDue() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		batch, err := w.due(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("mailWorker: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		for _, q := range batch {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			err := w.send(ctx, q.task)
+			cancel()
+			if err := w.finish(q, err); err != nil {
+				log.Printf("mailWorker: %v", err)
+				return
+			}
+		}
+	}
+}
+
+func (w *mailWorker) due(ctx context.Context) ([]queuedEmail, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, "SELECT id, task, attempts FROM email_queue WHERE next_attempt_at <= ? ORDER BY id LIMIT 10",
+		utc(time.Now())...)
+	if err != nil {
+		return nil, fmt.Errorf("select due tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var batch []queuedEmail
+	for rows.Next() {
+		var q queuedEmail
+		var body string
+		if err := rows.Scan(&q.id, &body, &q.attempts); err != nil {
+			return nil, fmt.Errorf("scan task: %w", err)
+		}
+		if err := json.Unmarshal([]byte(body), &q.task); err != nil {
+			// kept as a failed attempt, so it is dropped in the end
+			log.Printf("mailWorker: bad task %d: %v", q.id, err)
+		}
+		batch = append(batch, q)
+	}
+	return batch, rows.Err()
+}
+
+// finish deletes a sent task, or schedules a retry after a failure and
+// drops the task after mailMaxAttempts.
+func (w *mailWorker) finish(q queuedEmail, sendErr error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q.attempts++
+	if sendErr == nil || q.attempts >= mailMaxAttempts {
+		if sendErr == nil {
+			log.Printf("mailWorker: email sent to %s", q.task.To)
+		} else {
+			log.Printf("mailWorker: giving up on email to %s after %d attempts: %v", q.task.To, q.attempts, sendErr)
+		}
+		if _, err := SQLiteDB.ExecContext(ctx, "DELETE FROM email_queue WHERE id = ?", q.id); err != nil {
+			return fmt.Errorf("delete task %d: %w", q.id, err)
+		}
+		return nil
+	}
+
+	retry := time.Minute << (q.attempts - 1)
+	log.Printf("mailWorker: send mail failed for %s, retry in %s: %v", q.task.To, retry, sendErr)
+	if _, err := SQLiteDB.ExecContext(ctx, "UPDATE email_queue SET attempts = ?, next_attempt_at = ?, last_error = ? WHERE id = ?",
+		utc(q.attempts, time.Now().Add(retry), sendErr.Error(), q.id)...); err != nil {
+		return fmt.Errorf("reschedule task %d: %w", q.id, err)
+	}
+	return nil
+}
+
+func (w *mailWorker) send(ctx context.Context, t EmailTask) error {
+	return mailer.Send(ctx, w.smtp, w.from, t)
+}
@@ -0,0 +1,948 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UseMemoryStores keeps all state in the process and hands email tasks to an
+// in-process mail sink instead of RabbitMQ. Nothing survives a restart. The
+// process leads every job itself. Call it instead of InitClickhouse,
+// InitPostgres, Migrate and InitRabbit.
+func UseMemoryStores() {
+	m := newMemoryStore()
+	userDB, jobRunDB, cityDB, metricsDB = m, m, m, m
+	sentEmails = &mailSink{}
+	publisher = sentEmails
+	singleProcess = true
+	log.Println("UseMemoryStores: keeping all data in memory")
+}
+
+// memoryStore implements every store in memory. Observations are kept raw
+// and rolled up on read; observations, forecasts and anomalies older than
+// rawRetentionDays are dropped on insert.
+type memoryStore struct {
+	mu sync.Mutex
+
+	users        map[string]*memoryUser
+	cities       map[string]CityType
+	observations map[string][]Observation // by city, ordered by time
+	forecasts    map[forecastKey]memoryForecast
+	anomalyList  []anomaly
+	backfills    map[string]backfillProgress
+	runs         []jobRun
+	lastRunID    int64
+}
+
+type memoryUser struct {
+	storedUser
+	subs         []userCity
+	weeklySentAt time.Time
+}
+
+type forecastKey struct {
+	city     string
+	target   time.Time
+	issuedAt time.Time
+}
+
+type memoryForecast struct {
+	ForecastPoint
+	lead uint16
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:        make(map[string]*memoryUser),
+		cities:       make(map[string]CityType),
+		observations: make(map[string][]Observation),
+		forecasts:    make(map[forecastKey]memoryForecast),
+		backfills:    make(map[string]backfillProgress),
+	}
+}
+
+func (m *memoryStore) createUser(ctx context.Context, u storedUser, subs []userCity, welcome EmailTask) error {
+	m.mu.Lock()
+	if _, ok := m.users[u.Email]; ok {
+		m.mu.Unlock()
+		return errUserExist
+	}
+	user := &memoryUser{storedUser: u}
+	m.users[u.Email] = user
+	user.subs = keepSubscriptions(nil, subs)
+	m.mu.Unlock()
+
+	// the mail sink never fails, so nothing is lost between the two steps
+	return publisher.publish(ctx, welcome)
+}
+
+func (m *memoryStore) user(ctx context.Context, email string) (storedUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return storedUser{}, errUserNotFound
+	}
+	return u.storedUser, nil
+}
+
+func (m *memoryStore) updateUser(ctx context.Context, email string, weeklyDigest, anomalyAlerts *bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return errUserNotFound
+	}
+	if weeklyDigest != nil {
+		u.WeeklyDigest = *weeklyDigest
+	}
+	if anomalyAlerts != nil {
+		u.AnomalyAlerts = *anomalyAlerts
+	}
+	return nil
+}
+
+func (m *memoryStore) deleteUser(ctx context.Context, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, email)
+	return nil
+}
+
+func (m *memoryStore) subscriptions(ctx context.Context, email string) ([]userCity, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return nil, nil
+	}
+	return append([]userCity(nil), u.subs...), nil
+}
+
+func (m *memoryStore) setSubscriptions(ctx context.Context, email string, subs []userCity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[email]
+	if !ok {
+		return errUserNotFound
+	}
+	u.subs = keepSubscriptions(u.subs, subs)
+	return nil
+}
+
+// keepSubscriptions returns subs in order, with the created_at of the ones
+// already in existing.
+func keepSubscriptions(existing, subs []userCity) []userCity {
+	created := make(map[string]time.Time, len(existing))
+	for _, uc := range existing {
+		created[uc.CityID] = uc.CreatedAt
+	}
+	now := time.Now()
+	result := make([]userCity, len(subs))
+	for i, uc := range subs {
+		uc.Position, uc.CreatedAt = i, now
+		if t, ok := created[uc.CityID]; ok {
+			uc.CreatedAt = t
+		}
+		result[i] = uc
+	}
+	return result
+}
+
+func (m *memoryStore) recipients(ctx context.Context, f recipientFilter) ([]recipient, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	emails := make([]string, 0, len(m.users))
+	for email := range m.users {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+
+	alertCities := make(map[string]bool, len(f.alertCities))
+	for _, id := range f.alertCities {
+		alertCities[id] = true
+	}
+	weekAgo := time.Now().AddDate(0, 0, -7)
+
+	var result []recipient
+	for _, email := range emails {
+		u := m.users[email]
+		if f.weeklyDue && (!u.WeeklyDigest || u.weeklySentAt.After(weekAgo)) {
+			continue
+		}
+		if f.search != "" && !strings.Contains(strings.ToLower(email), strings.ToLower(f.search)) {
+			continue
+		}
+		if f.alertCities != nil && !u.AnomalyAlerts {
+			continue
+		}
+
+		r := recipient{email: email, labels: make(pointLabels), weeklyDigest: u.WeeklyDigest, anomalyAlerts: u.AnomalyAlerts}
+		for _, uc := range u.subs {
+			if f.alertCities != nil && !(uc.Alerts && alertCities[uc.CityID]) {
+				continue
+			}
+			r.cities = append(r.cities, uc.CityID)
+			if uc.Nickname != "" {
+				r.labels[uc.CityID] = uc.Nickname
+			}
+		}
+		if f.alertCities != nil && len(r.cities) == 0 {
+			continue
+		}
+		result = append(result, r)
+		if f.limit > 0 && len(result) == f.limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) queueWeeklySummary(ctx context.Context, email string, summary EmailTask) error {
+	m.mu.Lock()
+	if u, ok := m.users[email]; ok {
+		u.weeklySentAt = time.Now()
+	}
+	m.mu.Unlock()
+
+	return publisher.publish(ctx, summary)
+}
+
+func (m *memoryStore) subscriberCounts(ctx context.Context) (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int)
+	for _, u := range m.users {
+		for _, uc := range u.subs {
+			counts[uc.CityID]++
+		}
+	}
+	return counts, nil
+}
+
+func (m *memoryStore) moveSubscriptions(ctx context.Context, fromID, intoID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	changed := 0
+	for _, u := range m.users {
+		from, hasInto := -1, false
+		for i, uc := range u.subs {
+			switch uc.CityID {
+			case fromID:
+				from = i
+			case intoID:
+				hasInto = true
+			}
+		}
+		if from < 0 {
+			continue
+		}
+		if hasInto {
+			u.subs = append(u.subs[:from], u.subs[from+1:]...)
+		} else {
+			u.subs[from].CityID = intoID
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+func (m *memoryStore) removeSubscriptions(ctx context.Context, cityID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for _, u := range m.users {
+		for i, uc := range u.subs {
+			if uc.CityID == cityID {
+				u.subs = append(u.subs[:i], u.subs[i+1:]...)
+				removed++
+				break
+			}
+		}
+	}
+	return removed, nil
+}
+
+// syncCities does nothing: subscriptions refer to the cities of the same
+// store.
+func (m *memoryStore) syncCities(ctx context.Context, cities []CityType) error {
+	return nil
+}
+
+func (m *memoryStore) readCities(ctx context.Context) ([]CityType, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cities := make([]CityType, 0, len(m.cities))
+	for _, city := range m.cities {
+		cities = append(cities, city)
+	}
+	return cities, nil
+}
+
+func (m *memoryStore) writeCities(ctx context.Context, cities []CityType) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, city := range cities {
+		m.cities[city.ID] = city
+	}
+	return nil
+}
+
+func (m *memoryStore) insertObservations(ctx context.Context, observations []cityObservation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, r := range observations {
+		obs := m.observations[r.city.ID]
+		// observations of a timestamp replace each other, as in weather_metrics
+		i := sort.Search(len(obs), func(i int) bool { return !obs[i].Time.Before(r.obs.Time) })
+		if i < len(obs) && obs[i].Time.Equal(r.obs.Time) {
+			obs[i] = r.obs
+		} else {
+			obs = append(obs, Observation{})
+			copy(obs[i+1:], obs[i:])
+			obs[i] = r.obs
+		}
+		m.observations[r.city.ID] = obs
+	}
+	m.prune(time.Now())
+	return nil
+}
+
+// prune drops the data older than rawRetentionDays.
+func (m *memoryStore) prune(now time.Time) {
+	start := retentionStart(rawRetentionDays, now)
+	if start.IsZero() {
+		return
+	}
+	for id, obs := range m.observations {
+		i := sort.Search(len(obs), func(i int) bool { return !obs[i].Time.Before(start) })
+		if i > 0 {
+			m.observations[id] = append([]Observation(nil), obs[i:]...)
+		}
+	}
+	for key := range m.forecasts {
+		if key.target.Before(start) {
+			delete(m.forecasts, key)
+		}
+	}
+	kept := m.anomalyList[:0]
+	for _, a := range m.anomalyList {
+		if !a.ObservedAt.Before(start) {
+			kept = append(kept, a)
+		}
+	}
+	m.anomalyList = kept
+}
+
+func (m *memoryStore) latestObservation(ctx context.Context, cityID string) (Observation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obs := m.observations[cityID]
+	if len(obs) == 0 {
+		return Observation{}, fmt.Errorf("latestObservation: %s: %w", cityID, errNoObservations)
+	}
+	return obs[len(obs)-1], nil
+}
+
+func (m *memoryStore) lastObserved(ctx context.Context) (map[string]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dayAgo := time.Now().AddDate(0, 0, -1)
+	observed := make(map[string]time.Time)
+	for id, obs := range m.observations {
+		if len(obs) > 0 && !obs[len(obs)-1].Time.Before(dayAgo) {
+			observed[id] = obs[len(obs)-1].Time
+		}
+	}
+	return observed, nil
+}
+
+func (m *memoryStore) history(ctx context.Context, cityID string, from, to time.Time, resolution string) ([]historyPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obs := m.observations[cityID]
+	points := []historyPoint{}
+	switch resolution {
+	case resolutionRaw:
+		for _, o := range obs {
+			if o.Time.Before(from) || o.Time.After(to) {
+				continue
+			}
+			points = append(points, rollup([]Observation{o}, o.Time))
+		}
+	case resolutionHourly:
+		points = append(points, rollups(obs, truncateHour(from), to, truncateHour)...)
+	case resolutionDaily:
+		points = append(points, rollups(obs, truncateDay(from), truncateDay(to), truncateDay)...)
+	default:
+		return nil, fmt.Errorf("history: unknown resolution %q", resolution)
+	}
+	return points, nil
+}
+
+func truncateHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+func truncateDay(t time.Time) time.Time {
+	y, mo, d := t.UTC().Date()
+	return time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)
+}
+
+// rollups groups observations into the steps given by truncate, like the
+// hourly and daily rollup tables, keeping the steps from from to to.
+func rollups(obs []Observation, from, to time.Time, truncate func(time.Time) time.Time) []historyPoint {
+	var points []historyPoint
+	for i := 0; i < len(obs); {
+		step := truncate(obs[i].Time)
+		j := i + 1
+		for j < len(obs) && truncate(obs[j].Time).Equal(step) {
+			j++
+		}
+		if !step.Before(from) && !step.After(to) {
+			points = append(points, rollup(obs[i:j], step))
+		}
+		i = j
+	}
+	return points
+}
+
+func rollup(obs []Observation, step time.Time) historyPoint {
+	p := historyPoint{Time: step, TempMin: obs[0].Temp, TempMax: obs[0].Temp, Samples: uint64(len(obs))}
+	for _, o := range obs {
+		p.TempMin = min(p.TempMin, o.Temp)
+		p.TempMax = max(p.TempMax, o.Temp)
+		p.WindSpeedMax = max(p.WindSpeedMax, o.WindSpeed)
+		p.WindGustMax = max(p.WindGustMax, o.WindGust)
+		p.TempAvg += o.Temp
+		p.FeelsLikeAvg += o.FeelsLike
+		p.PressureAvg += float32(o.Pressure)
+		p.HumidityAvg += float32(o.Humidity)
+		p.WindSpeedAvg += o.WindSpeed
+		p.Rain1hAvg += o.Rain1h
+		p.Snow1hAvg += o.Snow1h
+	}
+	n := float32(len(obs))
+	p.TempAvg /= n
+	p.FeelsLikeAvg /= n
+	p.PressureAvg /= n
+	p.HumidityAvg /= n
+	p.WindSpeedAvg /= n
+	p.Rain1hAvg /= n
+	p.Snow1hAvg /= n
+	return p
+}
+
+// hourlyAverages returns the hourly rollups of observations since from, by
+// hour.
+func hourlyAverages(obs []Observation, from time.Time) map[time.Time]historyPoint {
+	hours := make(map[time.Time]historyPoint)
+	for _, p := range rollups(obs, truncateHour(from), time.Now(), truncateHour) {
+		hours[p.Time] = p
+	}
+	return hours
+}
+
+func (m *memoryStore) weeklyStats(ctx context.Context, cities []string) (map[string]cityWeeklyStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	result := make(map[string]cityWeeklyStats)
+	for _, city := range cities {
+		if stats, ok := weeklyCityStats(m.observations[city], now); ok {
+			result[city] = stats
+		}
+	}
+	return result, nil
+}
+
+// weeklyCityStats computes the stats of metricsStore.weeklyStats from the
+// observations of one city. It reports false when the city has no
+// observations in the last week.
+func weeklyCityStats(obs []Observation, now time.Time) (cityWeeklyStats, bool) {
+	weekAgo, twoWeeksAgo := now.AddDate(0, 0, -7), now.AddDate(0, 0, -14)
+	var stats cityWeeklyStats
+	var sum, prevSum float64
+	var cnt, prevCnt int
+	windByDay := make(map[time.Time]float32)
+	for _, o := range obs {
+		switch {
+		case o.Time.Before(twoWeeksAgo):
+		case o.Time.Before(weekAgo):
+			prevSum += float64(o.Temp)
+			prevCnt++
+		default:
+			if cnt == 0 || o.Temp < stats.MinTemp {
+				stats.MinTemp = o.Temp
+			}
+			if cnt == 0 || o.Temp > stats.MaxTemp {
+				stats.MaxTemp = o.Temp
+			}
+			sum += float64(o.Temp)
+			cnt++
+			day := truncateDay(o.Time)
+			windByDay[day] = max(windByDay[day], o.WindSpeed)
+		}
+	}
+	if cnt == 0 {
+		return cityWeeklyStats{}, false
+	}
+
+	stats.AvgTemp = float32(sum / float64(cnt))
+	if prevCnt > 0 {
+		stats.HasPrevious = true
+		stats.AvgTempChange = stats.AvgTemp - float32(prevSum/float64(prevCnt))
+	}
+	for day, wind := range windByDay {
+		if stats.WindiestDay.IsZero() || wind > stats.WindiestSpeed {
+			stats.WindiestDay, stats.WindiestSpeed = day, wind
+		}
+	}
+	return stats, true
+}
+
+// saveCollectionReport does nothing: nothing reads the reports back.
+func (m *memoryStore) saveCollectionReport(ctx context.Context, report collectionReport) error {
+	return nil
+}
+
+func (m *memoryStore) anomalyBaselines(ctx context.Context, cities []string) (anomalyBaselines, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	base := newAnomalyBaselines()
+	now := time.Now()
+	for _, city := range cities {
+		base.add(city, hourlyAverages(m.observations[city], now.AddDate(0, 0, -anomalyBaselineDays)), now)
+	}
+	return base, nil
+}
+
+func newAnomalyBaselines() anomalyBaselines {
+	return anomalyBaselines{
+		temp:           make(map[baselineKey]baselineStats),
+		wind:           make(map[baselineKey]baselineStats),
+		pressureChange: make(map[string]baselineStats),
+		pressureBefore: make(map[string]float64),
+	}
+}
+
+// add computes the baselines of a city from its hourly averages, leaving out
+// the current hour.
+func (base anomalyBaselines) add(city string, hours map[time.Time]historyPoint, now time.Time) {
+	currentHour := truncateHour(now)
+	temps := make(map[uint8][]float64)
+	winds := make(map[uint8][]float64)
+	var changes []float64
+	for hour, p := range hours {
+		if !hour.Before(currentHour) {
+			continue
+		}
+		h := uint8(hour.Hour())
+		temps[h] = append(temps[h], float64(p.TempAvg))
+		winds[h] = append(winds[h], float64(p.WindSpeedAvg))
+		if before, ok := hours[hour.Add(-3*time.Hour)]; ok {
+			changes = append(changes, float64(p.PressureAvg-before.PressureAvg))
+		}
+	}
+	for h, values := range temps {
+		base.temp[baselineKey{city: city, hour: h}] = newBaselineStats(values)
+		base.wind[baselineKey{city: city, hour: h}] = newBaselineStats(winds[h])
+	}
+	if len(changes) > 0 {
+		base.pressureChange[city] = newBaselineStats(changes)
+	}
+	if p, ok := hours[truncateHour(now.Add(-3*time.Hour))]; ok {
+		base.pressureBefore[city] = float64(p.PressureAvg)
+	}
+}
+
+// newBaselineStats returns the mean and population standard deviation of
+// values.
+func newBaselineStats(values []float64) baselineStats {
+	var sum, sumSq float64
+	for _, v := range values {
+		sum += v
+		sumSq += v * v
+	}
+	n := float64(len(values))
+	mean := sum / n
+	return baselineStats{mean: mean, stddev: math.Sqrt(math.Max(sumSq/n-mean*mean, 0)), samples: uint64(len(values))}
+}
+
+func (m *memoryStore) saveAnomalies(ctx context.Context, anomalies []anomaly) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.anomalyList = append(m.anomalyList, anomalies...)
+	return nil
+}
+
+func (m *memoryStore) alertedSince(ctx context.Context, cities []string, since time.Time) (map[string]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[string]bool, len(cities))
+	for _, id := range cities {
+		wanted[id] = true
+	}
+	result := make(map[string]bool)
+	for _, a := range m.anomalyList {
+		if a.Alerted && wanted[a.CityID] && !a.DetectedAt.Before(since) {
+			result[anomalyAlertKey(a.CityID, a.Metric)] = true
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryStore) anomalies(ctx context.Context, cityID string, days int) ([]anomaly, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	since := time.Now().AddDate(0, 0, -days)
+	result := []anomaly{}
+	for _, a := range m.anomalyList {
+		if !a.ObservedAt.Before(since) && (cityID == "" || a.CityID == cityID) {
+			result = append(result, a)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].ObservedAt.After(result[j].ObservedAt) })
+	if len(result) > 1000 {
+		result = result[:1000]
+	}
+	return result, nil
+}
+
+func (m *memoryStore) saveForecast(ctx context.Context, cityID string, issuedAt time.Time, forecast []ForecastPoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range forecast {
+		lead, ok := forecastLeadHours(issuedAt, p.Time)
+		if !ok {
+			continue
+		}
+		m.forecasts[forecastKey{city: cityID, target: p.Time, issuedAt: issuedAt}] = memoryForecast{ForecastPoint: p, lead: lead}
+	}
+	return nil
+}
+
+func (m *memoryStore) forecastAccuracy(ctx context.Context, cityID string, days int) ([]forecastAccuracy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	since := time.Now().AddDate(0, 0, -days)
+	hours := make(map[string]map[time.Time]historyPoint)
+	sums := make(accuracySums)
+	for key, f := range m.forecasts {
+		if key.target.Before(since) || (cityID != "" && key.city != cityID) {
+			continue
+		}
+		if _, ok := hours[key.city]; !ok {
+			hours[key.city] = hourlyAverages(m.observations[key.city], since)
+		}
+		sums.add(key.city, f.lead, f.ForecastPoint, hours[key.city])
+	}
+	return sums.result(), nil
+}
+
+type accuracyKey struct {
+	city string
+	lead uint16
+}
+
+// accuracySums adds up forecast errors by city and lead time.
+type accuracySums map[accuracyKey]*forecastAccuracy
+
+// add compares a forecast step with the hourly average observed at its
+// target time, if any.
+func (sums accuracySums) add(city string, lead uint16, f ForecastPoint, hours map[time.Time]historyPoint) {
+	// observations are matched by hour, so only whole-hour steps count
+	target := truncateHour(f.Time)
+	if !target.Equal(f.Time) {
+		return
+	}
+	o, ok := hours[target]
+	if !ok {
+		return
+	}
+
+	k := accuracyKey{city: city, lead: lead}
+	a, ok := sums[k]
+	if !ok {
+		a = &forecastAccuracy{CityID: city, LeadHours: lead}
+		sums[k] = a
+	}
+	temp := float64(f.Temp - o.TempAvg)
+	wind := float64(f.WindSpeed - o.WindSpeedAvg)
+	pressure := float64(f.Pressure) - float64(o.PressureAvg)
+	a.Samples++
+	a.TempMAE += math.Abs(temp)
+	a.TempBias += temp
+	a.WindMAE += math.Abs(wind)
+	a.WindBias += wind
+	a.PressureMAE += math.Abs(pressure)
+	a.PressureBias += pressure
+}
+
+// result returns the mean errors ordered by city and lead time.
+func (sums accuracySums) result() []forecastAccuracy {
+	result := make([]forecastAccuracy, 0, len(sums))
+	for _, a := range sums {
+		n := float64(a.Samples)
+		a.TempMAE /= n
+		a.TempBias /= n
+		a.WindMAE /= n
+		a.WindBias /= n
+		a.PressureMAE /= n
+		a.PressureBias /= n
+		result = append(result, *a)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CityID != result[j].CityID {
+			return result[i].CityID < result[j].CityID
+		}
+		return result[i].LeadHours < result[j].LeadHours
+	})
+	return result
+}
+
+func (m *memoryStore) saveBackfillProgress(ctx context.Context, p backfillProgress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p.UpdatedAt = time.Now()
+	m.backfills[p.CityID] = p
+	return nil
+}
+
+func (m *memoryStore) listBackfillProgress(ctx context.Context, cityID string, statuses ...string) ([]backfillProgress, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := []backfillProgress{}
+	for _, p := range m.backfills {
+		if cityID != "" && p.CityID != cityID {
+			continue
+		}
+		if len(statuses) > 0 && !slices.Contains(statuses, p.Status) {
+			continue
+		}
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UpdatedAt.After(result[j].UpdatedAt) })
+	return result, nil
+}
+
+func (m *memoryStore) requestRun(ctx context.Context, name string) (jobRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastRunID++
+	run := jobRun{ID: m.lastRunID, Job: name, Trigger: jobTriggerManual, Status: jobRunRequested, RequestedAt: time.Now()}
+	m.runs = append(m.runs, run)
+	return run, nil
+}
+
+func (m *memoryStore) requestedRuns(ctx context.Context) ([]jobRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var runs []jobRun
+	for _, r := range m.runs {
+		if r.Status == jobRunRequested {
+			runs = append(runs, r)
+		}
+	}
+	return runs, nil
+}
+
+// run returns the run with the given ID; runs are ordered by ID.
+func (m *memoryStore) run(runID int64) *jobRun {
+	i := sort.Search(len(m.runs), func(i int) bool { return m.runs[i].ID >= runID })
+	if i == len(m.runs) || m.runs[i].ID != runID {
+		return nil
+	}
+	return &m.runs[i]
+}
+
+func (m *memoryStore) claimRun(ctx context.Context, runID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.run(runID)
+	if r == nil || r.Status != jobRunRequested {
+		return false, nil
+	}
+	r.Status, r.Replica = jobRunRunning, replicaID
+	return true, nil
+}
+
+func (m *memoryStore) startRun(ctx context.Context, name, trigger string, runID int64, started time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if runID == 0 {
+		m.lastRunID++
+		m.runs = append(m.runs, jobRun{ID: m.lastRunID, Job: name, Trigger: trigger, RequestedAt: started})
+		runID = m.lastRunID
+	}
+	r := m.run(runID)
+	if r == nil {
+		return 0, fmt.Errorf("startRun: no run %d", runID)
+	}
+	r.Status, r.Replica, r.StartedAt = jobRunRunning, replicaID, &started
+	return runID, nil
+}
+
+func (m *memoryStore) finishRun(ctx context.Context, runID int64, duration time.Duration, runErr error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.run(runID)
+	if r == nil {
+		return fmt.Errorf("finishRun: no run %d", runID)
+	}
+	finished, ms := time.Now(), duration.Milliseconds()
+	r.Status, r.Error = jobRunSucceeded, ""
+	if runErr != nil {
+		r.Status, r.Error = jobRunFailed, runErr.Error()
+	}
+	r.FinishedAt, r.DurationMs = &finished, &ms
+	return nil
+}
+
+func (m *memoryStore) interruptRuns(ctx context.Context, name, replica string, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	now := time.Now()
+	for i := range m.runs {
+		r := &m.runs[i]
+		started := r.RequestedAt
+		if r.StartedAt != nil {
+			started = *r.StartedAt
+		}
+		if r.Status != jobRunRunning || (name != "" && r.Job != name) || (replica != "" && r.Replica != replica) || !started.Before(before) {
+			continue
+		}
+		r.Status, r.Error, r.FinishedAt = jobRunFailed, interruptedRun, &now
+		n++
+	}
+	return n, nil
+}
+
+func (m *memoryStore) skipRun(ctx context.Context, name, trigger string, runID int64, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if runID == 0 {
+		m.lastRunID++
+		m.runs = append(m.runs, jobRun{ID: m.lastRunID, Job: name, Trigger: trigger, Replica: replicaID, RequestedAt: time.Now()})
+		runID = m.lastRunID
+	}
+	r := m.run(runID)
+	if r == nil {
+		return fmt.Errorf("skipRun: no run %d", runID)
+	}
+	r.Status, r.Error = jobRunSkipped, reason
+	return nil
+}
+
+func (m *memoryStore) listRuns(ctx context.Context, name string, limit int) ([]jobRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	runs := []jobRun{}
+	for i := len(m.runs) - 1; i >= 0 && len(runs) < limit; i-- {
+		if name == "" || m.runs[i].Job == name {
+			runs = append(runs, m.runs[i])
+		}
+	}
+	return runs, nil
+}
+
+func (m *memoryStore) pruneRuns(ctx context.Context, days int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := time.Now().AddDate(0, 0, -days)
+	kept := m.runs[:0]
+	for _, r := range m.runs {
+		if !r.RequestedAt.Before(start) {
+			kept = append(kept, r)
+		}
+	}
+	pruned := int64(len(m.runs) - len(kept))
+	m.runs = kept
+	return pruned, nil
+}
+
+// mailSinkSize is the number of email tasks the mail sink keeps.
+const mailSinkSize = 100
+
+// sentEmails is the mail sink of memory mode, nil otherwise.
+var sentEmails *mailSink
+
+// mailSink is the publisher of memory mode: it logs email tasks and keeps the
+// latest ones for GET /v1/sentEmails instead of sending them.
+type mailSink struct {
+	mu    sync.Mutex
+	tasks []sentEmail
+}
+
+type sentEmail struct {
+	PublishedAt time.Time `json:"published_at"`
+	EmailTask
+}
+
+func (s *mailSink) publish(ctx context.Context, task EmailTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks = append(s.tasks, sentEmail{PublishedAt: time.Now(), EmailTask: task})
+	if len(s.tasks) > mailSinkSize {
+		s.tasks = append([]sentEmail(nil), s.tasks[len(s.tasks)-mailSinkSize:]...)
+	}
+	log.Printf("mailSink: %s email to %s: %s", task.Type, task.To, task.Subject)
+	return nil
+}
+
+// list returns the kept email tasks, newest first, optionally only those to
+// one address.
+func (s *mailSink) list(to string) []sentEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := []sentEmail{}
+	for i := len(s.tasks) - 1; i >= 0; i-- {
+		if to == "" || strings.EqualFold(s.tasks[i].To, to) {
+			result = append(result, s.tasks[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,176 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// weatherMetricsColumns lists every weather_metrics column, in table order.
+const weatherMetricsColumns = "timestamp, city, city_id, temp, app_temp, pressure, humidity, clouds, visibility, wind_speed, wind_deg, wind_gust, rain_1h, snow_1h, condition_id, sunrise, sunset, provider"
+
+// weatherMetricsDedupDDL is the weather_metrics layout keyed on the city and
+// observation time. Polls that return an observation already stored collapse
+// into one row when parts merge.
+const weatherMetricsDedupDDL = `
+	CREATE TABLE %s (
+		timestamp DateTime,
+		city String,
+		city_id String,
+		temp Float32,
+		app_temp Float32,
+		pressure Int16,
+		humidity UInt8 DEFAULT 0,
+		clouds UInt8 DEFAULT 0,
+		visibility UInt32 DEFAULT 0,
+		wind_speed Float32,
+		wind_deg Int16,
+		wind_gust Float32 DEFAULT 0,
+		rain_1h Float32 DEFAULT 0,
+		snow_1h Float32 DEFAULT 0,
+		condition_id UInt16 DEFAULT 0,
+		sunrise DateTime DEFAULT 0,
+		sunset DateTime DEFAULT 0,
+		provider LowCardinality(String) DEFAULT 'openweather'
+	) ENGINE = ReplacingMergeTree()
+	PARTITION BY toYYYYMM(timestamp)
+	ORDER BY (city_id, timestamp)`
+
+// migrateMetricsLayout moves weather_metrics from ORDER BY timestamp to the
+// deduplicating layout while the service keeps writing:
+//
+//  1. create weather_metrics_dedup and copy the table into it month by month,
+//     dropping duplicate (city_id, timestamp) rows on the way;
+//  2. detach the rollup views, exchange the tables and attach the views to
+//     the new table;
+//  3. copy rows that reached the old table during the copy.
+//
+// The old table is kept as weather_metrics_unordered for a manual rollback.
+// Rows inserted by other replicas between steps 2 and 3 may be counted twice
+// or not at all in the rollups.
+func migrateMetricsLayout(ctx context.Context) error {
+	var engine, sortingKey string
+	if err := ClickhouseConn.QueryRow(ctx, `
+		SELECT engine, sorting_key FROM system.tables
+		WHERE database = currentDatabase() AND name = 'weather_metrics'`).Scan(&engine, &sortingKey); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: inspect weather_metrics: %w", err)
+	}
+
+	if engine != "ReplacingMergeTree" || sortingKey != "city_id, timestamp" {
+		if err := copyMetricsToDedupLayout(ctx); err != nil {
+			return err
+		}
+	}
+
+	// also repairs a previous run that failed after the exchange
+	return createRollupViews(ctx)
+}
+
+func copyMetricsToDedupLayout(ctx context.Context) error {
+	log.Println("migrateMetricsLayout: copying weather_metrics to the (city_id, timestamp) layout")
+
+	// leftovers of an attempt that failed before the exchange
+	if err := ClickhouseConn.Exec(ctx, "DROP TABLE IF EXISTS weather_metrics_dedup"); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: drop leftover table: %w", err)
+	}
+	if err := ClickhouseConn.Exec(ctx, fmt.Sprintf(weatherMetricsDedupDDL, "weather_metrics_dedup")); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: create weather_metrics_dedup: %w", err)
+	}
+
+	// observations can arrive a poll late, so the catch-up looks an hour back
+	var copyStart time.Time
+	if err := ClickhouseConn.QueryRow(ctx, "SELECT now() - INTERVAL 1 HOUR").Scan(&copyStart); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: read server time: %w", err)
+	}
+
+	partitions, err := metricsPartitions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if err := ClickhouseConn.Exec(ctx, `
+			INSERT INTO weather_metrics_dedup (`+weatherMetricsColumns+`)
+			SELECT `+weatherMetricsColumns+` FROM weather_metrics
+			WHERE _partition_id = ?
+			LIMIT 1 BY city_id, timestamp`, partition); err != nil {
+			return fmt.Errorf("migrateMetricsLayout: copy partition %s: %w", partition, err)
+		}
+		log.Printf("migrateMetricsLayout: copied partition %s", partition)
+	}
+
+	if err := dropRollupViews(ctx); err != nil {
+		return err
+	}
+	if err := ClickhouseConn.Exec(ctx, "EXCHANGE TABLES weather_metrics AND weather_metrics_dedup"); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: exchange tables: %w", err)
+	}
+	if err := ClickhouseConn.Exec(ctx, "RENAME TABLE weather_metrics_dedup TO weather_metrics_unordered"); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: rename old table: %w", err)
+	}
+	if err := createRollupViews(ctx); err != nil {
+		return err
+	}
+
+	if err := ClickhouseConn.Exec(ctx, `
+		INSERT INTO weather_metrics (`+weatherMetricsColumns+`)
+		SELECT `+weatherMetricsColumns+` FROM weather_metrics_unordered
+		WHERE timestamp >= ? AND (city_id, timestamp) NOT IN (
+			SELECT city_id, timestamp FROM weather_metrics WHERE timestamp >= ?
+		)
+		LIMIT 1 BY city_id, timestamp`, copyStart, copyStart); err != nil {
+		return fmt.Errorf("migrateMetricsLayout: catch up: %w", err)
+	}
+
+	log.Println("migrateMetricsLayout: done, the old table is kept as weather_metrics_unordered")
+	return nil
+}
+
+func metricsPartitions(ctx context.Context) ([]string, error) {
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT DISTINCT partition_id FROM system.parts
+		WHERE database = currentDatabase() AND table = 'weather_metrics' AND active
+		ORDER BY partition_id`)
+	if err != nil {
+		return nil, fmt.Errorf("migrateMetricsLayout: list partitions: %w", err)
+	}
+	defer rows.Close()
+
+	var partitions []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("migrateMetricsLayout: scan partition: %w", err)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+func dropRollupViews(ctx context.Context) error {
+	for _, view := range []string{"weather_metrics_hourly_mv", "weather_metrics_daily_mv"} {
+		if err := ClickhouseConn.Exec(ctx, "DROP VIEW IF EXISTS "+view); err != nil {
+			return fmt.Errorf("dropRollupViews: %s: %w", view, err)
+		}
+	}
+	return nil
+}
+
+// createRollupViews creates the rollup views as defined by the rollups
+// migration, so there is one definition of them.
+func createRollupViews(ctx context.Context) error {
+	data, err := migrationsFS.ReadFile("migrations/clickhouse/0004_rollups.up.sql")
+	if err != nil {
+		return fmt.Errorf("createRollupViews: %w", err)
+	}
+	for _, stmt := range splitStatements(string(data)) {
+		if !strings.HasPrefix(stmt, "CREATE MATERIALIZED VIEW") {
+			continue
+		}
+		if err := ClickhouseConn.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("createRollupViews: %s: %w", firstLine(stmt), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,471 @@
+package weatherservice
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/<database>/NNNN_name.up.sql with an optional
+// NNNN_name.down.sql. Data conversions that need Go are registered in
+// goMigrations under their own version numbers. Applied versions are kept in
+// a schema_migrations table in each database.
+//
+// ClickHouse has no transactional DDL, so its migrations must be safe to run
+// again after a failure half way (IF NOT EXISTS and the like).
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// migrationLockKey is the Postgres advisory lock held while migrating either
+// database, so replicas starting together do not race.
+const migrationLockKey int64 = 0x57656174686572 // "Weather"
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	UpFunc  func(ctx context.Context) error
+	// DownFunc is nil for irreversible data conversions.
+	DownFunc func(ctx context.Context) error
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+func (m migration) reversible() bool {
+	return m.DownFunc != nil || (m.UpFunc == nil && m.Down != "")
+}
+
+var goMigrations = map[string][]migration{
+	"clickhouse": {
+		{Version: 1, Name: "legacy_cities", UpFunc: migrateLegacyCities},
+		{Version: 3, Name: "backfill_metrics_city_ids", UpFunc: backfillMetricsCityIDs},
+		{Version: 6, Name: "dedup_metrics_layout", UpFunc: migrateMetricsLayout},
+	},
+	"postgres": {
+		{Version: 2, Name: "user_city_ids", UpFunc: func(ctx context.Context) error {
+			if err := loadCities(ctx); err != nil {
+				return err
+			}
+			return migrateUserCityIDs()
+		}},
+		{Version: 7, Name: "copy_user_cities", UpFunc: copyUserCities, DownFunc: uncopyUserCities},
+	},
+}
+
+// migrationStore is a database that migrations are applied to.
+type migrationStore interface {
+	Name() string
+	ensureTable(ctx context.Context) error
+	applied(ctx context.Context) (map[int]bool, error)
+	// apply runs the statements and records the new state of the migration.
+	apply(ctx context.Context, m migration, statements []string, up bool) error
+}
+
+func migrationStores() []migrationStore {
+	// ClickHouse first: the Postgres conversions read the migrated cities
+	return []migrationStore{clickhouseMigrations{}, postgresMigrations{}}
+}
+
+func loadMigrations(db string) ([]migration, error) {
+	byVersion := make(map[int]*migration)
+	for _, m := range goMigrations[db] {
+		m := m
+		byVersion[m.Version] = &m
+	}
+
+	dir := path.Join("migrations", db)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("loadMigrations: %w", err)
+	}
+	for _, e := range entries {
+		file := e.Name()
+		direction := ""
+		switch {
+		case strings.HasSuffix(file, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(file, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(file, "."+direction+".sql")
+		num, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("loadMigrations: bad migration file name %s/%s", dir, file)
+		}
+
+		data, err := migrationsFS.ReadFile(path.Join(dir, file))
+		if err != nil {
+			return nil, fmt.Errorf("loadMigrations: %w", err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name || m.UpFunc != nil {
+			return nil, fmt.Errorf("loadMigrations: %s: version %d is used twice", db, version)
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.UpFunc == nil && m.Up == "" {
+			return nil, fmt.Errorf("loadMigrations: %s: %s has no up migration", db, m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements splits a migration file into statements ending with ";" at
+// the end of a line. Lines starting with "--" are comments.
+func splitStatements(sqlText string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(sqlText, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if s := strings.TrimSpace(current.String()); s != "" {
+		statements = append(statements, s)
+	}
+	return statements
+}
+
+// withMigrationLock runs fn while holding the Postgres advisory lock.
+func withMigrationLock(ctx context.Context, fn func() error) error {
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("withMigrationLock: get connection: %w", err)
+	}
+	defer conn.Close()
+
+	log.Println("withMigrationLock: waiting for migration lock")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("withMigrationLock: lock: %w", err)
+	}
+	defer func() {
+		// a fresh context: the lock must be released even if ctx is done
+		unlockCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := conn.ExecContext(unlockCtx, "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			log.Printf("withMigrationLock: unlock: %v", err)
+		}
+	}()
+
+	return fn()
+}
+
+// Migrate applies all pending migrations to ClickHouse and Postgres and the
+// configured retention. Both connections must be open.
+func Migrate(ctx context.Context) error {
+	return withMigrationLock(ctx, func() error {
+		for _, store := range migrationStores() {
+			if err := migrateUp(ctx, store); err != nil {
+				return err
+			}
+		}
+		return applyRetention(ctx)
+	})
+}
+
+func migrateUp(ctx context.Context, store migrationStore) error {
+	migrations, err := loadMigrations(store.Name())
+	if err != nil {
+		return err
+	}
+	if err := store.ensureTable(ctx); err != nil {
+		return err
+	}
+	applied, err := store.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		log.Printf("migrateUp: %s: applying %s", store.Name(), m)
+		if err := runMigration(ctx, store, m, true); err != nil {
+			return fmt.Errorf("migrateUp: %s: %s: %w", store.Name(), m, err)
+		}
+	}
+	return nil
+}
+
+// MigrateDown reverts the last steps applied migrations of one database.
+func MigrateDown(ctx context.Context, db string, steps int) error {
+	var store migrationStore
+	for _, s := range migrationStores() {
+		if s.Name() == db {
+			store = s
+		}
+	}
+	if store == nil {
+		return fmt.Errorf("MigrateDown: unknown database %q", db)
+	}
+
+	return withMigrationLock(ctx, func() error {
+		migrations, err := loadMigrations(db)
+		if err != nil {
+			return err
+		}
+		if err := store.ensureTable(ctx); err != nil {
+			return err
+		}
+		applied, err := store.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if !m.reversible() {
+				return fmt.Errorf("MigrateDown: %s: %s is irreversible", db, m)
+			}
+			log.Printf("MigrateDown: %s: reverting %s", db, m)
+			if err := runMigration(ctx, store, m, false); err != nil {
+				return fmt.Errorf("MigrateDown: %s: %s: %w", db, m, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+func runMigration(ctx context.Context, store migrationStore, m migration, up bool) error {
+	fn, sqlText := m.UpFunc, m.Up
+	if !up {
+		fn, sqlText = m.DownFunc, m.Down
+	}
+	if fn != nil {
+		if err := fn(ctx); err != nil {
+			return err
+		}
+		return store.apply(ctx, m, nil, up)
+	}
+	return store.apply(ctx, m, splitStatements(sqlText), up)
+}
+
+// MigrationStatus lists every known migration of every database and whether
+// it is applied.
+func MigrationStatus(ctx context.Context) ([]string, error) {
+	var lines []string
+	for _, store := range migrationStores() {
+		migrations, err := loadMigrations(store.Name())
+		if err != nil {
+			return nil, err
+		}
+		if err := store.ensureTable(ctx); err != nil {
+			return nil, err
+		}
+		applied, err := store.applied(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if applied[m.Version] {
+				state = "applied"
+			}
+			lines = append(lines, fmt.Sprintf("%-10s %-40s %s", store.Name(), m, state))
+		}
+	}
+	return lines, nil
+}
+
+// RunMigrateCommand implements the "migrate" subcommand:
+//
+//	migrate [up]
+//	migrate status
+//	migrate down <clickhouse|postgres> [steps]
+func RunMigrateCommand(ctx context.Context, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "up":
+		return Migrate(ctx)
+	case "status":
+		lines, err := MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	case "down":
+		if len(args) < 2 {
+			return errors.New("usage: migrate down <clickhouse|postgres> [steps]")
+		}
+		steps := 1
+		if len(args) > 2 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil || n < 1 {
+				return fmt.Errorf("migrate down: bad steps %q", args[2])
+			}
+			steps = n
+		}
+		return MigrateDown(ctx, args[1], steps)
+	}
+	return fmt.Errorf("unknown migrate command %q, want up, status or down", cmd)
+}
+
+type postgresMigrations struct{}
+
+func (postgresMigrations) Name() string { return "postgres" }
+
+func (postgresMigrations) ensureTable(ctx context.Context) error {
+	_, err := DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("postgresMigrations: create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (postgresMigrations) applied(ctx context.Context) (map[int]bool, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("postgresMigrations: select versions: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("postgresMigrations: scan: %w", err)
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// apply runs the statements and the bookkeeping in one transaction, so a
+// failed Postgres migration leaves nothing behind.
+func (postgresMigrations) apply(ctx context.Context, m migration, statements []string, up bool) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("exec %q: %w", firstLine(stmt), err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return tx.Commit()
+}
+
+type clickhouseMigrations struct{}
+
+func (clickhouseMigrations) Name() string { return "clickhouse" }
+
+func (clickhouseMigrations) ensureTable(ctx context.Context) error {
+	err := ClickhouseConn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version UInt32,
+			name String,
+			applied UInt8,
+			updated_at DateTime64(3) DEFAULT now64(3)
+		) ENGINE = ReplacingMergeTree(updated_at)
+		ORDER BY version`)
+	if err != nil {
+		return fmt.Errorf("clickhouseMigrations: create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (clickhouseMigrations) applied(ctx context.Context) (map[int]bool, error) {
+	rows, err := ClickhouseConn.Query(ctx, "SELECT version FROM schema_migrations FINAL WHERE applied = 1")
+	if err != nil {
+		return nil, fmt.Errorf("clickhouseMigrations: select versions: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v uint32
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("clickhouseMigrations: scan: %w", err)
+		}
+		applied[int(v)] = true
+	}
+	return applied, rows.Err()
+}
+
+func (clickhouseMigrations) apply(ctx context.Context, m migration, statements []string, up bool) error {
+	for _, stmt := range statements {
+		if err := ClickhouseConn.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("exec %q: %w", firstLine(stmt), err)
+		}
+	}
+
+	var state uint8
+	if up {
+		state = 1
+	}
+	if err := ClickhouseConn.Exec(ctx,
+		"INSERT INTO schema_migrations (version, name, applied) VALUES (?, ?, ?)",
+		uint32(m.Version), m.Name, state); err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return nil
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
@@ -0,0 +1,115 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// observationColumns are the weather_metrics columns holding an Observation,
+// in the order of observationValues and scanObservation.
+const observationColumns = "timestamp, temp, app_temp, pressure, humidity, clouds, visibility, wind_speed, wind_deg, wind_gust, rain_1h, snow_1h, condition_id, sunrise, sunset, provider, source"
+
+var errNoObservations = errors.New("no observations for city")
+
+func observationValues(obs Observation) []interface{} {
+	return []interface{}{
+		obs.Time,
+		obs.Temp,
+		obs.FeelsLike,
+		obs.Pressure,
+		obs.Humidity,
+		obs.Clouds,
+		obs.Visibility,
+		obs.WindSpeed,
+		obs.WindDeg,
+		obs.WindGust,
+		obs.Rain1h,
+		obs.Snow1h,
+		obs.ConditionID,
+		dateTimeOrEpoch(obs.Sunrise),
+		dateTimeOrEpoch(obs.Sunset),
+		obs.Provider,
+		obs.Source,
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanObservation(row rowScanner) (Observation, error) {
+	var obs Observation
+	err := row.Scan(
+		&obs.Time,
+		&obs.Temp,
+		&obs.FeelsLike,
+		&obs.Pressure,
+		&obs.Humidity,
+		&obs.Clouds,
+		&obs.Visibility,
+		&obs.WindSpeed,
+		&obs.WindDeg,
+		&obs.WindGust,
+		&obs.Rain1h,
+		&obs.Snow1h,
+		&obs.ConditionID,
+		&obs.Sunrise,
+		&obs.Sunset,
+		&obs.Provider,
+		&obs.Source,
+	)
+	return obs, err
+}
+
+// dateTimeOrEpoch keeps an unset time inside the ClickHouse DateTime range.
+func dateTimeOrEpoch(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return t
+}
+
+func (clickhouseStore) latestObservation(ctx context.Context, cityID string) (Observation, error) {
+	row := ClickhouseConn.QueryRow(ctx,
+		"SELECT "+observationColumns+" FROM weather_metrics WHERE city_id = ? ORDER BY timestamp DESC LIMIT 1", cityID)
+
+	obs, err := scanObservation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Observation{}, fmt.Errorf("latestObservation: %s: %w", cityID, errNoObservations)
+	}
+	if err != nil {
+		return Observation{}, fmt.Errorf("latestObservation: %w", err)
+	}
+	return obs, nil
+}
+
+// currentWeather is the answer of GET /v1/getWeather.
+type currentWeather struct {
+	City        CityType    `json:"city"`
+	Observation Observation `json:"observation"`
+}
+
+// getCurrentWeather returns the latest collected weather for a registered
+// city, given by ID or by name as in subscriptions.
+func getCurrentWeather(ctx context.Context, entry string) (currentWeather, error) {
+	city, err := resolveCity(ctx, entry)
+	if err != nil {
+		return currentWeather{}, err
+	}
+
+	mapMu.RLock()
+	_, registered := mapOfCities[city.ID]
+	mapMu.RUnlock()
+	if !registered {
+		return currentWeather{}, fmt.Errorf("getCurrentWeather: %s: %w", city.DisplayName(), errNoObservations)
+	}
+
+	obs, err := metricsDB.latestObservation(ctx, city.ID)
+	if err != nil {
+		return currentWeather{}, err
+	}
+	return currentWeather{City: city, Observation: obs}, nil
+}
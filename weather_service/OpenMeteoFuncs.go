@@ -0,0 +1,301 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	openMeteoForecastURL  = "https://api.open-meteo.com/v1/forecast"
+	openMeteoGeocodingURL = "https://geocoding-api.open-meteo.com/v1/search"
+)
+
+type openMeteoCurrentResp struct {
+	Current struct {
+		Time                int64   `json:"time"`
+		Interval            int64   `json:"interval"`
+		Temperature2m       float32 `json:"temperature_2m"`
+		ApparentTemperature float32 `json:"apparent_temperature"`
+		PressureMsl         float32 `json:"pressure_msl"`
+		RelativeHumidity2m  float32 `json:"relative_humidity_2m"`
+		CloudCover          float32 `json:"cloud_cover"`
+		Visibility          float32 `json:"visibility"`
+		WindSpeed10m        float32 `json:"wind_speed_10m"`
+		WindDirection10m    float32 `json:"wind_direction_10m"`
+		WindGusts10m        float32 `json:"wind_gusts_10m"`
+		Rain                float32 `json:"rain"`
+		Snowfall            float32 `json:"snowfall"`
+		WeatherCode         int     `json:"weather_code"`
+	} `json:"current"`
+	Daily struct {
+		Sunrise []int64 `json:"sunrise"`
+		Sunset  []int64 `json:"sunset"`
+	} `json:"daily"`
+}
+
+type openMeteoHourlyResp struct {
+	Hourly struct {
+		Time                []int64   `json:"time"`
+		Temperature2m       []float32 `json:"temperature_2m"`
+		ApparentTemperature []float32 `json:"apparent_temperature"`
+		PressureMsl         []float32 `json:"pressure_msl"`
+		WindSpeed10m        []float32 `json:"wind_speed_10m"`
+		WeatherCode         []int     `json:"weather_code"`
+	} `json:"hourly"`
+}
+
+type openMeteoHistoryResp struct {
+	Hourly struct {
+		Time                []int64   `json:"time"`
+		Temperature2m       []float32 `json:"temperature_2m"`
+		ApparentTemperature []float32 `json:"apparent_temperature"`
+		PressureMsl         []float32 `json:"pressure_msl"`
+		RelativeHumidity2m  []float32 `json:"relative_humidity_2m"`
+		CloudCover          []float32 `json:"cloud_cover"`
+		Visibility          []float32 `json:"visibility"`
+		WindSpeed10m        []float32 `json:"wind_speed_10m"`
+		WindDirection10m    []float32 `json:"wind_direction_10m"`
+		WindGusts10m        []float32 `json:"wind_gusts_10m"`
+		Rain                []float32 `json:"rain"`
+		Snowfall            []float32 `json:"snowfall"`
+		WeatherCode         []int     `json:"weather_code"`
+	} `json:"hourly"`
+}
+
+type openMeteoGeocodingResp struct {
+	Results []struct {
+		Name        string  `json:"name"`
+		Latitude    float32 `json:"latitude"`
+		Longitude   float32 `json:"longitude"`
+		CountryCode string  `json:"country_code"`
+		Admin1      string  `json:"admin1"`
+	} `json:"results"`
+}
+
+// openMeteoProvider uses the free Open-Meteo API, which needs no key.
+type openMeteoProvider struct{}
+
+func (openMeteoProvider) Name() string { return "openmeteo" }
+
+func (openMeteoProvider) Geocode(ctx context.Context, cityName string) ([]CityType, error) {
+	u := fmt.Sprintf("%s?name=%s&count=5&format=json", openMeteoGeocodingURL, url.QueryEscape(cityName))
+
+	var geoResp openMeteoGeocodingResp
+	if err := getJSON(ctx, upstreamRequest{Caller: "openMeteoGeocode", Provider: "openmeteo", Endpoint: "openmeteo/geo", URL: u}, &geoResp); err != nil {
+		return nil, err
+	}
+	if len(geoResp.Results) == 0 {
+		return nil, fmt.Errorf("openMeteoGeocode: no results for city %s", cityName)
+	}
+
+	cities := make([]CityType, 0, len(geoResp.Results))
+	for _, r := range geoResp.Results {
+		cities = append(cities, CityType{
+			Name:    r.Name,
+			Country: r.CountryCode,
+			State:   r.Admin1,
+			Lat:     r.Latitude,
+			Lon:     r.Longitude,
+		})
+	}
+	return cities, nil
+}
+
+func (openMeteoProvider) CurrentWeather(ctx context.Context, city CityType) (Observation, error) {
+	u := fmt.Sprintf("%s?latitude=%f&longitude=%f&current=temperature_2m,apparent_temperature,pressure_msl,relative_humidity_2m,cloud_cover,visibility,wind_speed_10m,wind_direction_10m,wind_gusts_10m,rain,snowfall,weather_code&daily=sunrise,sunset&forecast_days=1&timezone=auto&wind_speed_unit=ms&timeformat=unixtime",
+		openMeteoForecastURL, city.Lat, city.Lon)
+
+	var resp openMeteoCurrentResp
+	if err := getJSON(ctx, upstreamRequest{Caller: "openMeteoCurrent", Provider: "openmeteo", Endpoint: "openmeteo/current", URL: u}, &resp); err != nil {
+		return Observation{}, err
+	}
+	if resp.Current.Time == 0 {
+		return Observation{}, errors.New("openMeteoCurrent: empty current data")
+	}
+
+	cur := resp.Current
+	// precipitation is summed over the current interval (15 minutes), scale it
+	// to an hourly amount like OpenWeather's 1h volumes
+	perHour := float32(1)
+	if cur.Interval > 0 {
+		perHour = float32(3600) / float32(cur.Interval)
+	}
+
+	obs := Observation{
+		Time:        time.Unix(cur.Time, 0),
+		Temp:        cur.Temperature2m,
+		FeelsLike:   cur.ApparentTemperature,
+		Pressure:    int16(cur.PressureMsl),
+		Humidity:    uint8(cur.RelativeHumidity2m),
+		Clouds:      uint8(cur.CloudCover),
+		Visibility:  uint32(cur.Visibility),
+		WindSpeed:   cur.WindSpeed10m,
+		WindDeg:     int16(cur.WindDirection10m),
+		WindGust:    cur.WindGusts10m,
+		Rain1h:      cur.Rain * perHour,
+		Snow1h:      cur.Snowfall * 10 / 7 * perHour, // cm of snow to mm of water
+		ConditionID: wmoConditionID(cur.WeatherCode),
+	}
+	if len(resp.Daily.Sunrise) > 0 && len(resp.Daily.Sunset) > 0 {
+		obs.Sunrise = time.Unix(resp.Daily.Sunrise[0], 0)
+		obs.Sunset = time.Unix(resp.Daily.Sunset[0], 0)
+	}
+	return obs, nil
+}
+
+func (openMeteoProvider) Forecast(ctx context.Context, city CityType) ([]ForecastPoint, error) {
+	u := fmt.Sprintf("%s?latitude=%f&longitude=%f&hourly=temperature_2m,apparent_temperature,pressure_msl,wind_speed_10m,weather_code&forecast_hours=24&wind_speed_unit=ms&timeformat=unixtime",
+		openMeteoForecastURL, city.Lat, city.Lon)
+
+	var resp openMeteoHourlyResp
+	if err := getJSON(ctx, upstreamRequest{Caller: "openMeteoForecast", Provider: "openmeteo", Endpoint: "openmeteo/forecast", URL: u}, &resp); err != nil {
+		return nil, err
+	}
+
+	h := resp.Hourly
+	n := len(h.Time)
+	if n == 0 || len(h.Temperature2m) < n || len(h.ApparentTemperature) < n ||
+		len(h.PressureMsl) < n || len(h.WindSpeed10m) < n || len(h.WeatherCode) < n {
+		return nil, errors.New("openMeteoForecast: empty or inconsistent forecast data")
+	}
+
+	points := make([]ForecastPoint, 0, n)
+	for i := 0; i < n; i++ {
+		points = append(points, ForecastPoint{
+			Time:        time.Unix(h.Time[i], 0),
+			Temp:        h.Temperature2m[i],
+			FeelsLike:   h.ApparentTemperature[i],
+			Pressure:    int16(h.PressureMsl[i]),
+			WindSpeed:   h.WindSpeed10m[i],
+			Description: wmoDescription(h.WeatherCode[i]),
+		})
+	}
+	return points, nil
+}
+
+// History returns hourly observations between from and to. The forecast API
+// keeps the past 92 days, which is as far back as backfills go.
+func (openMeteoProvider) History(ctx context.Context, city CityType, from, to time.Time) ([]Observation, error) {
+	u := fmt.Sprintf("%s?latitude=%f&longitude=%f&hourly=temperature_2m,apparent_temperature,pressure_msl,relative_humidity_2m,cloud_cover,visibility,wind_speed_10m,wind_direction_10m,wind_gusts_10m,rain,snowfall,weather_code&start_date=%s&end_date=%s&wind_speed_unit=ms&timeformat=unixtime",
+		openMeteoForecastURL, city.Lat, city.Lon, from.UTC().Format("2006-01-02"), to.UTC().Format("2006-01-02"))
+
+	var resp openMeteoHistoryResp
+	if err := getJSON(ctx, upstreamRequest{Caller: "openMeteoHistory", Provider: "openmeteo", Endpoint: "openmeteo/history", URL: u}, &resp); err != nil {
+		return nil, err
+	}
+
+	h := resp.Hourly
+	n := len(h.Time)
+	if len(h.Temperature2m) < n || len(h.ApparentTemperature) < n || len(h.PressureMsl) < n ||
+		len(h.RelativeHumidity2m) < n || len(h.CloudCover) < n || len(h.Visibility) < n ||
+		len(h.WindSpeed10m) < n || len(h.WindDirection10m) < n || len(h.WindGusts10m) < n ||
+		len(h.Rain) < n || len(h.Snowfall) < n || len(h.WeatherCode) < n {
+		return nil, errors.New("openMeteoHistory: inconsistent history data")
+	}
+
+	observations := make([]Observation, 0, n)
+	for i := 0; i < n; i++ {
+		t := time.Unix(h.Time[i], 0)
+		if t.Before(from) || !t.Before(to) {
+			continue
+		}
+		// hourly precipitation already is the amount of the preceding hour
+		observations = append(observations, Observation{
+			Time:        t,
+			Temp:        h.Temperature2m[i],
+			FeelsLike:   h.ApparentTemperature[i],
+			Pressure:    int16(h.PressureMsl[i]),
+			Humidity:    uint8(h.RelativeHumidity2m[i]),
+			Clouds:      uint8(h.CloudCover[i]),
+			Visibility:  uint32(h.Visibility[i]),
+			WindSpeed:   h.WindSpeed10m[i],
+			WindDeg:     int16(h.WindDirection10m[i]),
+			WindGust:    h.WindGusts10m[i],
+			Rain1h:      h.Rain[i],
+			Snow1h:      h.Snowfall[i] * 10 / 7,
+			ConditionID: wmoConditionID(h.WeatherCode[i]),
+			Provider:    "openmeteo",
+			Source:      observationSourceBackfill,
+		})
+	}
+	return observations, nil
+}
+
+// wmoDescription maps WMO weather interpretation codes used by Open-Meteo to
+// descriptions close to the ones OpenWeather returns.
+func wmoDescription(code int) string {
+	switch {
+	case code == 0:
+		return "clear sky"
+	case code == 1:
+		return "mainly clear"
+	case code == 2:
+		return "partly cloudy"
+	case code == 3:
+		return "overcast clouds"
+	case code == 45 || code == 48:
+		return "fog"
+	case code >= 51 && code <= 57:
+		return "drizzle"
+	case code >= 61 && code <= 67:
+		return "rain"
+	case code >= 71 && code <= 77:
+		return "snow"
+	case code >= 80 && code <= 82:
+		return "rain showers"
+	case code == 85 || code == 86:
+		return "snow showers"
+	case code >= 95:
+		return "thunderstorm"
+	}
+	return "N/A"
+}
+
+// wmoConditionID maps WMO weather codes to the closest OpenWeather condition
+// ID, so weather_metrics.condition_id has one meaning for all providers.
+func wmoConditionID(code int) uint16 {
+	switch {
+	case code == 0:
+		return 800 // clear sky
+	case code == 1:
+		return 801 // few clouds
+	case code == 2:
+		return 802 // scattered clouds
+	case code == 3:
+		return 804 // overcast clouds
+	case code == 45 || code == 48:
+		return 741 // fog
+	case code == 51 || code == 53:
+		return 300 // light drizzle
+	case code == 55:
+		return 302 // heavy drizzle
+	case code == 56 || code == 57:
+		return 511 // freezing rain
+	case code == 61:
+		return 500 // light rain
+	case code == 63:
+		return 501 // moderate rain
+	case code == 65:
+		return 502 // heavy rain
+	case code == 66 || code == 67:
+		return 511 // freezing rain
+	case code == 71:
+		return 600 // light snow
+	case code == 73 || code == 77:
+		return 601 // snow
+	case code == 75:
+		return 602 // heavy snow
+	case code >= 80 && code <= 82:
+		return 521 // shower rain
+	case code == 85 || code == 86:
+		return 621 // shower snow
+	case code == 95:
+		return 211 // thunderstorm
+	case code == 96 || code == 99:
+		return 202 // thunderstorm with heavy rain
+	}
+	return 0
+}
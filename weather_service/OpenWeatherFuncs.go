@@ -1,36 +1,55 @@
 package weatherservice
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
+	"net/url"
 	"os"
-	"strings"
+	"time"
 )
 
 const (
-	apiWeatherURL     = "https://pro.openweathermap.org/data/2.5/weather"
-	apiCoordinatesURL = "http://api.openweathermap.org/geo/1.0/direct"
-)
+	apiProHost = "https://pro.openweathermap.org"
+	apiGeoHost = "http://api.openweathermap.org"
 
-var (
-	apiKey = os.Getenv("API_WEATHER_KEY")
+	apiWeatherPath     = "/data/2.5/weather"
+	apiForecastPath    = "/data/2.5/forecast/hourly"
+	apiCoordinatesPath = "/geo/1.0/direct"
 )
 
+var apiKey = os.Getenv("API_WEATHER_KEY")
+
 type weatherAPIResp struct {
 	Dt   int64 `json:"dt"`
 	Main struct {
 		Temp      float32 `json:"temp"`
 		FeelsLike float32 `json:"feels_like"`
 		Pressure  int16   `json:"pressure"`
+		Humidity  uint8   `json:"humidity"`
 	} `json:"main"`
-	Wind struct {
+	Visibility uint32 `json:"visibility"`
+	Wind       struct {
 		Speed float32 `json:"speed"`
 		Deg   int16   `json:"deg"`
+		Gust  float32 `json:"gust"`
 	} `json:"wind"`
+	Clouds struct {
+		All uint8 `json:"all"`
+	} `json:"clouds"`
+	Rain struct {
+		OneHour float32 `json:"1h"`
+	} `json:"rain"`
+	Snow struct {
+		OneHour float32 `json:"1h"`
+	} `json:"snow"`
+	Weather []struct {
+		ID uint16 `json:"id"`
+	} `json:"weather"`
+	Sys struct {
+		Sunrise int64 `json:"sunrise"`
+		Sunset  int64 `json:"sunset"`
+	} `json:"sys"`
 	City struct {
 		Name string `json:"name"`
 	}
@@ -52,135 +71,103 @@ type forecastAPIResp struct {
 }
 
 type listForecastAPIResp struct {
-	Cnt  int `json:"cnt"`
+	Cnt  int               `json:"cnt"`
 	List []forecastAPIResp `json:"list"`
 	City struct {
 		Name string `json:"name"`
 	}
 }
 
-func getCoordinates(cityName string) (CityType, error) {
-	url := fmt.Sprintf("%s?q=%s&limit=1&appid=%s", apiCoordinatesURL, cityName, apiKey)
-	log.Printf("getCoordinates: URL=%s", strings.Replace(url, apiKey, "***", 1))
-
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("getCoordinates: request error: %v", err)
-		return CityType{}, fmt.Errorf("getCoordinates: request error: %w", err)
-	}
-	defer resp.Body.Close()
+// openWeatherProvider talks to the OpenWeather pro endpoints and needs
+// API_WEATHER_KEY.
+type openWeatherProvider struct {
+	// baseURL sends every call to one host instead, e.g. a fakeweather
+	// server; empty means the real OpenWeather hosts.
+	baseURL string
+}
 
-	log.Printf("getCoordinates: status=%s", resp.Status)
+func (openWeatherProvider) Name() string { return "openweather" }
 
-	if resp.StatusCode != http.StatusOK {
-		return CityType{}, errors.New("getCoordinates: non-200 response from API")
+func (p openWeatherProvider) url(host, path string) string {
+	if p.baseURL != "" {
+		return p.baseURL + path
 	}
+	return host + path
+}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return CityType{}, fmt.Errorf("getCoordinates: read body error: %w", err)
-	}
+func (p openWeatherProvider) Geocode(ctx context.Context, cityName string) ([]CityType, error) {
+	u := fmt.Sprintf("%s?q=%s&limit=5&appid=%s", p.url(apiGeoHost, apiCoordinatesPath), url.QueryEscape(cityName), apiKey)
 
 	var cities []CityType
-	if err := json.Unmarshal(data, &cities); err != nil {
-		log.Printf("getCoordinates: decode error: %v", err)
-		return CityType{}, fmt.Errorf("getCoordinates: decode error: %w", err)
+	if err := getJSON(ctx, upstreamRequest{Caller: "getCoordinates", Provider: "openweather", Endpoint: "openweather/geo", URL: u, Secret: apiKey}, &cities); err != nil {
+		return nil, err
 	}
 	if len(cities) == 0 {
-		log.Printf("getCoordinates: no results for city %s", cityName)
-		return CityType{}, fmt.Errorf("getCoordinates: no results for city %s", cityName)
+		return nil, fmt.Errorf("getCoordinates: no results for city %s", cityName)
 	}
 
-	if len(data) > 0 {
-		sample := string(data)
-		if len(sample) > 200 {
-			sample = sample[:200] + "..."
-		}
-		log.Printf("getCoordinates: response sample=%s", sample)
-	}
-
-	return cities[0], nil
+	return cities, nil
 }
 
-func getWeather(city CityType) (weatherAPIResp, error) {
-	url := fmt.Sprintf("%s?lat=%f&lon=%f&appid=%s&units=metric", apiWeatherURL, city.Lat, city.Lon, apiKey)
-	log.Printf("getWeather: URL=%s", strings.Replace(url, apiKey, "***", 1))
-
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("getWeather: request error: %v", err)
-		return weatherAPIResp{}, fmt.Errorf("getWeather: request error: %w", err)
-	}
-	defer resp.Body.Close()
-
-	log.Printf("getWeather: status=%s", resp.Status)
-
-	if resp.StatusCode != http.StatusOK {
-		return weatherAPIResp{}, errors.New("getWeather: non-200 response from API")
-	}
-
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return weatherAPIResp{}, fmt.Errorf("getWeather: read body error: %w", err)
-	}
-
-	if len(data) > 0 {
-		sample := string(data)
-		if len(sample) > 200 {
-			sample = sample[:200] + "..."
-		}
-		log.Printf("getWeather: response sample=%s", sample)
-	}
+func (p openWeatherProvider) CurrentWeather(ctx context.Context, city CityType) (Observation, error) {
+	u := fmt.Sprintf("%s?lat=%f&lon=%f&appid=%s&units=metric", p.url(apiProHost, apiWeatherPath), city.Lat, city.Lon, apiKey)
 
 	var weatherResp weatherAPIResp
-	if err := json.Unmarshal(data, &weatherResp); err != nil {
-		log.Printf("getWeather: decode error: %v", err)
-		return weatherAPIResp{}, fmt.Errorf("getWeather: decode error: %w", err)
-	}
-
-	return weatherResp, nil
+	if err := getJSON(ctx, upstreamRequest{Caller: "getWeather", Provider: "openweather", Endpoint: "openweather/weather", URL: u, Secret: apiKey}, &weatherResp); err != nil {
+		return Observation{}, err
+	}
+
+	obs := Observation{
+		Time:       time.Unix(weatherResp.Dt, 0),
+		Temp:       weatherResp.Main.Temp,
+		FeelsLike:  weatherResp.Main.FeelsLike,
+		Pressure:   weatherResp.Main.Pressure,
+		Humidity:   weatherResp.Main.Humidity,
+		Clouds:     weatherResp.Clouds.All,
+		Visibility: weatherResp.Visibility,
+		WindSpeed:  weatherResp.Wind.Speed,
+		WindDeg:    weatherResp.Wind.Deg,
+		WindGust:   weatherResp.Wind.Gust,
+		Rain1h:     weatherResp.Rain.OneHour,
+		Snow1h:     weatherResp.Snow.OneHour,
+		Sunrise:    time.Unix(weatherResp.Sys.Sunrise, 0),
+		Sunset:     time.Unix(weatherResp.Sys.Sunset, 0),
+	}
+	if len(weatherResp.Weather) > 0 {
+		obs.ConditionID = weatherResp.Weather[0].ID
+	}
+	return obs, nil
 }
 
-func getWeatherForecast(city CityType) ([]forecastAPIResp, error) {
-	url := fmt.Sprintf("https://pro.openweathermap.org/data/2.5/forecast/hourly?lat=%f&lon=%f&appid=%s&units=metric", city.Lat, city.Lon, apiKey)
-	log.Printf("getWeatherForecast: URL=%s", strings.Replace(url, apiKey, "***", 1))
-
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Printf("getWeatherForecast: request error: %v", err)
-		return []forecastAPIResp{}, fmt.Errorf("getWeatherForecast: request error: %w", err)
-	}
-	defer resp.Body.Close()
-
-	log.Printf("getWeatherForecast: status=%s", resp.Status)
+func (p openWeatherProvider) Forecast(ctx context.Context, city CityType) ([]ForecastPoint, error) {
+	u := fmt.Sprintf("%s?lat=%f&lon=%f&appid=%s&units=metric", p.url(apiProHost, apiForecastPath), city.Lat, city.Lon, apiKey)
 
-	if resp.StatusCode != http.StatusOK {
-		return []forecastAPIResp{}, errors.New("getWeatherForecast: non-200 response from API")
+	var forecastResp listForecastAPIResp
+	if err := getJSON(ctx, upstreamRequest{Caller: "getWeatherForecast", Provider: "openweather", Endpoint: "openweather/forecast", URL: u, Secret: apiKey}, &forecastResp); err != nil {
+		return nil, err
 	}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return []forecastAPIResp{}, fmt.Errorf("getWeatherForecast: read body error: %w", err)
+	if forecastResp.Cnt == 0 || len(forecastResp.List) == 0 {
+		return nil, errors.New("getWeatherForecast: empty forecast data")
 	}
 
-	if len(data) > 0 {
-		sample := string(data)
-		if len(sample) > 200 {
-			sample = sample[:200] + "..."
+	// Only the next 24 hours go into the daily email
+	list := forecastResp.List[:min(24, len(forecastResp.List))]
+	points := make([]ForecastPoint, 0, len(list))
+	for _, entry := range list {
+		desc := "N/A"
+		if len(entry.Weather) > 0 {
+			desc = entry.Weather[0].Description
 		}
-		log.Printf("getWeatherForecast: response sample=%s", sample)
-	}
-
-	var forecastResp listForecastAPIResp
-	if err := json.Unmarshal(data, &forecastResp); err != nil {
-		log.Printf("getWeatherForecast: decode error: %v", err)
-		return []forecastAPIResp{}, fmt.Errorf("getWeatherForecast: decode error: %w", err)
-	}
-
-	if forecastResp.Cnt == 0 || len(forecastResp.List) == 0 {
-		return []forecastAPIResp{}, errors.New("getWeatherForecast: empty forecast data")
+		points = append(points, ForecastPoint{
+			Time:        time.Unix(entry.Dt, 0),
+			Temp:        entry.Main.Temp,
+			FeelsLike:   entry.Main.FeelsLike,
+			Pressure:    entry.Main.Pressure,
+			WindSpeed:   entry.Wind.Speed,
+			Description: desc,
+		})
 	}
 
-	// Return the first day's forecast as a sample
-	return forecastResp.List[0:24], nil
+	return points, nil
 }
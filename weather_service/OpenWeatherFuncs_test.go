@@ -0,0 +1,155 @@
+package weatherservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ilyaytrewq/WeatherServiceAPI/fakeweather"
+)
+
+// fakeUpstream is a fakeweather server wired into the package: an
+// OpenWeather provider pointed at it and a fast upstream client.
+type fakeUpstream struct {
+	provider openWeatherProvider
+	server   *fakeweather.Server
+	// hits counts the data requests that reached the server.
+	hits atomic.Int32
+	// onHit, if set, is called with the request number before the server
+	// answers.
+	onHit func(n int32)
+}
+
+func newFakeUpstream(t *testing.T, opts fakeweather.Options) *fakeUpstream {
+	t.Helper()
+	f := &fakeUpstream{server: fakeweather.New(opts)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := f.hits.Add(1)
+		if f.onHit != nil {
+			f.onHit(n)
+		}
+		f.server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	f.provider = openWeatherProvider{baseURL: ts.URL}
+
+	oldKey, oldUpstream := apiKey, upstream
+	t.Cleanup(func() { apiKey, upstream = oldKey, oldUpstream })
+	apiKey = "test-key"
+	upstream = newTestUpstreamClient()
+	return f
+}
+
+func newTestUpstreamClient() *upstreamClient {
+	c := newUpstreamClient()
+	c.callTimeout = 200 * time.Millisecond
+	c.maxRetries = 2
+	c.baseBackoff = time.Millisecond
+	c.maxBackoff = 5 * time.Millisecond
+	c.breakerThreshold = 100
+	c.breakerCooldown = 50 * time.Millisecond
+	return c
+}
+
+func TestOpenWeatherProviderAgainstFake(t *testing.T) {
+	ts, _ := fakeweather.NewTestServer(fakeweather.Options{Seed: 7})
+	defer ts.Close()
+	oldKey, oldUpstream := apiKey, upstream
+	defer func() { apiKey, upstream = oldKey, oldUpstream }()
+	apiKey, upstream = "test-key", newTestUpstreamClient()
+
+	p := openWeatherProvider{baseURL: ts.URL}
+	ctx := context.Background()
+
+	cities, err := p.Geocode(ctx, "Springfield")
+	if err != nil {
+		t.Fatalf("Geocode: %v", err)
+	}
+	if len(cities) == 0 || cities[0].Name != "Springfield" {
+		t.Fatalf("Geocode = %+v, want candidates named Springfield", cities)
+	}
+
+	obs, err := p.CurrentWeather(ctx, cities[0])
+	if err != nil {
+		t.Fatalf("CurrentWeather: %v", err)
+	}
+	if obs.Time.IsZero() || obs.Pressure == 0 || obs.Sunrise.IsZero() {
+		t.Errorf("CurrentWeather = %+v, want time, pressure and sunrise filled in", obs)
+	}
+
+	forecast, err := p.Forecast(ctx, cities[0])
+	if err != nil {
+		t.Fatalf("Forecast: %v", err)
+	}
+	if len(forecast) != 24 {
+		t.Fatalf("Forecast returned %d points, want 24", len(forecast))
+	}
+	for i := 1; i < len(forecast); i++ {
+		if forecast[i].Time.Sub(forecast[i-1].Time) != time.Hour {
+			t.Fatalf("forecast points %d and %d are not an hour apart", i-1, i)
+		}
+	}
+
+	// the same seed gives the same weather
+	again, err := p.CurrentWeather(ctx, cities[0])
+	if err != nil {
+		t.Fatalf("CurrentWeather: %v", err)
+	}
+	if again.Temp != obs.Temp {
+		t.Errorf("second CurrentWeather temp = %v, want %v", again.Temp, obs.Temp)
+	}
+}
+
+func TestOpenWeatherProviderFaults(t *testing.T) {
+	city := CityType{Name: "Testville", Lat: 10, Lon: 20}
+
+	tests := []struct {
+		fault string
+		// hits is the number of requests the call makes: retryable
+		// faults use up every retry, the others fail at once
+		hits int32
+	}{
+		{fakeweather.FaultServerError, 3},
+		{fakeweather.FaultRateLimit, 3},
+		{fakeweather.FaultTimeout, 3},
+		{fakeweather.FaultMalformed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fault, func(t *testing.T) {
+			f := newFakeUpstream(t, fakeweather.Options{Fault: tt.fault, TimeoutDelay: time.Second})
+
+			if _, err := f.provider.CurrentWeather(context.Background(), city); err == nil {
+				t.Fatal("CurrentWeather succeeded, want an error")
+			}
+			if got := f.hits.Load(); got != tt.hits {
+				t.Errorf("server got %d requests, want %d", got, tt.hits)
+			}
+
+			// the provider recovers as soon as the upstream does
+			f.server.SetFault(fakeweather.FaultNone, 0)
+			if _, err := f.provider.CurrentWeather(context.Background(), city); err != nil {
+				t.Errorf("CurrentWeather after the fault: %v", err)
+			}
+		})
+	}
+}
+
+func TestProviderChainFallsBack(t *testing.T) {
+	broken := newFakeUpstream(t, fakeweather.Options{Fault: fakeweather.FaultServerError})
+	healthy := newFakeUpstream(t, fakeweather.Options{})
+	chain := providerChain{broken.provider, healthy.provider}
+
+	obs, err := chain.CurrentWeather(context.Background(), CityType{Name: "Testville", Lat: 10, Lon: 20})
+	if err != nil {
+		t.Fatalf("CurrentWeather: %v", err)
+	}
+	if obs.Provider != "openweather" {
+		t.Errorf("Provider = %q, want openweather", obs.Provider)
+	}
+	if broken.hits.Load() == 0 || healthy.hits.Load() != 1 {
+		t.Errorf("hits: broken %d, healthy %d; want the broken one tried first", broken.hits.Load(), healthy.hits.Load())
+	}
+}
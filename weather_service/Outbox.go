@@ -0,0 +1,239 @@
+package weatherservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// outboxPollInterval is how often the relay looks for tasks queued by
+	// other replicas or due for a retry; tasks queued by this replica wake
+	// it at once.
+	outboxPollInterval = envDuration("OUTBOX_POLL_INTERVAL", 5*time.Second)
+	// outboxRetentionDays is how long published tasks are kept in
+	// email_outbox; 0 keeps them forever.
+	outboxRetentionDays = envDays("OUTBOX_RETENTION_DAYS", 7)
+)
+
+const (
+	outboxBatchSize      = 20
+	outboxPublishTimeout = 5 * time.Second
+	outboxMaxBackoff     = time.Hour
+)
+
+// outboxWake wakes the relay of this replica after a task was queued.
+var outboxWake = make(chan struct{}, 1)
+
+// In postgres mode email tasks are not published to RabbitMQ directly: they
+// are written to email_outbox, in the transaction of the user change that
+// caused them where there is one, and the relay publishes them. A task is
+// marked sent only after RabbitMQ took it, so it is delivered at least once
+// even if RabbitMQ or the replica is down when the task is created.
+
+// queueEmailTask writes a task to email_outbox through q, which is the
+// transaction of the change the email belongs to or DB. The relay has to be
+// woken by wakeOutboxRelay after the commit.
+func queueEmailTask(ctx context.Context, q sqlQueryer, task EmailTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("queueEmailTask: marshal: %w", err)
+	}
+	if _, err := q.ExecContext(ctx, "INSERT INTO email_outbox (task) VALUES ($1)", string(body)); err != nil {
+		return fmt.Errorf("queueEmailTask: insert: %w", err)
+	}
+	return nil
+}
+
+func wakeOutboxRelay() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// publish queues a task that does not belong to a user change.
+func (postgresStore) publish(ctx context.Context, task EmailTask) error {
+	if err := queueEmailTask(ctx, DB, task); err != nil {
+		return err
+	}
+	wakeOutboxRelay()
+	return nil
+}
+
+// StartOutboxRelay starts publishing the tasks of email_outbox to RabbitMQ.
+// Every replica runs a relay; rows are locked while published, so each task
+// is taken by one of them.
+func StartOutboxRelay() {
+	go func() {
+		ticker := time.NewTicker(outboxPollInterval)
+		defer ticker.Stop()
+		var pruned time.Time
+		for {
+			for rabbitConnected() {
+				n, err := relayOutbox()
+				if err != nil {
+					log.Printf("outboxRelay: %v", err)
+				}
+				if err != nil || n < outboxBatchSize {
+					break
+				}
+			}
+			if time.Since(pruned) > time.Hour {
+				pruneOutbox()
+				pruned = time.Now()
+			}
+
+			select {
+			case <-outboxWake:
+			case <-ticker.C:
+			}
+		}
+	}()
+	log.Println("StartOutboxRelay: relay started")
+}
+
+// relayOutbox publishes a batch of due tasks, oldest first, and returns the
+// number of tasks it published. While RabbitMQ is disconnected the tasks stay
+// in the outbox as they are. The tasks published before a failure are
+// committed as sent either way, so they are not published again.
+func relayOutbox() (int, error) {
+	// the transaction spans every publish of the batch: a shorter timeout
+	// would roll back the sent marks of tasks RabbitMQ already took
+	ctx, cancel := context.WithTimeout(context.Background(), outboxBatchSize*outboxPublishTimeout+30*time.Second)
+	defer cancel()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, task, task->>'to', attempts
+		FROM email_outbox
+		WHERE sent_at IS NULL AND next_attempt_at <= now()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, outboxBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("select due tasks: %w", err)
+	}
+	var batch []outboxTask
+	for rows.Next() {
+		var t outboxTask
+		if err := rows.Scan(&t.id, &t.body, &t.to, &t.attempts); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan task: %w", err)
+		}
+		batch = append(batch, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("select due tasks: %w", err)
+	}
+
+	sent, err := relayBatch(ctx, batch, publishToRabbit, outboxTx{tx})
+	if err != nil && !errors.Is(err, errRabbitDown) {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return sent, err
+}
+
+type outboxTask struct {
+	id       int64
+	body     []byte
+	to       string
+	attempts int
+}
+
+// outboxMarks records what became of the published tasks.
+type outboxMarks interface {
+	markSent(ctx context.Context, id int64) error
+	reschedule(ctx context.Context, id int64, retry time.Duration, cause error) error
+}
+
+// relayBatch publishes the tasks in order and returns the number it
+// published. It stops at the first failed publish: the task is retried with
+// exponential backoff and the rest wait for the next run. errRabbitDown is
+// not an attempt and is returned with the task left as it is. Any other
+// error comes from marks, and the marks made so far must not be committed.
+func relayBatch(ctx context.Context, batch []outboxTask, publish func(context.Context, []byte) error, marks outboxMarks) (int, error) {
+	for i, t := range batch {
+		ctxPub, cancelPub := context.WithTimeout(ctx, outboxPublishTimeout)
+		pubErr := publish(ctxPub, t.body)
+		cancelPub()
+
+		if errors.Is(pubErr, errRabbitDown) {
+			// the rest of the batch waits for the reconnect, which wakes
+			// the relay
+			return i, pubErr
+		}
+		if pubErr != nil {
+			retry := outboxBackoff(t.attempts + 1)
+			log.Printf("outboxRelay: publish failed for %s, retry in %s: %v", t.to, retry, pubErr)
+			if err := marks.reschedule(ctx, t.id, retry, pubErr); err != nil {
+				return i, fmt.Errorf("reschedule task %d: %w", t.id, err)
+			}
+			return i, nil
+		}
+
+		if err := marks.markSent(ctx, t.id); err != nil {
+			return i, fmt.Errorf("mark task %d sent: %w", t.id, err)
+		}
+		log.Printf("outboxRelay: email task published for %s", t.to)
+	}
+	return len(batch), nil
+}
+
+// outboxTx makes the marks in the relay's transaction.
+type outboxTx struct {
+	tx sqlQueryer
+}
+
+func (o outboxTx) markSent(ctx context.Context, id int64) error {
+	_, err := o.tx.ExecContext(ctx, "UPDATE email_outbox SET attempts = attempts + 1, sent_at = now() WHERE id = $1", id)
+	return err
+}
+
+func (o outboxTx) reschedule(ctx context.Context, id int64, retry time.Duration, cause error) error {
+	_, err := o.tx.ExecContext(ctx, `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = now() + make_interval(secs => $2), last_error = $3
+		WHERE id = $1
+	`, id, retry.Seconds(), cause.Error())
+	return err
+}
+
+// outboxBackoff is the delay before the next attempt of a task that failed
+// attempts times: 5s, 10s, 20s and so on up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 10 {
+		return outboxMaxBackoff
+	}
+	return min(5*time.Second<<(attempts-1), outboxMaxBackoff)
+}
+
+// pruneOutbox deletes tasks published more than outboxRetentionDays ago.
+func pruneOutbox() {
+	if outboxRetentionDays == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	res, err := DB.ExecContext(ctx, "DELETE FROM email_outbox WHERE sent_at < now() - make_interval(days => $1)", outboxRetentionDays)
+	if err != nil {
+		log.Printf("pruneOutbox: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("pruneOutbox: deleted %d tasks", n)
+	}
+}
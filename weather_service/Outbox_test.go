@@ -0,0 +1,144 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeOutboxMarks records the marks of relayBatch and fails the mark of
+// task failOn.
+type fakeOutboxMarks struct {
+	sent        []int64
+	rescheduled map[int64]time.Duration
+	failOn      int64
+}
+
+func (m *fakeOutboxMarks) markSent(ctx context.Context, id int64) error {
+	if id == m.failOn {
+		return errors.New("connection lost")
+	}
+	m.sent = append(m.sent, id)
+	return nil
+}
+
+func (m *fakeOutboxMarks) reschedule(ctx context.Context, id int64, retry time.Duration, cause error) error {
+	if id == m.failOn {
+		return errors.New("connection lost")
+	}
+	m.rescheduled[id] = retry
+	return nil
+}
+
+func TestRelayBatch(t *testing.T) {
+	batch := []outboxTask{
+		{id: 1, body: []byte("1"), to: "a@example.com"},
+		{id: 2, body: []byte("2"), to: "b@example.com", attempts: 2},
+		{id: 3, body: []byte("3"), to: "c@example.com"},
+	}
+
+	tests := []struct {
+		name string
+		// publishErrs are the results of the publishes by task body
+		publishErrs map[string]error
+		failOn      int64
+
+		wantSent        int
+		wantErr         error
+		wantMarked      []int64
+		wantRescheduled map[int64]time.Duration
+		wantPublished   int
+	}{
+		{
+			name:          "all published",
+			wantSent:      3,
+			wantMarked:    []int64{1, 2, 3},
+			wantPublished: 3,
+		},
+		{
+			// the first task stays marked sent and the rest wait
+			name:            "publish fails mid-batch",
+			publishErrs:     map[string]error{"2": errors.New("nack")},
+			wantSent:        1,
+			wantMarked:      []int64{1},
+			wantRescheduled: map[int64]time.Duration{2: outboxBackoff(3)},
+			wantPublished:   2,
+		},
+		{
+			name:          "RabbitMQ drops mid-batch",
+			publishErrs:   map[string]error{"2": fmt.Errorf("publish: %w", errRabbitDown)},
+			wantSent:      1,
+			wantErr:       errRabbitDown,
+			wantMarked:    []int64{1},
+			wantPublished: 2,
+		},
+		{
+			name:          "mark fails",
+			failOn:        2,
+			wantSent:      1,
+			wantErr:       errors.New("mark task 2 sent"),
+			wantMarked:    []int64{1},
+			wantPublished: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			published := 0
+			publish := func(ctx context.Context, body []byte) error {
+				published++
+				return tt.publishErrs[string(body)]
+			}
+			marks := &fakeOutboxMarks{rescheduled: make(map[int64]time.Duration), failOn: tt.failOn}
+
+			sent, err := relayBatch(context.Background(), batch, publish, marks)
+			if sent != tt.wantSent {
+				t.Errorf("relayBatch = %d, want %d", sent, tt.wantSent)
+			}
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("relayBatch error: %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Errorf("relayBatch error = nil, want %v", tt.wantErr)
+			case errors.Is(tt.wantErr, errRabbitDown) != errors.Is(err, errRabbitDown):
+				// the relay commits the marks only on errRabbitDown
+				t.Errorf("relayBatch error = %v, want %v", err, tt.wantErr)
+			}
+			if published != tt.wantPublished {
+				t.Errorf("published %d tasks, want %d", published, tt.wantPublished)
+			}
+			if fmt.Sprint(marks.sent) != fmt.Sprint(tt.wantMarked) {
+				t.Errorf("marked sent %v, want %v", marks.sent, tt.wantMarked)
+			}
+			if len(marks.rescheduled) != len(tt.wantRescheduled) {
+				t.Errorf("rescheduled %v, want %v", marks.rescheduled, tt.wantRescheduled)
+			}
+			for id, retry := range tt.wantRescheduled {
+				if marks.rescheduled[id] != retry {
+					t.Errorf("task %d rescheduled in %s, want %s", id, marks.rescheduled[id], retry)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, outboxMaxBackoff},
+		// the shift would overflow long before this
+		{100, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
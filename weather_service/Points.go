@@ -0,0 +1,116 @@
+package weatherservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+const (
+	cityKindCity  = "city"
+	cityKindPoint = "point"
+)
+
+// PointSubscription is a subscription to an arbitrary location, e.g. a field
+// site. Points go through the same collection pipeline as cities; the label
+// is per user and stored as the nickname of the subscription.
+type PointSubscription struct {
+	ID    string  `json:"id,omitempty"`
+	Label string  `json:"label"`
+	Lat   float32 `json:"lat"`
+	Lon   float32 `json:"lon"`
+	// Alerts is the anomaly alert opt-in, as in Subscription.
+	Alerts *bool `json:"alerts,omitempty"`
+}
+
+// pointGridResolution is the grid step in degrees that points are snapped to.
+// Subscriptions in the same cell share one upstream call. Changing it only
+// affects new subscriptions: existing points keep their cell.
+var pointGridResolution = loadPointGridResolution()
+
+func loadPointGridResolution() float64 {
+	const def = 0.05 // ~5 km
+	v := os.Getenv("POINT_GRID_RESOLUTION")
+	if v == "" {
+		return def
+	}
+	res, err := strconv.ParseFloat(v, 64)
+	if err != nil || res <= 0 || res > 1 {
+		log.Printf("loadPointGridResolution: invalid POINT_GRID_RESOLUTION %q, using %.2f", v, def)
+		return def
+	}
+	return res
+}
+
+func snapToGrid(v float32) float32 {
+	snapped := math.Round(float64(v)/pointGridResolution) * pointGridResolution
+	// keep the value printable without float noise like 52.050000000000004
+	return float32(math.Round(snapped*1e6) / 1e6)
+}
+
+// pointCity returns the grid cell a location falls into as a CityType.
+func pointCity(lat, lon float32) CityType {
+	lat, lon = snapToGrid(lat), snapToGrid(lon)
+	name := fmt.Sprintf("%.4f,%.4f", lat, lon)
+	return CityType{
+		ID:   uuid.NewSHA1(cityNamespace, []byte("point|"+name)).String(),
+		Name: name,
+		Kind: cityKindPoint,
+		Lat:  lat,
+		Lon:  lon,
+	}
+}
+
+// resolvePoints validates points, snaps them to the grid and fills in their
+// IDs. Points that land in the same cell are merged, the first label wins.
+func resolvePoints(points []PointSubscription) ([]PointSubscription, []CityType, error) {
+	resolved := make([]PointSubscription, 0, len(points))
+	cells := make([]CityType, 0, len(points))
+	seen := make(map[string]struct{})
+
+	for _, p := range points {
+		if p.Lat < -90 || p.Lat > 90 || p.Lon < -180 || p.Lon > 180 {
+			return nil, nil, fmt.Errorf("resolvePoints: invalid coordinates %.4f,%.4f", p.Lat, p.Lon)
+		}
+		cell := pointCity(p.Lat, p.Lon)
+		if _, ok := seen[cell.ID]; ok {
+			continue
+		}
+		seen[cell.ID] = struct{}{}
+
+		if p.Label == "" {
+			p.Label = fmt.Sprintf("%.4f,%.4f", p.Lat, p.Lon)
+		}
+		p.ID = cell.ID
+		resolved = append(resolved, p)
+		cells = append(cells, cell)
+	}
+	return resolved, cells, nil
+}
+
+// pointLabels maps subscribed IDs to the user's nicknames for them: the labels
+// of points and the optional nicknames of cities.
+type pointLabels map[string]string
+
+func parsePointLabels(data []byte) pointLabels {
+	labels := make(pointLabels)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &labels); err != nil {
+			log.Printf("parsePointLabels: %v", err)
+		}
+	}
+	return labels
+}
+
+// subscriptionName is how a subscribed city or point is shown to one user.
+func subscriptionName(id string, labels pointLabels) string {
+	if label, ok := labels[id]; ok {
+		return label
+	}
+	return cityNames([]string{id})[0]
+}
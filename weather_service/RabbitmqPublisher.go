@@ -2,46 +2,161 @@ package weatherservice
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/ilyaytrewq/WeatherServiceAPI/mailer"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 var (
-	rabbitConn    *amqp.Connection
-	rabbitChannel *amqp.Channel
 	emailExchange = "email_exchange"
 	emailQueue    = "email_queue"
 )
 
-type EmailTask struct {
-	To      string                 `json:"to"`
-	Subject string                 `json:"subject"`
-	Body    string                 `json:"body"`
-	Type    string                 `json:"type,omitempty"`
-	Meta    map[string]interface{} `json:"meta,omitempty"`
-}
+const (
+	rabbitReconnectDelay    = time.Second
+	rabbitMaxReconnectDelay = 30 * time.Second
+	// rabbitConnectWait is how long InitRabbit waits for the first
+	// connection before it leaves the publisher connecting in the background.
+	rabbitConnectWait = 10 * time.Second
+)
+
+// errRabbitDown is returned by publishToRabbit while the publisher is not
+// connected. The outbox relay keeps the tasks and waits for the reconnect.
+var errRabbitDown = errors.New("rabbitmq is not connected")
+
+// EmailTask is an email published to smtp_service, or sent by the mail
+// worker in sqlite mode.
+type EmailTask = mailer.Task
+
+// InlineImage is an image embedded into the HTML part and referenced from it
+// as cid:<CID>.
+type InlineImage = mailer.InlineImage
 
+// InitRabbit starts the RabbitMQ publisher. It fails only without
+// RABBITMQ_URL: if the broker is not reachable yet, the publisher keeps
+// connecting in the background and email tasks wait in the outbox.
 func InitRabbit() error {
 	url := os.Getenv("RABBITMQ_URL")
 	if url == "" {
 		return fmt.Errorf("RABBITMQ_URL env not set")
 	}
 
+	go rabbit.run(url)
+	select {
+	case <-rabbit.connected():
+	case <-time.After(rabbitConnectWait):
+		log.Println("InitRabbit: broker not reachable yet, connecting in the background")
+	}
+	return nil
+}
+
+// rabbit publishes email tasks to email_exchange, from which smtp_service
+// consumes them.
+var rabbit = &rabbitPublisher{up: make(chan struct{})}
+
+// rabbitPublisher keeps one connection and one channel in confirm mode and
+// reconnects when either closes. Publishes are serialized by mu, so there is
+// one message in flight and the next confirmation and return belong to it.
+type rabbitPublisher struct {
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	// up is closed while connected.
+	up chan struct{}
+	// redeclare is set after a return: the queue or its binding was
+	// deleted and is declared again before the next publish.
+	redeclare bool
+}
+
+func (p *rabbitPublisher) connected() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.up
+}
+
+func rabbitConnected() bool {
+	select {
+	case <-rabbit.connected():
+		return true
+	default:
+		return false
+	}
+}
+
+// run connects and reconnects with exponential backoff until the process
+// exits.
+func (p *rabbitPublisher) run(url string) {
+	delay := rabbitReconnectDelay
+	for {
+		connClosed, chClosed, err := p.connect(url)
+		if err != nil {
+			log.Printf("rabbitPublisher: %v, retry in %s", err, delay)
+			time.Sleep(delay)
+			delay = min(2*delay, rabbitMaxReconnectDelay)
+			continue
+		}
+		delay = rabbitReconnectDelay
+		log.Println("rabbitPublisher: connected")
+		// tasks queued during the outage are published now
+		wakeOutboxRelay()
+
+		var reason *amqp.Error
+		select {
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		}
+		log.Printf("rabbitPublisher: connection lost: %v", reason)
+		p.disconnect()
+	}
+}
+
+func (p *rabbitPublisher) connect(url string) (connClosed, chClosed chan *amqp.Error, err error) {
 	conn, err := amqp.Dial(url)
 	if err != nil {
-		return fmt.Errorf("InitRabbit: dial: %w", err)
+		return nil, nil, fmt.Errorf("dial: %w", err)
 	}
 	ch, err := conn.Channel()
 	if err != nil {
 		conn.Close()
-		return fmt.Errorf("InitRabbit: channel: %w", err)
+		return nil, nil, fmt.Errorf("channel: %w", err)
+	}
+	if err := declareEmailQueue(ch); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("confirm mode: %w", err)
 	}
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn, p.ch = conn, ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	p.redeclare = false
+	close(p.up)
+	return conn.NotifyClose(make(chan *amqp.Error, 1)), ch.NotifyClose(make(chan *amqp.Error, 1)), nil
+}
+
+func (p *rabbitPublisher) disconnect() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn.Close()
+	p.conn, p.ch = nil, nil
+	p.up = make(chan struct{})
+}
+
+// declareEmailQueue declares email_exchange and email_queue and binds them.
+func declareEmailQueue(ch *amqp.Channel) error {
 	if err := ch.ExchangeDeclare(
 		emailExchange, // name
 		"direct",      // type
@@ -51,12 +166,10 @@ func InitRabbit() error {
 		false,         // no-wait
 		nil,           // args
 	); err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: exchange declare: %w", err)
+		return fmt.Errorf("exchange declare: %w", err)
 	}
 
-	_, err = ch.QueueDeclare(
+	_, err := ch.QueueDeclare(
 		emailQueue, // name
 		true,       // durable
 		false,      // delete when unused
@@ -65,36 +178,40 @@ func InitRabbit() error {
 		nil,        // args
 	)
 	if err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: queue declare: %w", err)
+		return fmt.Errorf("queue declare: %w", err)
 	}
 
 	if err := ch.QueueBind(emailQueue, "send_email", emailExchange, false, nil); err != nil {
-		ch.Close()
-		conn.Close()
-		return fmt.Errorf("InitRabbit: queue bind: %w", err)
+		return fmt.Errorf("queue bind: %w", err)
 	}
-
-	rabbitConn = conn
-	rabbitChannel = ch
-	log.Println("InitRabbit: connected")
 	return nil
 }
 
-func publishEmailTask(ctx context.Context, task EmailTask) error {
-	if rabbitChannel == nil {
-		return fmt.Errorf("rabbit channel not initialized")
+// publishToRabbit publishes an email task encoded as JSON to email_exchange
+// and waits until the broker confirms it. Tasks get here through the outbox
+// relay (see queueEmailTask).
+func publishToRabbit(ctx context.Context, body []byte) error {
+	return rabbit.publish(ctx, body)
+}
+
+func (p *rabbitPublisher) publish(ctx context.Context, body []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ch == nil || p.ch.IsClosed() {
+		return errRabbitDown
 	}
-	body, err := json.Marshal(task)
-	if err != nil {
-		return fmt.Errorf("publishEmailTask: marshal: %w", err)
+	if p.redeclare {
+		if err := declareEmailQueue(p.ch); err != nil {
+			return fmt.Errorf("publishEmailTask: %w", err)
+		}
+		p.redeclare = false
 	}
 
-	err = rabbitChannel.PublishWithContext(ctx,
+	err := p.ch.PublishWithContext(ctx,
 		emailExchange, // exchange
 		"send_email",  // routing key
-		false,         // mandatory
+		true,          // mandatory
 		false,         // immediate
 		amqp.Publishing{
 			ContentType:  "application/json",
@@ -106,5 +223,29 @@ func publishEmailTask(ctx context.Context, task EmailTask) error {
 	if err != nil {
 		return fmt.Errorf("publishEmailTask: publish: %w", err)
 	}
-	return nil
+
+	// an unroutable message is returned before it is acked
+	select {
+	case c, ok := <-p.confirms:
+		if !ok {
+			return fmt.Errorf("publishEmailTask: channel closed before confirm")
+		}
+		select {
+		case r, ok := <-p.returns:
+			if ok {
+				p.redeclare = true
+				return fmt.Errorf("publishEmailTask: returned as unroutable: %s", r.ReplyText)
+			}
+		default:
+		}
+		if !c.Ack {
+			return fmt.Errorf("publishEmailTask: nacked by the broker")
+		}
+		return nil
+	case <-ctx.Done():
+		// a late confirm would be taken for the next message's, so the
+		// channel is dropped and run reconnects
+		p.ch.Close()
+		return fmt.Errorf("publishEmailTask: waiting for confirm: %w", ctx.Err())
+	}
 }
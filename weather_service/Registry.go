@@ -0,0 +1,267 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// City statuses. Only active cities are polled; paused ones lost their last
+// subscriber and are reactivated by the next subscription. Retired and merged
+// cities are no longer offered, their history stays in weather_metrics.
+const (
+	cityStatusActive  = "active"
+	cityStatusPaused  = "paused"
+	cityStatusRetired = "retired"
+	cityStatusMerged  = "merged"
+)
+
+var errCityNotFound = errors.New("city not found")
+
+// active reports whether the city is polled. Rows written before statuses
+// existed have none.
+func (c CityType) active() bool {
+	return c.Status == "" || c.Status == cityStatusActive
+}
+
+// followMerges returns the city a merged city was merged into, following
+// chains of merges.
+func followMerges(city CityType) CityType {
+	mapMu.RLock()
+	defer mapMu.RUnlock()
+
+	for i := 0; city.MergedInto != "" && i < 10; i++ {
+		next, ok := mapOfCities[city.MergedInto]
+		if !ok {
+			break
+		}
+		city = next
+	}
+	return city
+}
+
+// registryEntry is a city as shown to admins, with its subscriber count.
+type registryEntry struct {
+	CityType
+	Subscribers int `json:"subscribers"`
+}
+
+func (postgresStore) subscriberCounts(ctx context.Context) (map[string]int, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT city_id, count(*) FROM user_cities GROUP BY city_id")
+	if err != nil {
+		return nil, fmt.Errorf("subscriberCounts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, fmt.Errorf("subscriberCounts: scan: %w", err)
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// listRegistry returns every known city with its subscriber count, optionally
+// only those in the given status.
+func listRegistry(ctx context.Context, status string) ([]registryEntry, error) {
+	counts, err := userDB.subscriberCounts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listRegistry: %w", err)
+	}
+
+	mapMu.RLock()
+	entries := make([]registryEntry, 0, len(mapOfCities))
+	for id, city := range mapOfCities {
+		if city.Status == "" {
+			city.Status = cityStatusActive
+		}
+		if status != "" && city.Status != status {
+			continue
+		}
+		entries = append(entries, registryEntry{CityType: city, Subscribers: counts[id]})
+	}
+	mapMu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Subscribers != entries[j].Subscribers {
+			return entries[i].Subscribers > entries[j].Subscribers
+		}
+		return entries[i].DisplayName() < entries[j].DisplayName()
+	})
+	return entries, nil
+}
+
+// syncCityRegistry pauses active cities without subscribers and reactivates
+// paused ones that got subscribers back, e.g. through a direct database edit.
+// Runs before every collection, so unsubscribed cities are not polled.
+func syncCityRegistry(ctx context.Context) error {
+	counts, err := userDB.subscriberCounts(ctx)
+	if err != nil {
+		return fmt.Errorf("syncCityRegistry: %w", err)
+	}
+
+	var changed []CityType
+	mapMu.RLock()
+	for id, city := range mapOfCities {
+		switch {
+		case city.active() && counts[id] == 0:
+			city.Status = cityStatusPaused
+			changed = append(changed, city)
+		case city.Status == cityStatusPaused && counts[id] > 0:
+			city.Status = cityStatusActive
+			changed = append(changed, city)
+		}
+	}
+	mapMu.RUnlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := saveCities(ctx, changed); err != nil {
+		return fmt.Errorf("syncCityRegistry: %w", err)
+	}
+	log.Printf("syncCityRegistry: %d cities changed status", len(changed))
+	return nil
+}
+
+func registeredCity(id string) (CityType, error) {
+	mapMu.RLock()
+	city, ok := mapOfCities[id]
+	mapMu.RUnlock()
+	if !ok {
+		return CityType{}, fmt.Errorf("%w: %s", errCityNotFound, id)
+	}
+	return city, nil
+}
+
+// renameCity changes the display name of a city. Its ID, and so its
+// subscriptions and history, stay the same.
+func renameCity(ctx context.Context, id, name string) (CityType, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return CityType{}, errors.New("renameCity: name is required")
+	}
+	city, err := registeredCity(id)
+	if err != nil {
+		return CityType{}, fmt.Errorf("renameCity: %w", err)
+	}
+
+	city.Name = name
+	if err := saveCities(ctx, []CityType{city}); err != nil {
+		return CityType{}, fmt.Errorf("renameCity: %w", err)
+	}
+	log.Printf("renameCity: %s renamed to %s", id, city.DisplayName())
+	return city, nil
+}
+
+// mergeCities moves the subscribers of a duplicate city to another one and
+// marks the duplicate as merged. The duplicate's history stays under its own
+// ID: city_id is part of the weather_metrics sorting key and cannot be
+// updated in place.
+func mergeCities(ctx context.Context, fromID, intoID string) (CityType, error) {
+	if fromID == intoID {
+		return CityType{}, errors.New("mergeCities: cannot merge a city into itself")
+	}
+	from, err := registeredCity(fromID)
+	if err != nil {
+		return CityType{}, fmt.Errorf("mergeCities: %w", err)
+	}
+	into, err := registeredCity(intoID)
+	if err != nil {
+		return CityType{}, fmt.Errorf("mergeCities: %w", err)
+	}
+	if from.Kind == cityKindPoint || into.Kind == cityKindPoint {
+		return CityType{}, errors.New("mergeCities: point subscriptions cannot be merged")
+	}
+	if from.Status == cityStatusMerged || into.Status == cityStatusMerged || into.Status == cityStatusRetired {
+		return CityType{}, fmt.Errorf("mergeCities: cannot merge %s (%s) into %s (%s)", fromID, from.Status, intoID, into.Status)
+	}
+
+	moved, err := userDB.moveSubscriptions(ctx, fromID, intoID)
+	if err != nil {
+		return CityType{}, fmt.Errorf("mergeCities: %w", err)
+	}
+
+	from.Status, from.MergedInto = cityStatusMerged, intoID
+	changed := []CityType{from}
+	if moved > 0 && !into.active() {
+		into.Status = cityStatusActive
+		changed = append(changed, into)
+	}
+	if err := saveCities(ctx, changed); err != nil {
+		return CityType{}, fmt.Errorf("mergeCities: %w", err)
+	}
+	log.Printf("mergeCities: %s merged into %s, %d subscribers moved", from.DisplayName(), into.DisplayName(), moved)
+	return from, nil
+}
+
+// retireCity removes a city from every subscription and stops polling it.
+// Subscribing to it again registers it anew.
+func retireCity(ctx context.Context, id string) (CityType, error) {
+	city, err := registeredCity(id)
+	if err != nil {
+		return CityType{}, fmt.Errorf("retireCity: %w", err)
+	}
+
+	unsubscribed, err := userDB.removeSubscriptions(ctx, id)
+	if err != nil {
+		return CityType{}, fmt.Errorf("retireCity: %w", err)
+	}
+
+	city.Status, city.MergedInto = cityStatusRetired, ""
+	if err := saveCities(ctx, []CityType{city}); err != nil {
+		return CityType{}, fmt.Errorf("retireCity: %w", err)
+	}
+	log.Printf("retireCity: %s retired, %d users unsubscribed", city.DisplayName(), unsubscribed)
+	return city, nil
+}
+
+func (postgresStore) moveSubscriptions(ctx context.Context, fromID, intoID string) (int, error) {
+	into, err := registeredCity(intoID)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: %w", err)
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := mirrorCities(ctx, tx, []CityType{into}); err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: %w", err)
+	}
+	dropped, err := tx.ExecContext(ctx, `
+		DELETE FROM user_cities f
+		WHERE f.city_id = $1
+		AND EXISTS (SELECT 1 FROM user_cities t WHERE t.user_email = f.user_email AND t.city_id = $2)`, fromID, intoID)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: delete duplicates: %w", err)
+	}
+	moved, err := tx.ExecContext(ctx, "UPDATE user_cities SET city_id = $2 WHERE city_id = $1", fromID, intoID)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: update: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: commit: %w", err)
+	}
+	n, _ := dropped.RowsAffected()
+	m, _ := moved.RowsAffected()
+	return int(n + m), nil
+}
+
+func (postgresStore) removeSubscriptions(ctx context.Context, cityID string) (int, error) {
+	res, err := DB.ExecContext(ctx, "DELETE FROM user_cities WHERE city_id = $1", cityID)
+	if err != nil {
+		return 0, fmt.Errorf("removeSubscriptions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
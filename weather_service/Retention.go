@@ -0,0 +1,85 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Retention of weather data in days; 0 keeps the data forever. Changing a
+// value takes effect on the next migration run.
+var (
+	rawRetentionDays    = envDays("METRICS_RAW_TTL_DAYS", 90)
+	hourlyRetentionDays = envDays("METRICS_HOURLY_TTL_DAYS", 730)
+	dailyRetentionDays  = envDays("METRICS_DAILY_TTL_DAYS", 0)
+)
+
+// minRawRetentionDays is the raw history weeklyStats reads: the last week and
+// the week before, which the summary compares it with.
+const minRawRetentionDays = 14
+
+// checkRetention rejects a raw retention too short for the weekly summary.
+func checkRetention() error {
+	if rawRetentionDays != 0 && rawRetentionDays < minRawRetentionDays {
+		return fmt.Errorf("METRICS_RAW_TTL_DAYS=%d is too short, the weekly summary needs at least %d days (0 keeps the data forever)",
+			rawRetentionDays, minRawRetentionDays)
+	}
+	return nil
+}
+
+type retentionRule struct {
+	table  string
+	column string
+	days   int
+}
+
+func retentionRules() []retentionRule {
+	return []retentionRule{
+		{"weather_metrics", "timestamp", rawRetentionDays},
+		{"weather_metrics_hourly", "hour", hourlyRetentionDays},
+		{"weather_metrics_daily", "day", dailyRetentionDays},
+	}
+}
+
+// applyRetention sets the TTL of the raw and rollup tables to the configured
+// retention. A table is only altered when its TTL differs, since changing a
+// TTL rewrites existing parts.
+func applyRetention(ctx context.Context) error {
+	if err := checkRetention(); err != nil {
+		return fmt.Errorf("applyRetention: %w", err)
+	}
+	for _, rule := range retentionRules() {
+		var engine string
+		if err := ClickhouseConn.QueryRow(ctx, `
+			SELECT engine_full FROM system.tables
+			WHERE database = currentDatabase() AND name = ?`, rule.table).Scan(&engine); err != nil {
+			return fmt.Errorf("applyRetention: inspect %s: %w", rule.table, err)
+		}
+
+		var query string
+		switch {
+		case rule.days > 0 && !strings.Contains(engine, fmt.Sprintf("TTL %s + toIntervalDay(%d)", rule.column, rule.days)):
+			query = fmt.Sprintf("ALTER TABLE %s MODIFY TTL %s + INTERVAL %d DAY", rule.table, rule.column, rule.days)
+		case rule.days == 0 && strings.Contains(engine, " TTL "):
+			query = fmt.Sprintf("ALTER TABLE %s REMOVE TTL", rule.table)
+		default:
+			continue
+		}
+
+		if err := ClickhouseConn.Exec(ctx, query); err != nil {
+			return fmt.Errorf("applyRetention: %s: %w", rule.table, err)
+		}
+		log.Printf("applyRetention: %s keeps %d days (0 = forever)", rule.table, rule.days)
+	}
+	return nil
+}
+
+// retentionStart is the oldest time still kept at the given retention.
+func retentionStart(days int, now time.Time) time.Time {
+	if days == 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -days)
+}
@@ -0,0 +1,946 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB is the database of sqlite mode.
+var SQLiteDB *sql.DB
+
+// UseSQLiteStores keeps all state in one SQLite file and sends emails with
+// the built-in mail worker instead of RabbitMQ and smtp_service. The file is
+// created and migrated if needed. Like memory mode, it is meant for a single
+// process, which leads every job itself. Call it instead of InitClickhouse,
+// InitPostgres, Migrate and InitRabbit.
+func UseSQLiteStores(ctx context.Context, path string) error {
+	worker, err := newMailWorker()
+	if err != nil {
+		return fmt.Errorf("UseSQLiteStores: %w", err)
+	}
+	if path == "" {
+		path = "weather.db"
+	}
+	// WAL lets the HTTP handlers read while a job writes; immediate
+	// transactions wait for the write lock up front instead of failing when
+	// they upgrade to it
+	dsn := "file:" + path + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)" +
+		"&_time_format=sqlite&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return fmt.Errorf("UseSQLiteStores: open %s: %w", path, err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("UseSQLiteStores: open %s: %w", path, err)
+	}
+	SQLiteDB = db
+
+	if err := migrateUp(ctx, sqliteMigrations{}); err != nil {
+		return fmt.Errorf("UseSQLiteStores: %w", err)
+	}
+
+	s := sqliteStore{mail: worker}
+	userDB, jobRunDB, cityDB, metricsDB = s, s, s, s
+	publisher = worker
+	go worker.run()
+	singleProcess = true
+	log.Printf("UseSQLiteStores: keeping all data in %s", path)
+	return nil
+}
+
+// utc converts the times among args to UTC. Times are stored as text, so
+// they only compare correctly in one time zone.
+func utc(args ...interface{}) []interface{} {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			args[i] = t.UTC()
+		}
+	}
+	return args
+}
+
+// jsonList encodes values for "IN (SELECT value FROM json_each(?))", which
+// stands in for the array parameters of the other stores.
+func jsonList(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// sqliteStore implements every store in SQLiteDB. Observations are kept raw
+// and rolled up on read, as in memoryStore, so history and anomaly
+// baselines reach back METRICS_RAW_TTL_DAYS. Emails that belong to a user
+// change are queued for mail in the same transaction.
+type sqliteStore struct {
+	mail *mailWorker
+}
+
+func (s sqliteStore) createUser(ctx context.Context, u storedUser, subs []userCity, welcome EmailTask) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users (email, password, weekly_digest, anomaly_alerts) VALUES (?, ?, ?, ?)",
+		u.Email, u.PasswordHash, u.WeeklyDigest, u.AnomalyAlerts)
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return errUserExist
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveSQLiteUserCities(ctx, tx, u.Email, subs); err != nil {
+		return err
+	}
+	if err := queueSQLiteEmail(ctx, tx, welcome); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	s.mail.notify()
+	return nil
+}
+
+func (sqliteStore) user(ctx context.Context, email string) (storedUser, error) {
+	u := storedUser{Email: email}
+	err := SQLiteDB.QueryRowContext(ctx, "SELECT password, weekly_digest, anomaly_alerts FROM users WHERE email = ?", email).
+		Scan(&u.PasswordHash, &u.WeeklyDigest, &u.AnomalyAlerts)
+	if err == sql.ErrNoRows {
+		return storedUser{}, errUserNotFound
+	}
+	if err != nil {
+		return storedUser{}, err
+	}
+	return u, nil
+}
+
+func (sqliteStore) updateUser(ctx context.Context, email string, weeklyDigest, anomalyAlerts *bool) error {
+	_, err := SQLiteDB.ExecContext(ctx, `
+		UPDATE users
+		SET weekly_digest = COALESCE(?, weekly_digest), anomaly_alerts = COALESCE(?, anomaly_alerts)
+		WHERE email = ?`, weeklyDigest, anomalyAlerts, email)
+	return err
+}
+
+func (sqliteStore) deleteUser(ctx context.Context, email string) error {
+	_, err := SQLiteDB.ExecContext(ctx, "DELETE FROM users WHERE email = ?", email)
+	return err
+}
+
+func (sqliteStore) subscriptions(ctx context.Context, email string) ([]userCity, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT uc.city_id, c.kind, uc.nickname, uc.position, uc.alerts, uc.created_at
+		FROM user_cities uc
+		JOIN cities c ON c.id = uc.city_id
+		WHERE uc.user_email = ?
+		ORDER BY uc.position, uc.created_at`, email)
+	if err != nil {
+		return nil, fmt.Errorf("subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []userCity
+	for rows.Next() {
+		var uc userCity
+		if err := rows.Scan(&uc.CityID, &uc.Kind, &uc.Nickname, &uc.Position, &uc.Alerts, &uc.CreatedAt); err != nil {
+			return nil, fmt.Errorf("subscriptions: scan: %w", err)
+		}
+		subs = append(subs, uc)
+	}
+	return subs, rows.Err()
+}
+
+func (sqliteStore) setSubscriptions(ctx context.Context, email string, subs []userCity) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("setSubscriptions: begin: %w", err)
+	}
+	defer tx.Rollback()
+	if err := saveSQLiteUserCities(ctx, tx, email, subs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("setSubscriptions: commit: %w", err)
+	}
+	return nil
+}
+
+// saveSQLiteUserCities is saveUserCities for SQLite. The cities are in the
+// same database, so there is nothing to mirror.
+func saveSQLiteUserCities(ctx context.Context, tx *sql.Tx, email string, subs []userCity) error {
+	ids := make([]string, len(subs))
+	for i, uc := range subs {
+		ids[i] = uc.CityID
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_cities WHERE user_email = ? AND city_id NOT IN (SELECT value FROM json_each(?))",
+		email, jsonList(ids)); err != nil {
+		return fmt.Errorf("saveUserCities: delete: %w", err)
+	}
+	now := time.Now()
+	for i, uc := range subs {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO user_cities (user_email, city_id, nickname, position, alerts, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (user_email, city_id) DO UPDATE
+			SET nickname = excluded.nickname, position = excluded.position, alerts = excluded.alerts`,
+			utc(email, uc.CityID, uc.Nickname, i, uc.Alerts, now)...)
+		if err != nil {
+			return fmt.Errorf("saveUserCities: upsert %s: %w", uc.CityID, err)
+		}
+	}
+	return nil
+}
+
+func (sqliteStore) recipients(ctx context.Context, f recipientFilter) ([]recipient, error) {
+	join := "LEFT JOIN user_cities uc ON uc.user_email = u.email"
+	var where []string
+	var args []interface{}
+	if f.alertCities != nil {
+		// only the subscriptions opted in to alerts are returned
+		join = "JOIN user_cities uc ON uc.user_email = u.email AND uc.alerts AND uc.city_id IN (SELECT value FROM json_each(?))"
+		args = append(args, jsonList(f.alertCities))
+		where = append(where, "u.anomaly_alerts")
+	}
+	if f.weeklyDue {
+		where = append(where, "u.weekly_digest AND (u.weekly_digest_sent_at IS NULL OR u.weekly_digest_sent_at < ?)")
+		args = append(args, time.Now().AddDate(0, 0, -7))
+	}
+	if f.search != "" {
+		// LIKE ignores case like ILIKE, for ASCII letters
+		where = append(where, "u.email LIKE '%' || ? || '%'")
+		args = append(args, f.search)
+	}
+
+	query := "SELECT u.email, u.weekly_digest, u.anomaly_alerts, uc.city_id, COALESCE(uc.nickname, '') FROM users u " + join
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY u.email, uc.position, uc.created_at"
+
+	rows, err := SQLiteDB.QueryContext(ctx, query, utc(args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("recipients: %w", err)
+	}
+	defer rows.Close()
+
+	// one row per subscription, grouped into recipients here
+	var result []recipient
+	for rows.Next() {
+		var r recipient
+		var cityID sql.NullString
+		var nickname string
+		if err := rows.Scan(&r.email, &r.weeklyDigest, &r.anomalyAlerts, &cityID, &nickname); err != nil {
+			return nil, fmt.Errorf("recipients: scan: %w", err)
+		}
+		if len(result) == 0 || result[len(result)-1].email != r.email {
+			if f.limit > 0 && len(result) == f.limit {
+				break
+			}
+			r.labels = make(pointLabels)
+			result = append(result, r)
+		}
+		last := &result[len(result)-1]
+		if cityID.Valid {
+			last.cities = append(last.cities, cityID.String)
+			if nickname != "" {
+				last.labels[cityID.String] = nickname
+			}
+		}
+	}
+	return result, rows.Err()
+}
+
+func (s sqliteStore) queueWeeklySummary(ctx context.Context, email string, summary EmailTask) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET weekly_digest_sent_at = ? WHERE email = ?", utc(time.Now(), email)...); err != nil {
+		return err
+	}
+	if err := queueSQLiteEmail(ctx, tx, summary); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	s.mail.notify()
+	return nil
+}
+
+func (sqliteStore) subscriberCounts(ctx context.Context) (map[string]int, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, "SELECT city_id, count(*) FROM user_cities GROUP BY city_id")
+	if err != nil {
+		return nil, fmt.Errorf("subscriberCounts: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, fmt.Errorf("subscriberCounts: scan: %w", err)
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+func (sqliteStore) moveSubscriptions(ctx context.Context, fromID, intoID string) (int, error) {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	dropped, err := tx.ExecContext(ctx, `
+		DELETE FROM user_cities
+		WHERE city_id = ?
+		AND user_email IN (SELECT user_email FROM user_cities WHERE city_id = ?)`, fromID, intoID)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: delete duplicates: %w", err)
+	}
+	moved, err := tx.ExecContext(ctx, "UPDATE user_cities SET city_id = ? WHERE city_id = ?", intoID, fromID)
+	if err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: update: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("moveSubscriptions: commit: %w", err)
+	}
+	n, _ := dropped.RowsAffected()
+	m, _ := moved.RowsAffected()
+	return int(n + m), nil
+}
+
+func (sqliteStore) removeSubscriptions(ctx context.Context, cityID string) (int, error) {
+	res, err := SQLiteDB.ExecContext(ctx, "DELETE FROM user_cities WHERE city_id = ?", cityID)
+	if err != nil {
+		return 0, fmt.Errorf("removeSubscriptions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// syncCities does nothing: user_cities references the cities table of the
+// same database.
+func (sqliteStore) syncCities(ctx context.Context, cities []CityType) error {
+	return nil
+}
+
+func (sqliteStore) readCities(ctx context.Context) ([]CityType, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, "SELECT id, name, country, state, kind, lat, lon, status, merged_into FROM cities")
+	if err != nil {
+		return nil, fmt.Errorf("select cities: %w", err)
+	}
+	defer rows.Close()
+
+	var cities []CityType
+	for rows.Next() {
+		var city CityType
+		if err := rows.Scan(&city.ID, &city.Name, &city.Country, &city.State, &city.Kind, &city.Lat, &city.Lon, &city.Status, &city.MergedInto); err != nil {
+			return nil, fmt.Errorf("scan city: %w", err)
+		}
+		cities = append(cities, city)
+	}
+	return cities, rows.Err()
+}
+
+func (sqliteStore) writeCities(ctx context.Context, cities []CityType) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("writeCities: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	for _, city := range cities {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO cities (id, name, country, state, kind, status, merged_into, lat, lon, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE
+			SET name = excluded.name, country = excluded.country, state = excluded.state, kind = excluded.kind,
+				status = excluded.status, merged_into = excluded.merged_into, lat = excluded.lat, lon = excluded.lon,
+				updated_at = excluded.updated_at`,
+			utc(city.ID, city.Name, city.Country, city.State, city.Kind, city.Status, city.MergedInto, city.Lat, city.Lon, now)...)
+		if err != nil {
+			return fmt.Errorf("writeCities: upsert %s: %w", city.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("writeCities: commit: %w", err)
+	}
+	return nil
+}
+
+// insertObservations replaces observations of the same city and time, and
+// drops the data older than rawRetentionDays.
+func (sqliteStore) insertObservations(ctx context.Context, observations []cityObservation) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("insertObservations: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT OR REPLACE INTO weather_metrics ("+observationColumns+", city_id) VALUES (?"+strings.Repeat(", ?", 17)+")")
+	if err != nil {
+		return fmt.Errorf("insertObservations: prepare: %w", err)
+	}
+	defer stmt.Close()
+	for _, r := range observations {
+		if _, err := stmt.ExecContext(ctx, utc(append(observationValues(r.obs), r.city.ID)...)...); err != nil {
+			return fmt.Errorf("insertObservations: insert: %w", err)
+		}
+	}
+
+	if start := retentionStart(rawRetentionDays, time.Now()); !start.IsZero() {
+		for _, prune := range []string{
+			"DELETE FROM weather_metrics WHERE timestamp < ?",
+			"DELETE FROM forecasts WHERE target_time < ?",
+			"DELETE FROM anomalies WHERE observed_at < ?",
+		} {
+			if _, err := tx.ExecContext(ctx, prune, utc(start)...); err != nil {
+				return fmt.Errorf("insertObservations: prune: %w", err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("insertObservations: commit: %w", err)
+	}
+	return nil
+}
+
+func (sqliteStore) latestObservation(ctx context.Context, cityID string) (Observation, error) {
+	row := SQLiteDB.QueryRowContext(ctx,
+		"SELECT "+observationColumns+" FROM weather_metrics WHERE city_id = ? ORDER BY timestamp DESC LIMIT 1", cityID)
+
+	obs, err := scanObservation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Observation{}, fmt.Errorf("latestObservation: %s: %w", cityID, errNoObservations)
+	}
+	if err != nil {
+		return Observation{}, fmt.Errorf("latestObservation: %w", err)
+	}
+	return obs, nil
+}
+
+func (sqliteStore) lastObserved(ctx context.Context) (map[string]time.Time, error) {
+	// max() loses the column type the driver parses times by, so the newest
+	// rows are selected instead
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT city_id, timestamp FROM weather_metrics
+		WHERE (city_id, timestamp) IN (
+			SELECT city_id, max(timestamp) FROM weather_metrics
+			WHERE timestamp >= ?
+			GROUP BY city_id
+		)`, utc(time.Now().AddDate(0, 0, -1))...)
+	if err != nil {
+		return nil, fmt.Errorf("lastObserved: %w", err)
+	}
+	defer rows.Close()
+
+	observed := make(map[string]time.Time)
+	for rows.Next() {
+		var id string
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, fmt.Errorf("lastObserved: scan: %w", err)
+		}
+		observed[id] = t
+	}
+	return observed, rows.Err()
+}
+
+// observations returns the observations of the cities from from until to,
+// excluded, by city and ordered by time.
+func (sqliteStore) observations(ctx context.Context, cities []string, from, to time.Time) (map[string][]Observation, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT city_id, `+observationColumns+` FROM weather_metrics
+		WHERE city_id IN (SELECT value FROM json_each(?)) AND timestamp >= ? AND timestamp < ?
+		ORDER BY city_id, timestamp`, utc(jsonList(cities), from, to)...)
+	if err != nil {
+		return nil, fmt.Errorf("observations: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[string][]Observation)
+	for rows.Next() {
+		var id string
+		var obs Observation
+		if err := rows.Scan(&id, &obs.Time, &obs.Temp, &obs.FeelsLike, &obs.Pressure, &obs.Humidity, &obs.Clouds,
+			&obs.Visibility, &obs.WindSpeed, &obs.WindDeg, &obs.WindGust, &obs.Rain1h, &obs.Snow1h, &obs.ConditionID,
+			&obs.Sunrise, &obs.Sunset, &obs.Provider, &obs.Source); err != nil {
+			return nil, fmt.Errorf("observations: scan: %w", err)
+		}
+		result[id] = append(result[id], obs)
+	}
+	return result, rows.Err()
+}
+
+func (s sqliteStore) history(ctx context.Context, cityID string, from, to time.Time, resolution string) ([]historyPoint, error) {
+	truncate := truncateHour
+	step := time.Hour
+	switch resolution {
+	case resolutionRaw:
+		obs, err := s.observations(ctx, []string{cityID}, from, to.Add(time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("history: %w", err)
+		}
+		points := make([]historyPoint, 0, len(obs[cityID]))
+		for _, o := range obs[cityID] {
+			points = append(points, rollup([]Observation{o}, o.Time))
+		}
+		return points, nil
+	case resolutionHourly:
+	case resolutionDaily:
+		truncate, step = truncateDay, 24*time.Hour
+	default:
+		return nil, fmt.Errorf("history: unknown resolution %q", resolution)
+	}
+
+	from, to = truncate(from), truncate(to)
+	obs, err := s.observations(ctx, []string{cityID}, from, to.Add(step))
+	if err != nil {
+		return nil, fmt.Errorf("history: %w", err)
+	}
+	points := []historyPoint{}
+	return append(points, rollups(obs[cityID], from, to, truncate)...), nil
+}
+
+func (s sqliteStore) weeklyStats(ctx context.Context, cities []string) (map[string]cityWeeklyStats, error) {
+	now := time.Now()
+	obs, err := s.observations(ctx, cities, now.AddDate(0, 0, -14), now.Add(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("weeklyStats: %w", err)
+	}
+
+	result := make(map[string]cityWeeklyStats)
+	for city, cityObs := range obs {
+		if stats, ok := weeklyCityStats(cityObs, now); ok {
+			result[city] = stats
+		}
+	}
+	return result, nil
+}
+
+// saveCollectionReport does nothing: nothing reads the reports back.
+func (sqliteStore) saveCollectionReport(ctx context.Context, report collectionReport) error {
+	return nil
+}
+
+func (s sqliteStore) anomalyBaselines(ctx context.Context, cities []string) (anomalyBaselines, error) {
+	now := time.Now()
+	from := truncateHour(now.AddDate(0, 0, -anomalyBaselineDays))
+	obs, err := s.observations(ctx, cities, from, now.Add(time.Second))
+	if err != nil {
+		return anomalyBaselines{}, fmt.Errorf("anomalyBaselines: %w", err)
+	}
+
+	base := newAnomalyBaselines()
+	for _, city := range cities {
+		base.add(city, hourlyAverages(obs[city], from), now)
+	}
+	return base, nil
+}
+
+func (sqliteStore) saveAnomalies(ctx context.Context, anomalies []anomaly) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("saveAnomalies: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, a := range anomalies {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO anomalies (city_id, observed_at, detected_at, metric, value, baseline_mean, baseline_stddev, z_score, samples, alerted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			utc(a.CityID, a.ObservedAt, a.DetectedAt, a.Metric, a.Value, a.BaselineMean, a.BaselineStddev, a.ZScore, a.Samples, a.Alerted)...)
+		if err != nil {
+			return fmt.Errorf("saveAnomalies: insert: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("saveAnomalies: commit: %w", err)
+	}
+	return nil
+}
+
+func (sqliteStore) alertedSince(ctx context.Context, cities []string, since time.Time) (map[string]bool, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT DISTINCT city_id, metric
+		FROM anomalies
+		WHERE alerted AND detected_at >= ? AND city_id IN (SELECT value FROM json_each(?))`,
+		utc(since, jsonList(cities))...)
+	if err != nil {
+		return nil, fmt.Errorf("alertedSince: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]bool)
+	for rows.Next() {
+		var city, metric string
+		if err := rows.Scan(&city, &metric); err != nil {
+			return nil, fmt.Errorf("alertedSince: scan: %w", err)
+		}
+		result[anomalyAlertKey(city, metric)] = true
+	}
+	return result, rows.Err()
+}
+
+func (sqliteStore) anomalies(ctx context.Context, cityID string, days int) ([]anomaly, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT city_id, observed_at, detected_at, metric, value, baseline_mean, baseline_stddev, z_score, samples, alerted
+		FROM anomalies
+		WHERE observed_at >= ? AND (? = '' OR city_id = ?)
+		ORDER BY observed_at DESC
+		LIMIT 1000`, utc(time.Now().AddDate(0, 0, -days), cityID, cityID)...)
+	if err != nil {
+		return nil, fmt.Errorf("anomalies: %w", err)
+	}
+	defer rows.Close()
+
+	result := []anomaly{}
+	for rows.Next() {
+		var a anomaly
+		if err := rows.Scan(&a.CityID, &a.ObservedAt, &a.DetectedAt, &a.Metric, &a.Value,
+			&a.BaselineMean, &a.BaselineStddev, &a.ZScore, &a.Samples, &a.Alerted); err != nil {
+			return nil, fmt.Errorf("anomalies: scan: %w", err)
+		}
+		result = append(result, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("anomalies: rows: %w", err)
+	}
+	return result, nil
+}
+
+func (sqliteStore) saveForecast(ctx context.Context, cityID string, issuedAt time.Time, forecast []ForecastPoint) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("saveForecast: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, p := range forecast {
+		lead, ok := forecastLeadHours(issuedAt, p.Time)
+		if !ok {
+			continue
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO forecasts (city_id, issued_at, target_time, lead_hours, temp, feels_like, pressure, wind_speed, description, provider)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			utc(cityID, issuedAt, p.Time, lead, p.Temp, p.FeelsLike, p.Pressure, p.WindSpeed, p.Description, p.Provider)...)
+		if err != nil {
+			return fmt.Errorf("saveForecast: insert: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("saveForecast: commit: %w", err)
+	}
+	return nil
+}
+
+func (s sqliteStore) forecastAccuracy(ctx context.Context, cityID string, days int) ([]forecastAccuracy, error) {
+	now := time.Now()
+	since := now.AddDate(0, 0, -days)
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT city_id, target_time, lead_hours, temp, pressure, wind_speed
+		FROM forecasts
+		WHERE target_time >= ? AND target_time <= ? AND (? = '' OR city_id = ?)`,
+		utc(since, now, cityID, cityID)...)
+	if err != nil {
+		return nil, fmt.Errorf("forecastAccuracy: %w", err)
+	}
+
+	type forecastRow struct {
+		city string
+		lead uint16
+		ForecastPoint
+	}
+	var forecasts []forecastRow
+	var cities []string
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var f forecastRow
+		if err := rows.Scan(&f.city, &f.Time, &f.lead, &f.Temp, &f.Pressure, &f.WindSpeed); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("forecastAccuracy: scan: %w", err)
+		}
+		forecasts = append(forecasts, f)
+		if !seen[f.city] {
+			seen[f.city] = true
+			cities = append(cities, f.city)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("forecastAccuracy: rows: %w", err)
+	}
+
+	from := truncateHour(since)
+	obs, err := s.observations(ctx, cities, from, now.Add(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("forecastAccuracy: %w", err)
+	}
+	hours := make(map[string]map[time.Time]historyPoint, len(cities))
+	for _, city := range cities {
+		hours[city] = hourlyAverages(obs[city], from)
+	}
+
+	sums := make(accuracySums)
+	for _, f := range forecasts {
+		sums.add(f.city, f.lead, f.ForecastPoint, hours[f.city])
+	}
+	return sums.result(), nil
+}
+
+func (sqliteStore) saveBackfillProgress(ctx context.Context, p backfillProgress) error {
+	_, err := SQLiteDB.ExecContext(ctx, `
+		INSERT OR REPLACE INTO backfill_progress (city_id, range_from, range_to, done_until, status, rows, error, attempts, next_attempt_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		utc(p.CityID, p.From, p.To, p.DoneUntil, p.Status, p.Rows, p.Error, p.Attempts, p.NextAttemptAt, time.Now())...)
+	if err != nil {
+		return fmt.Errorf("saveBackfillProgress: %s: %w", p.CityID, err)
+	}
+	return nil
+}
+
+func (sqliteStore) listBackfillProgress(ctx context.Context, cityID string, statuses ...string) ([]backfillProgress, error) {
+	query := `
+		SELECT city_id, range_from, range_to, done_until, status, rows, error, attempts, next_attempt_at, updated_at
+		FROM backfill_progress
+		WHERE (? = '' OR city_id = ?)`
+	args := []interface{}{cityID, cityID}
+	if len(statuses) > 0 {
+		query += " AND status IN (SELECT value FROM json_each(?))"
+		args = append(args, jsonList(statuses))
+	}
+	query += " ORDER BY updated_at DESC"
+
+	rows, err := SQLiteDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listBackfillProgress: %w", err)
+	}
+	defer rows.Close()
+
+	result := []backfillProgress{}
+	for rows.Next() {
+		var p backfillProgress
+		if err := rows.Scan(&p.CityID, &p.From, &p.To, &p.DoneUntil, &p.Status, &p.Rows, &p.Error, &p.Attempts, &p.NextAttemptAt, &p.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("listBackfillProgress: scan: %w", err)
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func (sqliteStore) requestRun(ctx context.Context, name string) (jobRun, error) {
+	run := jobRun{Job: name, Trigger: jobTriggerManual, Status: jobRunRequested, RequestedAt: time.Now()}
+	res, err := SQLiteDB.ExecContext(ctx, "INSERT INTO job_runs (job, trigger, status, requested_at) VALUES (?, ?, ?, ?)",
+		utc(name, run.Trigger, run.Status, run.RequestedAt)...)
+	if err != nil {
+		return jobRun{}, err
+	}
+	if run.ID, err = res.LastInsertId(); err != nil {
+		return jobRun{}, err
+	}
+	return run, nil
+}
+
+func (sqliteStore) requestedRuns(ctx context.Context) ([]jobRun, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, "SELECT id, job FROM job_runs WHERE status = ? ORDER BY id", jobRunRequested)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []jobRun
+	for rows.Next() {
+		r := jobRun{Trigger: jobTriggerManual, Status: jobRunRequested}
+		if err := rows.Scan(&r.ID, &r.Job); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (sqliteStore) claimRun(ctx context.Context, runID int64) (bool, error) {
+	res, err := SQLiteDB.ExecContext(ctx, "UPDATE job_runs SET status = ?, replica = ? WHERE id = ? AND status = ?",
+		jobRunRunning, replicaID, runID, jobRunRequested)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (sqliteStore) startRun(ctx context.Context, name, trigger string, runID int64, started time.Time) (int64, error) {
+	if runID != 0 {
+		_, err := SQLiteDB.ExecContext(ctx, "UPDATE job_runs SET status = ?, replica = ?, started_at = ? WHERE id = ?",
+			utc(jobRunRunning, replicaID, started, runID)...)
+		return runID, err
+	}
+	res, err := SQLiteDB.ExecContext(ctx, `
+		INSERT INTO job_runs (job, trigger, status, replica, requested_at, started_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		utc(name, trigger, jobRunRunning, replicaID, started, started)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (sqliteStore) finishRun(ctx context.Context, runID int64, duration time.Duration, runErr error) error {
+	status, message := jobRunSucceeded, ""
+	if runErr != nil {
+		status, message = jobRunFailed, runErr.Error()
+	}
+	_, err := SQLiteDB.ExecContext(ctx, `
+		UPDATE job_runs SET status = ?, finished_at = ?, duration_ms = ?, error = ? WHERE id = ?`,
+		utc(status, time.Now(), duration.Milliseconds(), message, runID)...)
+	return err
+}
+
+func (sqliteStore) interruptRuns(ctx context.Context, name, replica string, before time.Time) (int64, error) {
+	res, err := SQLiteDB.ExecContext(ctx, `
+		UPDATE job_runs SET status = ?, finished_at = ?, error = ?
+		WHERE status = ? AND (? = '' OR job = ?) AND (? = '' OR replica = ?)
+			AND COALESCE(started_at, requested_at) < ?`,
+		utc(jobRunFailed, time.Now(), interruptedRun, jobRunRunning, name, name, replica, replica, before)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (sqliteStore) skipRun(ctx context.Context, name, trigger string, runID int64, reason string) error {
+	if runID != 0 {
+		_, err := SQLiteDB.ExecContext(ctx, "UPDATE job_runs SET status = ?, error = ? WHERE id = ?", jobRunSkipped, reason, runID)
+		return err
+	}
+	_, err := SQLiteDB.ExecContext(ctx, `
+		INSERT INTO job_runs (job, trigger, status, replica, requested_at, error) VALUES (?, ?, ?, ?, ?, ?)`,
+		utc(name, trigger, jobRunSkipped, replicaID, time.Now(), reason)...)
+	return err
+}
+
+func (sqliteStore) listRuns(ctx context.Context, name string, limit int) ([]jobRun, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, `
+		SELECT id, job, trigger, status, replica, requested_at, started_at, finished_at, duration_ms, error
+		FROM job_runs
+		WHERE ? = '' OR job = ?
+		ORDER BY id DESC
+		LIMIT ?`, name, name, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listRuns: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []jobRun{}
+	for rows.Next() {
+		var r jobRun
+		var started, finished sql.NullTime
+		var duration sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.Job, &r.Trigger, &r.Status, &r.Replica, &r.RequestedAt, &started, &finished, &duration, &r.Error); err != nil {
+			return nil, fmt.Errorf("listRuns: scan: %w", err)
+		}
+		if started.Valid {
+			r.StartedAt = &started.Time
+		}
+		if finished.Valid {
+			r.FinishedAt = &finished.Time
+		}
+		if duration.Valid {
+			r.DurationMs = &duration.Int64
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (sqliteStore) pruneRuns(ctx context.Context, days int) (int64, error) {
+	res, err := SQLiteDB.ExecContext(ctx, "DELETE FROM job_runs WHERE requested_at < ?", utc(time.Now().AddDate(0, 0, -days))...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sqliteMigrations applies migrations/sqlite. A single process uses the
+// file, so no lock is taken.
+type sqliteMigrations struct{}
+
+func (sqliteMigrations) Name() string { return "sqlite" }
+
+func (sqliteMigrations) ensureTable(ctx context.Context) error {
+	_, err := SQLiteDB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("sqliteMigrations: create schema_migrations: %w", err)
+	}
+	return nil
+}
+
+func (sqliteMigrations) applied(ctx context.Context) (map[int]bool, error) {
+	rows, err := SQLiteDB.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("sqliteMigrations: select versions: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("sqliteMigrations: scan: %w", err)
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
+
+// apply runs the statements and the bookkeeping in one transaction; SQLite
+// DDL is transactional too.
+func (sqliteMigrations) apply(ctx context.Context, m migration, statements []string, up bool) error {
+	tx, err := SQLiteDB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("exec %q: %w", firstLine(stmt), err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("record version: %w", err)
+	}
+	return tx.Commit()
+}
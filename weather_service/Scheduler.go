@@ -0,0 +1,556 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Overlap policies: what happens when a job is due while its previous run is
+// still going.
+const (
+	// overlapSkip records the new run as skipped.
+	overlapSkip = "skip"
+	// overlapQueue keeps one run waiting until the current one ends; further
+	// runs are skipped.
+	overlapQueue = "queue"
+	// overlapAllow starts the new run alongside the current one.
+	overlapAllow = "allow"
+)
+
+const (
+	jobTriggerSchedule = "schedule"
+	jobTriggerManual   = "manual"
+
+	jobRunRequested = "requested"
+	jobRunRunning   = "running"
+	jobRunSucceeded = "succeeded"
+	jobRunFailed    = "failed"
+	jobRunSkipped   = "skipped"
+)
+
+var (
+	// schedulerPollInterval is how often the leaders pick up manual triggers.
+	schedulerPollInterval = envDuration("SCHEDULER_POLL_INTERVAL", 5*time.Second)
+	// jobRunsRetentionDays bounds job_runs; 0 keeps the history forever.
+	jobRunsRetentionDays = envDays("JOB_RUNS_RETENTION_DAYS", 30)
+)
+
+var errUnknownJob = errors.New("unknown job")
+
+// processStarted tells the runs of this process from those of an earlier
+// process with the same REPLICA_ID.
+var processStarted = time.Now()
+
+// interruptedRun is the error of runs closed by interruptStaleRuns.
+const interruptedRun = "interrupted: the replica running it stopped or lost the job"
+
+// job is a background task run by the scheduler.
+type job struct {
+	Name string
+	// Spec is the default schedule (see parseCron), overridden by
+	// JOB_<NAME>_SCHEDULE.
+	Spec    string
+	Overlap string
+	// Timeout bounds a run; 0 means no limit.
+	Timeout time.Duration
+	// Leader restricts the job to the replica leading it.
+	Leader bool
+	Run    func(ctx context.Context) error
+
+	schedule cronSchedule
+
+	mu      sync.Mutex
+	nextRun time.Time
+	running int
+	queued  *queuedRun
+}
+
+type queuedRun struct {
+	trigger string
+	runID   int64
+}
+
+// scheduler runs the registered jobs on their schedules and on manual
+// triggers, recording every run in job_runs.
+type scheduler struct {
+	jobs []*job
+}
+
+var jobScheduler = &scheduler{}
+
+// register adds a job; it must be called before start.
+func (s *scheduler) register(j *job) error {
+	key := "JOB_" + strings.ToUpper(j.Name) + "_SCHEDULE"
+	if v := os.Getenv(key); v != "" {
+		if schedule, err := parseCron(v); err != nil {
+			log.Printf("scheduler: invalid %s=%q, using %q: %v", key, v, j.Spec, err)
+		} else {
+			j.Spec, j.schedule = v, schedule
+		}
+	}
+	if j.schedule == nil {
+		schedule, err := parseCron(j.Spec)
+		if err != nil {
+			return fmt.Errorf("scheduler: job %s: %w", j.Name, err)
+		}
+		j.schedule = schedule
+	}
+	if j.Overlap == "" {
+		j.Overlap = overlapSkip
+	}
+	s.jobs = append(s.jobs, j)
+	return nil
+}
+
+func (s *scheduler) job(name string) (*job, bool) {
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j, true
+		}
+	}
+	return nil, false
+}
+
+// start campaigns for the leader jobs and starts the scheduling loop.
+func (s *scheduler) start() {
+	var leaderJobs []string
+	now := time.Now()
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		j.nextRun = j.schedule.next(now)
+		j.mu.Unlock()
+		if j.Leader {
+			leaderJobs = append(leaderJobs, j.Name)
+		}
+		log.Printf("scheduler: job %s scheduled %q, next run at %s", j.Name, j.Spec, j.nextRun.Format(time.RFC3339))
+	}
+	// runs this replica left running before a restart; in single-process
+	// mode every run left running is one
+	replica := replicaID
+	if singleProcess {
+		replica = ""
+	}
+	interruptStaleRuns("", replica, processStarted)
+	startLeaderElection(leaderJobs...)
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		var lastPoll time.Time
+		for now := range ticker.C {
+			for _, j := range s.jobs {
+				j.mu.Lock()
+				due := !j.nextRun.IsZero() && !now.Before(j.nextRun)
+				if due {
+					j.nextRun = j.schedule.next(now)
+				}
+				j.mu.Unlock()
+
+				if due && (!j.Leader || isLeader(j.Name)) {
+					s.dispatch(j, jobTriggerSchedule, 0)
+				}
+			}
+
+			if now.Sub(lastPoll) >= schedulerPollInterval {
+				lastPoll = now
+				s.pollRequested()
+			}
+		}
+	}()
+}
+
+// dispatch starts a run of j unless its overlap policy says otherwise. runID
+// is the job_runs row of a manual trigger, 0 for scheduled runs.
+func (s *scheduler) dispatch(j *job, trigger string, runID int64) {
+	j.mu.Lock()
+	if j.running > 0 && j.Overlap != overlapAllow {
+		if j.Overlap == overlapQueue && j.queued == nil {
+			j.queued = &queuedRun{trigger: trigger, runID: runID}
+			j.mu.Unlock()
+			log.Printf("scheduler: job %s is running, %s run queued", j.Name, trigger)
+			return
+		}
+		j.mu.Unlock()
+		log.Printf("scheduler: job %s is running, %s run skipped", j.Name, trigger)
+		recordSkippedRun(j.Name, trigger, runID)
+		return
+	}
+	j.running++
+	j.mu.Unlock()
+
+	go func() {
+		for {
+			s.execute(j, trigger, runID)
+
+			j.mu.Lock()
+			if j.queued == nil {
+				j.running--
+				j.mu.Unlock()
+				return
+			}
+			trigger, runID = j.queued.trigger, j.queued.runID
+			j.queued = nil
+			j.mu.Unlock()
+		}
+	}()
+}
+
+func (s *scheduler) execute(j *job, trigger string, runID int64) {
+	started := time.Now()
+	runID = startJobRun(j.Name, trigger, runID, started)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if j.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, j.Timeout)
+		defer cancel()
+	}
+	if j.Leader {
+		go cancelOnLeaderLoss(ctx, cancel, j.Name)
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return j.Run(ctx)
+	}()
+
+	duration := time.Since(started)
+	if err != nil {
+		log.Printf("scheduler: job %s failed after %s: %v", j.Name, duration.Round(time.Millisecond), err)
+	} else {
+		log.Printf("scheduler: job %s done in %s", j.Name, duration.Round(time.Millisecond))
+	}
+	finishJobRun(runID, duration, err)
+}
+
+// cancelOnLeaderLoss cancels the run of a leader job once this replica no
+// longer leads it, so that the new leader does not run it alongside.
+func cancelOnLeaderLoss(ctx context.Context, cancel context.CancelFunc, job string) {
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !isLeader(job) {
+				log.Printf("scheduler: replica %s lost leadership of %s, cancelling the run", replicaID, job)
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// pollRequested starts the manual triggers of jobs led by this replica.
+func (s *scheduler) pollRequested() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	requests, err := jobRunDB.requestedRuns(ctx)
+	if err != nil {
+		log.Printf("scheduler: poll requested runs: %v", err)
+		return
+	}
+
+	for _, r := range requests {
+		j, ok := s.job(r.Job)
+		if !ok || (j.Leader && !isLeader(j.Name)) {
+			continue
+		}
+		// claim the request, another replica may run the job without a leader
+		claimed, err := jobRunDB.claimRun(ctx, r.ID)
+		if err != nil {
+			log.Printf("scheduler: claim run %d: %v", r.ID, err)
+			continue
+		}
+		if claimed {
+			s.dispatch(j, jobTriggerManual, r.ID)
+		}
+	}
+}
+
+// trigger requests a run of the named job. The request is stored in job_runs
+// and started by the replica leading the job within schedulerPollInterval.
+func (s *scheduler) trigger(ctx context.Context, name string) (jobRun, error) {
+	if _, ok := s.job(name); !ok {
+		return jobRun{}, fmt.Errorf("%w: %s", errUnknownJob, name)
+	}
+
+	run, err := jobRunDB.requestRun(ctx, name)
+	if err != nil {
+		return jobRun{}, fmt.Errorf("trigger: %w", err)
+	}
+	log.Printf("scheduler: run %d of %s requested", run.ID, name)
+	return run, nil
+}
+
+// jobRun is a row of job_runs.
+type jobRun struct {
+	ID          int64      `json:"id"`
+	Job         string     `json:"job"`
+	Trigger     string     `json:"trigger"`
+	Status      string     `json:"status"`
+	Replica     string     `json:"replica,omitempty"`
+	RequestedAt time.Time  `json:"requested_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	DurationMs  *int64     `json:"duration_ms,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// startJobRun marks a run as started, inserting its row for scheduled runs.
+// History is best effort: on errors the job still runs and 0 is returned.
+func startJobRun(name, trigger string, runID int64, started time.Time) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runID, err := jobRunDB.startRun(ctx, name, trigger, runID, started)
+	if err != nil {
+		log.Printf("startJobRun: %s: %v", name, err)
+		return 0
+	}
+	return runID
+}
+
+// interruptStaleRuns closes the runs that stayed running because their
+// replica died or lost the job before finishing them. A replica that gains
+// the leadership of a job calls it for the job, as no other replica can be
+// running it any more.
+func interruptStaleRuns(name, replica string, before time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	n, err := jobRunDB.interruptRuns(ctx, name, replica, before)
+	if err != nil {
+		log.Printf("interruptStaleRuns: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("interruptStaleRuns: closed %d runs left running", n)
+	}
+}
+
+func finishJobRun(runID int64, duration time.Duration, runErr error) {
+	if runID == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := jobRunDB.finishRun(ctx, runID, duration, runErr); err != nil {
+		log.Printf("finishJobRun: run %d: %v", runID, err)
+	}
+}
+
+func recordSkippedRun(name, trigger string, runID int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := jobRunDB.skipRun(ctx, name, trigger, runID, "previous run still running"); err != nil {
+		log.Printf("recordSkippedRun: %s: %v", name, err)
+	}
+}
+
+// jobInfo describes a job for GET /v1/admin/jobs.
+type jobInfo struct {
+	Name     string  `json:"name"`
+	Schedule string  `json:"schedule"`
+	Overlap  string  `json:"overlap"`
+	Timeout  string  `json:"timeout,omitempty"`
+	Leader   string  `json:"leader,omitempty"`
+	Running  int     `json:"running_here"`
+	NextRun  string  `json:"next_run,omitempty"`
+	LastRun  *jobRun `json:"last_run,omitempty"`
+}
+
+func (s *scheduler) list(ctx context.Context) ([]jobInfo, error) {
+	leaders, err := listLeaders(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	leaderOf := make(map[string]string, len(leaders))
+	for _, l := range leaders {
+		if l.Alive {
+			leaderOf[l.Job] = l.Replica
+		}
+	}
+
+	infos := make([]jobInfo, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		info := jobInfo{Name: j.Name, Schedule: j.Spec, Overlap: j.Overlap, Leader: leaderOf[j.Name]}
+		if j.Timeout > 0 {
+			info.Timeout = j.Timeout.String()
+		}
+		j.mu.Lock()
+		info.Running = j.running
+		if !j.nextRun.IsZero() {
+			info.NextRun = j.nextRun.Format(time.RFC3339)
+		}
+		j.mu.Unlock()
+
+		runs, err := jobRunDB.listRuns(ctx, j.Name, 1)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		if len(runs) > 0 {
+			info.LastRun = &runs[0]
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// pruneJobRuns deletes job_runs older than jobRunsRetentionDays.
+func pruneJobRuns(ctx context.Context) error {
+	if jobRunsRetentionDays == 0 {
+		return nil
+	}
+	n, err := jobRunDB.pruneRuns(ctx, jobRunsRetentionDays)
+	if err != nil {
+		return fmt.Errorf("pruneJobRuns: %w", err)
+	}
+	log.Printf("pruneJobRuns: deleted %d runs", n)
+	return nil
+}
+
+func (postgresStore) requestRun(ctx context.Context, name string) (jobRun, error) {
+	run := jobRun{Job: name, Trigger: jobTriggerManual, Status: jobRunRequested}
+	err := DB.QueryRowContext(ctx, `
+		INSERT INTO job_runs (job, trigger, status) VALUES ($1, $2, $3)
+		RETURNING id, requested_at`,
+		name, run.Trigger, run.Status).Scan(&run.ID, &run.RequestedAt)
+	if err != nil {
+		return jobRun{}, err
+	}
+	return run, nil
+}
+
+func (postgresStore) requestedRuns(ctx context.Context) ([]jobRun, error) {
+	rows, err := DB.QueryContext(ctx, "SELECT id, job FROM job_runs WHERE status = $1 ORDER BY id", jobRunRequested)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []jobRun
+	for rows.Next() {
+		r := jobRun{Trigger: jobTriggerManual, Status: jobRunRequested}
+		if err := rows.Scan(&r.ID, &r.Job); err != nil {
+			return nil, fmt.Errorf("scan: %w", err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (postgresStore) claimRun(ctx context.Context, runID int64) (bool, error) {
+	res, err := DB.ExecContext(ctx, "UPDATE job_runs SET status = $1, replica = $2 WHERE id = $3 AND status = $4",
+		jobRunRunning, replicaID, runID, jobRunRequested)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (postgresStore) startRun(ctx context.Context, name, trigger string, runID int64, started time.Time) (int64, error) {
+	if runID != 0 {
+		_, err := DB.ExecContext(ctx, "UPDATE job_runs SET status = $1, replica = $2, started_at = $3 WHERE id = $4",
+			jobRunRunning, replicaID, started, runID)
+		return runID, err
+	}
+	err := DB.QueryRowContext(ctx, `
+		INSERT INTO job_runs (job, trigger, status, replica, started_at) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id`,
+		name, trigger, jobRunRunning, replicaID, started).Scan(&runID)
+	return runID, err
+}
+
+func (postgresStore) finishRun(ctx context.Context, runID int64, duration time.Duration, runErr error) error {
+	status, message := jobRunSucceeded, ""
+	if runErr != nil {
+		status, message = jobRunFailed, runErr.Error()
+	}
+	_, err := DB.ExecContext(ctx, `
+		UPDATE job_runs SET status = $1, finished_at = now(), duration_ms = $2, error = $3 WHERE id = $4`,
+		status, duration.Milliseconds(), message, runID)
+	return err
+}
+
+func (postgresStore) interruptRuns(ctx context.Context, name, replica string, before time.Time) (int64, error) {
+	res, err := DB.ExecContext(ctx, `
+		UPDATE job_runs SET status = $1, finished_at = now(), error = $2
+		WHERE status = $3 AND ($4 = '' OR job = $4) AND ($5 = '' OR replica = $5)
+			AND COALESCE(started_at, requested_at) < $6`,
+		jobRunFailed, interruptedRun, jobRunRunning, name, replica, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (postgresStore) skipRun(ctx context.Context, name, trigger string, runID int64, reason string) error {
+	if runID != 0 {
+		_, err := DB.ExecContext(ctx, "UPDATE job_runs SET status = $1, error = $2 WHERE id = $3", jobRunSkipped, reason, runID)
+		return err
+	}
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO job_runs (job, trigger, status, replica, error) VALUES ($1, $2, $3, $4, $5)`,
+		name, trigger, jobRunSkipped, replicaID, reason)
+	return err
+}
+
+func (postgresStore) listRuns(ctx context.Context, name string, limit int) ([]jobRun, error) {
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, job, trigger, status, replica, requested_at, started_at, finished_at, duration_ms, error
+		FROM job_runs
+		WHERE $1::text = '' OR job = $1
+		ORDER BY id DESC
+		LIMIT $2`, name, limit)
+	if err != nil {
+		return nil, fmt.Errorf("listRuns: %w", err)
+	}
+	defer rows.Close()
+
+	runs := []jobRun{}
+	for rows.Next() {
+		var r jobRun
+		var started, finished sql.NullTime
+		var duration sql.NullInt64
+		if err := rows.Scan(&r.ID, &r.Job, &r.Trigger, &r.Status, &r.Replica, &r.RequestedAt, &started, &finished, &duration, &r.Error); err != nil {
+			return nil, fmt.Errorf("listRuns: scan: %w", err)
+		}
+		if started.Valid {
+			r.StartedAt = &started.Time
+		}
+		if finished.Valid {
+			r.FinishedAt = &finished.Time
+		}
+		if duration.Valid {
+			r.DurationMs = &duration.Int64
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (postgresStore) pruneRuns(ctx context.Context, days int) (int64, error) {
+	res, err := DB.ExecContext(ctx, "DELETE FROM job_runs WHERE requested_at < now() - make_interval(days => $1)", days)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,67 @@
+package weatherservice
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCancelOnLeaderLoss(t *testing.T) {
+	oldInterval := leaderCheckInterval
+	defer func() { leaderCheckInterval = oldInterval }()
+	leaderCheckInterval = 5 * time.Millisecond
+
+	// this replica does not lead the job: the run is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnLeaderLoss(ctx, cancel, "not-led")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the run of a job this replica does not lead was not cancelled")
+	}
+}
+
+func TestInterruptStaleRuns(t *testing.T) {
+	oldDB, oldReplica := jobRunDB, replicaID
+	defer func() { jobRunDB, replicaID = oldDB, oldReplica }()
+	store := newMemoryStore()
+	jobRunDB = store
+	ctx := context.Background()
+	earlier := time.Now().Add(-time.Hour)
+
+	// a replica that died in the middle of a collection and of a backfill
+	replicaID = "dead"
+	dead, _ := store.startRun(ctx, jobCollection, jobTriggerSchedule, 0, earlier)
+	deadBackfill, _ := store.startRun(ctx, jobBackfill, jobTriggerSchedule, 0, earlier)
+	replicaID = "alive"
+	done, _ := store.startRun(ctx, jobCollection, jobTriggerSchedule, 0, earlier)
+	if err := store.finishRun(ctx, done, time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// this replica takes over the collection
+	interruptStaleRuns(jobCollection, "", time.Now())
+	// and starts a run of its own, which a later call leaves alone
+	current, _ := store.startRun(ctx, jobCollection, jobTriggerSchedule, 0, time.Now())
+	interruptStaleRuns(jobCollection, "alive", time.Now().Add(-time.Minute))
+
+	want := map[int64]string{
+		dead:         jobRunFailed,
+		deadBackfill: jobRunRunning,
+		done:         jobRunSucceeded,
+		current:      jobRunRunning,
+	}
+	runs, err := store.listRuns(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range runs {
+		if r.Status != want[r.ID] {
+			t.Errorf("run %d of %s by %s: status %s, want %s", r.ID, r.Job, r.Replica, r.Status, want[r.ID])
+		}
+		if r.Status == jobRunFailed && (r.Error != interruptedRun || r.FinishedAt == nil) {
+			t.Errorf("run %d closed without its error or finish time: %+v", r.ID, r)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// The service keeps its state behind these stores. By default users, job runs
+// and the email outbox live in Postgres and cities and weather data in
+// ClickHouse; memory mode (see UseMemoryStores) keeps everything in the
+// process.
+var (
+	userDB    userStore      = postgresStore{}
+	jobRunDB  jobRunStore    = postgresStore{}
+	cityDB    cityStore      = clickhouseStore{}
+	metricsDB metricsStore   = clickhouseStore{}
+	publisher emailPublisher = postgresStore{}
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// storedUser is a user account without its subscriptions.
+type storedUser struct {
+	Email         string
+	PasswordHash  string
+	WeeklyDigest  bool
+	AnomalyAlerts bool
+}
+
+// recipient is a user with the subscribed IDs in order and the nicknames of
+// the subscriptions, as needed to render emails.
+type recipient struct {
+	email         string
+	cities        []string
+	labels        pointLabels
+	weeklyDigest  bool
+	anomalyAlerts bool
+}
+
+// recipientFilter selects users for userStore.recipients. The zero value
+// selects every user.
+type recipientFilter struct {
+	// weeklyDue selects users whose weekly digest is due.
+	weeklyDue bool
+	// alertCities selects users opted in to anomaly alerts, keeping only
+	// their opted-in subscriptions to these cities.
+	alertCities []string
+	// search selects users whose email contains it, ignoring case.
+	search string
+	// limit caps the number of users; 0 means no limit.
+	limit int
+}
+
+// userStore keeps users and their subscriptions.
+type userStore interface {
+	// createUser stores a new user with its subscriptions and queues the
+	// welcome email in the same transaction, or returns errUserExist.
+	createUser(ctx context.Context, u storedUser, subs []userCity, welcome EmailTask) error
+	// user returns errUserNotFound for unknown emails.
+	user(ctx context.Context, email string) (storedUser, error)
+	// updateUser changes the flags that are not nil.
+	updateUser(ctx context.Context, email string, weeklyDigest, anomalyAlerts *bool) error
+	deleteUser(ctx context.Context, email string) error
+
+	// subscriptions returns the subscriptions of a user in order.
+	subscriptions(ctx context.Context, email string) ([]userCity, error)
+	// setSubscriptions makes subs the subscriptions of a user. Subscriptions
+	// the user keeps keep their created_at.
+	setSubscriptions(ctx context.Context, email string, subs []userCity) error
+	recipients(ctx context.Context, f recipientFilter) ([]recipient, error)
+	// queueWeeklySummary queues the weekly summary of a user and records it
+	// as sent in one transaction.
+	queueWeeklySummary(ctx context.Context, email string, summary EmailTask) error
+
+	// subscriberCounts counts the users subscribed to each city.
+	subscriberCounts(ctx context.Context) (map[string]int, error)
+	// moveSubscriptions moves the subscriptions of fromID to intoID, keeping
+	// their position and settings; users who already had intoID just lose
+	// fromID. It returns the number of subscriptions changed.
+	moveSubscriptions(ctx context.Context, fromID, intoID string) (int, error)
+	// removeSubscriptions unsubscribes every user from a city.
+	removeSubscriptions(ctx context.Context, cityID string) (int, error)
+	// syncCities updates the store's copy of the cities that subscriptions
+	// reference, if it keeps one.
+	syncCities(ctx context.Context, cities []CityType) error
+}
+
+// cityStore keeps the city registry.
+type cityStore interface {
+	readCities(ctx context.Context) ([]CityType, error)
+	// writeCities stores new versions of cities.
+	writeCities(ctx context.Context, cities []CityType) error
+}
+
+// metricsStore keeps observations and everything derived from them.
+type metricsStore interface {
+	insertObservations(ctx context.Context, observations []cityObservation) error
+	// latestObservation returns errNoObservations when the city has none.
+	latestObservation(ctx context.Context, cityID string) (Observation, error)
+	// lastObserved returns the time of the newest observation of each city
+	// observed during the last day.
+	lastObserved(ctx context.Context) (map[string]time.Time, error)
+	history(ctx context.Context, cityID string, from, to time.Time, resolution string) ([]historyPoint, error)
+	weeklyStats(ctx context.Context, cities []string) (map[string]cityWeeklyStats, error)
+	saveCollectionReport(ctx context.Context, report collectionReport) error
+
+	anomalyBaselines(ctx context.Context, cities []string) (anomalyBaselines, error)
+	saveAnomalies(ctx context.Context, anomalies []anomaly) error
+	// alertedSince returns the anomalyAlertKey of every metric of the given
+	// cities with an alerted anomaly detected since the given time.
+	alertedSince(ctx context.Context, cities []string, since time.Time) (map[string]bool, error)
+	// anomalies returns anomalies of the last days, newest first, for one
+	// city or for all when cityID is empty. City names are not filled in.
+	anomalies(ctx context.Context, cityID string, days int) ([]anomaly, error)
+
+	saveForecast(ctx context.Context, cityID string, issuedAt time.Time, forecast []ForecastPoint) error
+	// forecastAccuracy is getForecastAccuracy without the city names.
+	forecastAccuracy(ctx context.Context, cityID string, days int) ([]forecastAccuracy, error)
+
+	saveBackfillProgress(ctx context.Context, p backfillProgress) error
+	// listBackfillProgress returns the backfill of one city, or of every
+	// city when cityID is empty, optionally only those in the given
+	// statuses, most recently updated first.
+	listBackfillProgress(ctx context.Context, cityID string, statuses ...string) ([]backfillProgress, error)
+}
+
+// jobRunStore keeps the history of background job runs and the manual
+// triggers waiting for a leader.
+type jobRunStore interface {
+	// requestRun stores a manual trigger of a job.
+	requestRun(ctx context.Context, name string) (jobRun, error)
+	requestedRuns(ctx context.Context) ([]jobRun, error)
+	// claimRun marks a requested run as running on this replica; false
+	// means another replica claimed it first.
+	claimRun(ctx context.Context, runID int64) (bool, error)
+	// startRun marks a run as started, creating it when runID is 0, and
+	// returns its ID.
+	startRun(ctx context.Context, name, trigger string, runID int64, started time.Time) (int64, error)
+	finishRun(ctx context.Context, runID int64, duration time.Duration, runErr error) error
+	// interruptRuns marks as failed the runs left running that started
+	// before the given time, of one job or of all when name is empty, and of
+	// one replica or of all when replica is empty.
+	interruptRuns(ctx context.Context, name, replica string, before time.Time) (int64, error)
+	// skipRun records a run that did not start, creating it when runID is 0.
+	skipRun(ctx context.Context, name, trigger string, runID int64, reason string) error
+	// listRuns returns the latest runs, of one job or of all when name is
+	// empty.
+	listRuns(ctx context.Context, name string, limit int) ([]jobRun, error)
+	// pruneRuns deletes runs requested more than days ago.
+	pruneRuns(ctx context.Context, days int) (int64, error)
+}
+
+// emailPublisher hands email tasks over to the mail worker, or to the outbox
+// relaying them to it.
+type emailPublisher interface {
+	publish(ctx context.Context, task EmailTask) error
+}
+
+func publishEmailTask(ctx context.Context, task EmailTask) error {
+	return publisher.publish(ctx, task)
+}
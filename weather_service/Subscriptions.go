@@ -0,0 +1,383 @@
+package weatherservice
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Subscription is a subscribed city or point with the user's settings for it.
+// In requests City is a city ID or name, as in UserData.Cities; the other
+// output fields are ignored.
+type Subscription struct {
+	City     string `json:"city"`
+	Name     string `json:"name,omitempty"`
+	Kind     string `json:"kind,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	// Alerts opts the subscription in to anomaly alerts, which also have to
+	// be enabled for the user. New subscriptions are opted in.
+	Alerts    *bool      `json:"alerts,omitempty"`
+	Position  int        `json:"position"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// userCity is a row of user_cities. Kind comes from the cities table and
+// tells points from cities.
+type userCity struct {
+	CityID    string
+	Kind      string
+	Nickname  string
+	Position  int
+	Alerts    bool
+	CreatedAt time.Time
+}
+
+// sqlQueryer is implemented by *sql.DB and *sql.Tx.
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// subscriptionColumns aggregates the user_cities rows joined as uc into the
+// subscribed IDs in the user's order and a JSON object of their nicknames,
+// to be scanned with pq.Array and parsePointLabels. Needs GROUP BY.
+const subscriptionColumns = `
+	COALESCE(array_agg(uc.city_id ORDER BY uc.position, uc.created_at) FILTER (WHERE uc.city_id IS NOT NULL), '{}'),
+	COALESCE(jsonb_object_agg(uc.city_id, uc.nickname) FILTER (WHERE uc.nickname <> ''), '{}')`
+
+// userCities returns the subscriptions of a user in order.
+func userCities(ctx context.Context, q sqlQueryer, email string) ([]userCity, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT uc.city_id, c.kind, uc.nickname, uc.position, uc.alerts, uc.created_at
+		FROM user_cities uc
+		JOIN cities c ON c.id = uc.city_id
+		WHERE uc.user_email = $1
+		ORDER BY uc.position, uc.created_at`, email)
+	if err != nil {
+		return nil, fmt.Errorf("userCities: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []userCity
+	for rows.Next() {
+		var uc userCity
+		if err := rows.Scan(&uc.CityID, &uc.Kind, &uc.Nickname, &uc.Position, &uc.Alerts, &uc.CreatedAt); err != nil {
+			return nil, fmt.Errorf("userCities: scan: %w", err)
+		}
+		subs = append(subs, uc)
+	}
+	return subs, rows.Err()
+}
+
+// saveUserCities makes subs the subscriptions of a user. Rows for cities the
+// user keeps are updated in place, so they keep their created_at.
+func saveUserCities(ctx context.Context, q sqlQueryer, email string, subs []userCity) error {
+	ids := make([]string, 0, len(subs))
+	cities := make([]CityType, 0, len(subs))
+	mapMu.RLock()
+	for _, uc := range subs {
+		ids = append(ids, uc.CityID)
+		if city, ok := mapOfCities[uc.CityID]; ok {
+			cities = append(cities, city)
+		}
+	}
+	mapMu.RUnlock()
+
+	// the city may have been registered by a replica that has not mirrored
+	// it yet
+	if err := mirrorCities(ctx, q, cities); err != nil {
+		return fmt.Errorf("saveUserCities: %w", err)
+	}
+
+	if _, err := q.ExecContext(ctx, "DELETE FROM user_cities WHERE user_email = $1 AND NOT (city_id = ANY($2))",
+		email, pq.Array(ids)); err != nil {
+		return fmt.Errorf("saveUserCities: delete: %w", err)
+	}
+	for i, uc := range subs {
+		_, err := q.ExecContext(ctx, `
+			INSERT INTO user_cities (user_email, city_id, nickname, position, alerts)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (user_email, city_id) DO UPDATE
+			SET nickname = EXCLUDED.nickname, position = EXCLUDED.position, alerts = EXCLUDED.alerts`,
+			email, uc.CityID, uc.Nickname, i, uc.Alerts)
+		if err != nil {
+			return fmt.Errorf("saveUserCities: upsert %s: %w", uc.CityID, err)
+		}
+	}
+	return nil
+}
+
+// mirrorCities copies cities from the ClickHouse registry to the Postgres
+// cities table that user_cities references.
+func mirrorCities(ctx context.Context, q sqlQueryer, cities []CityType) error {
+	for _, city := range cities {
+		_, err := q.ExecContext(ctx, `
+			INSERT INTO cities (id, name, country, state, kind, status, merged_into, lat, lon, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, now())
+			ON CONFLICT (id) DO UPDATE
+			SET name = EXCLUDED.name, country = EXCLUDED.country, state = EXCLUDED.state, kind = EXCLUDED.kind,
+				status = EXCLUDED.status, merged_into = EXCLUDED.merged_into, lat = EXCLUDED.lat, lon = EXCLUDED.lon,
+				updated_at = EXCLUDED.updated_at`,
+			city.ID, city.Name, city.Country, city.State, city.Kind, city.Status, city.MergedInto, city.Lat, city.Lon)
+		if err != nil {
+			return fmt.Errorf("mirrorCities: upsert %s: %w", city.ID, err)
+		}
+	}
+	return nil
+}
+
+func (postgresStore) subscriptions(ctx context.Context, email string) ([]userCity, error) {
+	return userCities(ctx, DB, email)
+}
+
+func (postgresStore) setSubscriptions(ctx context.Context, email string, subs []userCity) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("setSubscriptions: begin: %w", err)
+	}
+	defer tx.Rollback()
+	if err := saveUserCities(ctx, tx, email, subs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("setSubscriptions: commit: %w", err)
+	}
+	return nil
+}
+
+func (postgresStore) syncCities(ctx context.Context, cities []CityType) error {
+	return mirrorCities(ctx, DB, cities)
+}
+
+func (postgresStore) recipients(ctx context.Context, f recipientFilter) ([]recipient, error) {
+	join := "LEFT JOIN user_cities uc ON uc.user_email = u.email"
+	var where []string
+	var args []interface{}
+	if f.alertCities != nil {
+		args = append(args, pq.Array(f.alertCities))
+		// only the subscriptions opted in to alerts are aggregated
+		join = fmt.Sprintf("JOIN user_cities uc ON uc.user_email = u.email AND uc.alerts AND uc.city_id = ANY($%d)", len(args))
+		where = append(where, "u.anomaly_alerts")
+	}
+	if f.weeklyDue {
+		where = append(where, "u.weekly_digest AND (u.weekly_digest_sent_at IS NULL OR u.weekly_digest_sent_at < now() - INTERVAL '7 days')")
+	}
+	if f.search != "" {
+		args = append(args, f.search)
+		where = append(where, fmt.Sprintf("u.email ILIKE '%%' || $%d || '%%'", len(args)))
+	}
+
+	query := "SELECT u.email, u.weekly_digest, u.anomaly_alerts," + subscriptionColumns + " FROM users u " + join
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " GROUP BY u.email ORDER BY u.email"
+	if f.limit > 0 {
+		args = append(args, f.limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("recipients: %w", err)
+	}
+	defer rows.Close()
+
+	var result []recipient
+	for rows.Next() {
+		var r recipient
+		var storedLabels []byte
+		if err := rows.Scan(&r.email, &r.weeklyDigest, &r.anomalyAlerts, pq.Array(&r.cities), &storedLabels); err != nil {
+			return nil, fmt.Errorf("recipients: scan: %w", err)
+		}
+		r.labels = parsePointLabels(storedLabels)
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// subscribe registers the requested cities and points and returns the
+// subscriptions to store: plain cities, then cities with settings, then
+// points. Subscriptions in existing keep their settings and created_at unless
+// the request changes them; a city also listed in settings gets those
+// settings. The existing cities are kept when cities and
+// settings are both nil, the existing points when points is nil.
+func subscribe(cities []string, settings []Subscription, points []PointSubscription, existing []userCity) ([]userCity, error) {
+	known := make(map[string]userCity, len(existing))
+	for _, uc := range existing {
+		known[uc.CityID] = uc
+	}
+
+	var subs []userCity
+	index := make(map[string]int)
+	add := func(id, kind string, nickname *string, alerts *bool) {
+		i, ok := index[id]
+		if !ok {
+			uc, ok := known[id]
+			if !ok {
+				uc = userCity{CityID: id, Alerts: true}
+			}
+			uc.Kind = kind
+			uc.Position = len(subs)
+			i = len(subs)
+			index[id] = i
+			subs = append(subs, uc)
+		}
+		// a city listed again, e.g. in both cities and subscriptions, keeps
+		// its position and takes the settings given with it
+		if nickname != nil {
+			subs[i].Nickname = *nickname
+		}
+		if alerts != nil {
+			subs[i].Alerts = *alerts
+		}
+	}
+
+	if cities == nil && settings == nil {
+		for _, uc := range existing {
+			if uc.Kind != cityKindPoint {
+				add(uc.CityID, uc.Kind, nil, nil)
+			}
+		}
+	}
+	ids, err := addCitiesToDB(cities)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		add(id, cityKindCity, nil, nil)
+	}
+	for _, s := range settings {
+		ids, err := addCitiesToDB([]string{s.City})
+		if err != nil {
+			return nil, err
+		}
+		nickname := s.Nickname
+		add(ids[0], cityKindCity, &nickname, s.Alerts)
+	}
+
+	if points == nil {
+		for _, uc := range existing {
+			if uc.Kind == cityKindPoint {
+				add(uc.CityID, uc.Kind, nil, nil)
+			}
+		}
+		return subs, nil
+	}
+
+	resolved, cells, err := resolvePoints(points)
+	if err != nil {
+		return nil, err
+	}
+	newCells := make(map[string]CityType, len(cells))
+	for _, cell := range cells {
+		newCells[cell.ID] = cell
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := registerCities(ctx, newCells); err != nil {
+		return nil, err
+	}
+	for _, p := range resolved {
+		label := p.Label
+		add(p.ID, cityKindPoint, &label, p.Alerts)
+	}
+	return subs, nil
+}
+
+// copyUserCities copies the users.cities arrays and point labels to
+// user_cities, mirroring the city registry first. Entries that are not in the
+// registry, such as legacy names migrateUserCityIDs could not resolve, stay
+// in users.cities, which is left in place; 0012_user_cities_unresolved lists
+// them.
+func copyUserCities(ctx context.Context) error {
+	if err := loadCities(ctx); err != nil {
+		return err
+	}
+	mapMu.RLock()
+	cities := make([]CityType, 0, len(mapOfCities))
+	for _, city := range mapOfCities {
+		cities = append(cities, city)
+	}
+	mapMu.RUnlock()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("copyUserCities: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := mirrorCities(ctx, tx, cities); err != nil {
+		return fmt.Errorf("copyUserCities: %w", err)
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO user_cities (user_email, city_id, nickname, position)
+		SELECT u.email, s.id, COALESCE(u.point_labels ->> s.id, ''), s.n - 1
+		FROM users u, unnest(u.cities) WITH ORDINALITY AS s(id, n)
+		WHERE EXISTS (SELECT 1 FROM cities c WHERE c.id = s.id)
+		ON CONFLICT (user_email, city_id) DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("copyUserCities: insert: %w", err)
+	}
+	copied, _ := res.RowsAffected()
+
+	var unresolved int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT count(*) FROM users u, unnest(u.cities) AS s(id)
+		WHERE NOT EXISTS (SELECT 1 FROM cities c WHERE c.id = s.id)`).Scan(&unresolved); err != nil {
+		return fmt.Errorf("copyUserCities: count unresolved: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("copyUserCities: commit: %w", err)
+	}
+	if unresolved > 0 {
+		log.Printf("copyUserCities: %d entries of users.cities are not registered cities and were left there", unresolved)
+	}
+	log.Printf("copyUserCities: copied %d subscriptions", copied)
+	return nil
+}
+
+// uncopyUserCities undoes copyUserCities: users.cities is rebuilt from
+// user_cities, so subscription changes made since survive the rollback, and
+// the entries copyUserCities left there are kept after them.
+func uncopyUserCities(ctx context.Context) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("uncopyUserCities: begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users u SET
+			cities = ARRAY(
+				SELECT uc.city_id FROM user_cities uc
+				WHERE uc.user_email = u.email
+				ORDER BY uc.position, uc.created_at
+			) || ARRAY(
+				SELECT s.id FROM unnest(u.cities) WITH ORDINALITY AS s(id, n)
+				WHERE NOT EXISTS (SELECT 1 FROM cities c WHERE c.id = s.id)
+				ORDER BY s.n
+			),
+			point_labels = COALESCE((
+				SELECT jsonb_object_agg(uc.city_id, uc.nickname)
+				FROM user_cities uc
+				JOIN cities c ON c.id = uc.city_id
+				WHERE uc.user_email = u.email AND c.kind = 'point'
+			), '{}')`); err != nil {
+		return fmt.Errorf("uncopyUserCities: update users: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_cities"); err != nil {
+		return fmt.Errorf("uncopyUserCities: delete: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("uncopyUserCities: commit: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package weatherservice
+
+import "testing"
+
+func TestSubscribeMergesSettingsOfListedCities(t *testing.T) {
+	mapMu.Lock()
+	oldCities := mapOfCities
+	mapOfCities = map[string]CityType{
+		"c1": {ID: "c1", Name: "One", Status: cityStatusActive},
+		"c2": {ID: "c2", Name: "Two", Status: cityStatusActive},
+	}
+	mapMu.Unlock()
+	defer func() {
+		mapMu.Lock()
+		mapOfCities = oldCities
+		mapMu.Unlock()
+	}()
+
+	off := false
+	existing := []userCity{{CityID: "c1", Kind: cityKindCity, Nickname: "work", Alerts: true}}
+	subs, err := subscribe([]string{"c1", "c2"}, []Subscription{{City: "c2", Nickname: "home", Alerts: &off}}, nil, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []userCity{
+		{CityID: "c1", Kind: cityKindCity, Nickname: "work", Position: 0, Alerts: true},
+		{CityID: "c2", Kind: cityKindCity, Nickname: "home", Position: 1, Alerts: false},
+	}
+	if len(subs) != len(want) {
+		t.Fatalf("subscribe returned %d subscriptions, want %d: %+v", len(subs), len(want), subs)
+	}
+	for i := range want {
+		if subs[i] != want[i] {
+			t.Errorf("subscription %d = %+v, want %+v", i, subs[i], want[i])
+		}
+	}
+}
@@ -16,9 +16,19 @@ import (
 )
 
 type UserData struct {
-	Email    string   `json:"email"`
-	Password string   `json:"password,omitempty"`
-	Cities   []string `json:"cities"`
+	Email         string     `json:"email"`
+	Password      string     `json:"password,omitempty"`
+	Cities        []string   `json:"cities"`
+	WeeklyDigest  *bool      `json:"weekly_digest,omitempty"`
+	AnomalyAlerts *bool      `json:"anomaly_alerts,omitempty"`
+	CityDetails   []CityType `json:"city_details,omitempty"`
+	// Points replaces the user's point subscriptions when present; when the
+	// field is omitted the existing points are kept.
+	Points []PointSubscription `json:"points,omitempty"`
+	// Subscriptions adds cities with settings to Cities. The existing cities
+	// are kept when both fields are omitted. Responses list every city and
+	// point the user is subscribed to.
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
 }
 
 var (
@@ -50,19 +60,115 @@ func InitPostgres() error {
 		return fmt.Errorf("failed to ping Postgres: %w", err)
 	}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			email VARCHAR(255) NOT NULL PRIMARY KEY,
-			password VARCHAR(255) NOT NULL,
-			cities TEXT[] DEFAULT '{}'
-		);
-	`)
+	return nil
+}
+
+// postgresStore keeps users and job runs in Postgres.
+type postgresStore struct{}
+
+func (postgresStore) createUser(ctx context.Context, u storedUser, subs []userCity, welcome EmailTask) error {
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to create users table: %w", err)
+		return fmt.Errorf("begin: %w", err)
 	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users (email, password, weekly_digest, anomaly_alerts)
+		VALUES ($1, $2, $3, $4);
+	`, u.Email, u.PasswordHash, u.WeeklyDigest, u.AnomalyAlerts)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return errUserExist
+	}
+	if err != nil {
+		return err
+	}
+	if err := saveUserCities(ctx, tx, u.Email, subs); err != nil {
+		return err
+	}
+	if err := queueEmailTask(ctx, tx, welcome); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	wakeOutboxRelay()
+	return nil
+}
+
+func (postgresStore) user(ctx context.Context, email string) (storedUser, error) {
+	u := storedUser{Email: email}
+	err := DB.QueryRowContext(ctx, "SELECT password, weekly_digest, anomaly_alerts FROM users WHERE email=$1", email).
+		Scan(&u.PasswordHash, &u.WeeklyDigest, &u.AnomalyAlerts)
+	if err == sql.ErrNoRows {
+		return storedUser{}, errUserNotFound
+	}
+	if err != nil {
+		return storedUser{}, err
+	}
+	return u, nil
+}
+
+func (postgresStore) updateUser(ctx context.Context, email string, weeklyDigest, anomalyAlerts *bool) error {
+	_, err := DB.ExecContext(ctx, `
+		UPDATE users
+		SET weekly_digest = COALESCE($1, weekly_digest), anomaly_alerts = COALESCE($2, anomaly_alerts)
+		WHERE email = $3`, weeklyDigest, anomalyAlerts, email)
+	return err
+}
+
+func (postgresStore) deleteUser(ctx context.Context, email string) error {
+	_, err := DB.ExecContext(ctx, "DELETE FROM users WHERE email=$1", email)
+	return err
+}
+
+// migrateUserCityIDs replaces city names left in users.cities by the
+// name-keyed schema with the IDs their cities got in migrateLegacyCities.
+// Entries that are already IDs are left alone, so it is safe to run on every
+// start. Needs mapOfCities loaded from the migrated ClickHouse cities.
+func migrateUserCityIDs() error {
+	rows, err := DB.Query("SELECT email, cities FROM users")
+	if err != nil {
+		return fmt.Errorf("migrateUserCityIDs: select error: %w", err)
+	}
+
+	updates := make(map[string][]string)
+	for rows.Next() {
+		var email string
+		var cities []string
+		if err := rows.Scan(&email, pq.Array(&cities)); err != nil {
+			rows.Close()
+			return fmt.Errorf("migrateUserCityIDs: row scan error: %w", err)
+		}
 
-	startPeriodicEmailSending(10 * 60)
+		changed := false
+		mapMu.RLock()
+		for i, entry := range cities {
+			if _, ok := mapOfCities[entry]; ok {
+				continue
+			}
+			if id := legacyCityID(entry); mapOfCities[id].ID == id {
+				cities[i] = id
+				changed = true
+			}
+		}
+		mapMu.RUnlock()
 
+		if changed {
+			updates[email] = cities
+		}
+	}
+	rows.Close()
+
+	for email, cities := range updates {
+		if _, err := DB.Exec("UPDATE users SET cities = $1 WHERE email = $2", pq.Array(cities), email); err != nil {
+			return fmt.Errorf("migrateUserCityIDs: update error: %w", err)
+		}
+	}
+	if len(updates) > 0 {
+		log.Printf("migrateUserCityIDs: converted cities of %d users to ids", len(updates))
+	}
 	return nil
 }
 
@@ -73,12 +179,13 @@ func createUser(r *http.Request) error {
 		return fmt.Errorf("createUser: decode error: %w", err)
 	}
 
-	var existsEmail string
-	err := DB.QueryRow("SELECT email FROM users WHERE email=$1", userData.Email).Scan(&existsEmail)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	_, err := userDB.user(ctx, userData.Email)
 	if err == nil {
 		return errUserExist
 	}
-	if err != sql.ErrNoRows {
+	if !errors.Is(err, errUserNotFound) {
 		log.Printf("createUser: select error: %v", err)
 		return fmt.Errorf("createUser: select error: %w", err)
 	}
@@ -102,27 +209,30 @@ func createUser(r *http.Request) error {
 		return fmt.Errorf("createUser: password hashing error: %w", err)
 	}
 
-	addedCities, err := addCitiesToDB(userData.Cities)
+	subs, err := subscribe(userData.Cities, userData.Subscriptions, userData.Points, nil)
 	if err != nil {
-		log.Printf("createUser: addCitiesToDB error: %v", err)
-		return fmt.Errorf("createUser: addCitiesToDB error: %w", err)
+		log.Printf("createUser: subscribe error: %v", err)
+		return fmt.Errorf("createUser: subscribe error: %w", err)
 	}
-	_, err = DB.Exec(`
-		INSERT INTO users (email, password, cities)
-		VALUES ($1, $2, $3);
-	`, userData.Email, string(hash), pq.Array(addedCities))
+	user := storedUser{
+		Email:         userData.Email,
+		PasswordHash:  string(hash),
+		WeeklyDigest:  userData.WeeklyDigest != nil && *userData.WeeklyDigest,
+		AnomalyAlerts: userData.AnomalyAlerts != nil && *userData.AnomalyAlerts,
+	}
+	welcome, err := welcomeEmailTask(user.Email)
 	if err != nil {
+		log.Printf("createUser: %v", err)
+		return fmt.Errorf("createUser: %w", err)
+	}
+	if err := userDB.createUser(ctx, user, subs, welcome); err != nil {
+		if errors.Is(err, errUserExist) {
+			return errUserExist
+		}
 		log.Printf("createUser: insert error: %v", err)
 		return fmt.Errorf("createUser: insert error: %w", err)
 	}
 
-	go func(email string) {
-		ctx := context.Background()
-		if err := publishWelcomeEmail(ctx, email); err != nil {
-			log.Printf("createUser: failed to publish welcome email for %s: %v", email, err)
-		}
-	}(userData.Email)
-
 	log.Printf("createUser: user %s created (or already exists)", userData.Email) // CHANGED
 	return nil
 }
@@ -139,9 +249,10 @@ func changeUserData(r *http.Request) error {
 		return errors.New("changeUserData: email and password are required")
 	}
 
-	var storedHash string
-	err := DB.QueryRow("SELECT password FROM users WHERE email=$1", req.Email).Scan(&storedHash)
-	if err == sql.ErrNoRows {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	user, err := userDB.user(ctx, req.Email)
+	if errors.Is(err, errUserNotFound) {
 		log.Printf("changeUserData: user %s not found", req.Email)
 		return errors.New("changeUserData: user not found")
 	}
@@ -150,24 +261,36 @@ func changeUserData(r *http.Request) error {
 		return fmt.Errorf("changeUserData: select error: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
 		log.Printf("changeUserData: incorrect password for %s", req.Email)
 		return errors.New("changeUserData: incorrect password")
 	}
 
-	addedCities, err := addCitiesToDB(req.Cities)
-	log.Printf("changeUserData: addedCities=%v", addedCities)
-	if ; err != nil {
-		log.Printf("changeUserData: addCitiesToDB error: %v", err)
-		return fmt.Errorf("changeUserData: addCitiesToDB error: %w", err)
+	existing, err := userDB.subscriptions(ctx, req.Email)
+	if err != nil {
+		log.Printf("changeUserData: %v", err)
+		return fmt.Errorf("changeUserData: %w", err)
 	}
 
-	_, err = DB.Exec("UPDATE users SET cities = $1 WHERE email = $2", pq.Array(addedCities), req.Email)
+	subs, err := subscribe(req.Cities, req.Subscriptions, req.Points, existing)
 	if err != nil {
+		log.Printf("changeUserData: subscribe error: %v", err)
+		return fmt.Errorf("changeUserData: subscribe error: %w", err)
+	}
+	log.Printf("changeUserData: %d subscriptions", len(subs))
+
+	if err := userDB.setSubscriptions(ctx, req.Email, subs); err != nil {
 		log.Printf("changeUserData: update error: %v", err)
 		return fmt.Errorf("changeUserData: update error: %w", err)
 	}
 
+	if req.WeeklyDigest != nil || req.AnomalyAlerts != nil {
+		if err := userDB.updateUser(ctx, req.Email, req.WeeklyDigest, req.AnomalyAlerts); err != nil {
+			log.Printf("changeUserData: update settings error: %v", err)
+			return fmt.Errorf("changeUserData: update settings error: %w", err)
+		}
+	}
+
 	log.Printf("changeUserData: user %s cities updated", req.Email)
 	return nil
 }
@@ -184,10 +307,10 @@ func getUserData(r *http.Request) (UserData, error) {
 		return UserData{}, errors.New("getUserData: email and password are required")
 	}
 
-	var storedHash string
-	var cities []string
-	err := DB.QueryRow("SELECT password, cities FROM users WHERE email=$1", req.Email).Scan(&storedHash, pq.Array(&cities))
-	if err == sql.ErrNoRows {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	user, err := userDB.user(ctx, req.Email)
+	if errors.Is(err, errUserNotFound) {
 		log.Printf("getUserData: user %s not found", req.Email)
 		return UserData{}, errors.New("getUserData: user not found")
 	}
@@ -196,15 +319,54 @@ func getUserData(r *http.Request) (UserData, error) {
 		return UserData{}, fmt.Errorf("getUserData: select error: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
 		log.Printf("getUserData: incorrect password for %s", req.Email)
 		return UserData{}, errors.New("getUserData: incorrect password")
 	}
 
-	log.Printf("getUserData: success for %s, cities=%v", req.Email, cities)
+	userSubs, err := userDB.subscriptions(ctx, req.Email)
+	if err != nil {
+		log.Printf("getUserData: %v", err)
+		return UserData{}, fmt.Errorf("getUserData: %w", err)
+	}
+
+	log.Printf("getUserData: success for %s, %d subscriptions", req.Email, len(userSubs))
+	cityIDs := make([]string, 0, len(userSubs))
+	details := make([]CityType, 0, len(userSubs))
+	subs := make([]Subscription, 0, len(userSubs))
+	var points []PointSubscription
+	mapMu.RLock()
+	for i, uc := range userSubs {
+		city := mapOfCities[uc.CityID]
+		alerts, createdAt := uc.Alerts, uc.CreatedAt
+		subs = append(subs, Subscription{
+			City:      uc.CityID,
+			Name:      city.DisplayName(),
+			Kind:      uc.Kind,
+			Nickname:  uc.Nickname,
+			Alerts:    &alerts,
+			Position:  i,
+			CreatedAt: &createdAt,
+		})
+		if uc.Kind == cityKindPoint {
+			points = append(points, PointSubscription{ID: uc.CityID, Label: uc.Nickname, Lat: city.Lat, Lon: city.Lon, Alerts: &alerts})
+			continue
+		}
+		cityIDs = append(cityIDs, uc.CityID)
+		if city.ID != "" {
+			details = append(details, city)
+		}
+	}
+	mapMu.RUnlock()
+
 	return UserData{
-		Email:  req.Email,
-		Cities: cities,
+		Email:         req.Email,
+		Cities:        cityIDs,
+		WeeklyDigest:  &user.WeeklyDigest,
+		AnomalyAlerts: &user.AnomalyAlerts,
+		CityDetails:   details,
+		Points:        points,
+		Subscriptions: subs,
 	}, nil
 }
 
@@ -220,9 +382,10 @@ func deleteUser(r *http.Request) error {
 		return errors.New("deleteUser: email and password are required")
 	}
 
-	var storedHash string
-	err := DB.QueryRow("SELECT password FROM users WHERE email=$1", req.Email).Scan(&storedHash)
-	if err == sql.ErrNoRows {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	user, err := userDB.user(ctx, req.Email)
+	if errors.Is(err, errUserNotFound) {
 		log.Printf("deleteUser: user %s not found", req.Email)
 		return errors.New("deleteUser: user not found")
 	}
@@ -231,13 +394,12 @@ func deleteUser(r *http.Request) error {
 		return fmt.Errorf("deleteUser: select error: %w", err)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(req.Password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
 		log.Printf("deleteUser: incorrect password for %s", req.Email)
 		return errors.New("deleteUser: incorrect password")
 	}
 
-	_, err = DB.Exec("DELETE FROM users WHERE email=$1", req.Email)
-	if err != nil {
+	if err := userDB.deleteUser(ctx, req.Email); err != nil {
 		log.Printf("deleteUser: delete error: %v", err)
 		return fmt.Errorf("deleteUser: delete error: %w", err)
 	}
@@ -246,74 +408,44 @@ func deleteUser(r *http.Request) error {
 	return nil
 }
 
-func sendWeatherEmails() error {
+func sendWeatherEmails(ctx context.Context) error {
+	loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	// subscribers may have been added through other replicas
+	if err := loadCities(loadCtx); err != nil {
+		log.Printf("sendWeatherEmails: %v", err)
+	}
+
+	mapMu.RLock()
 	for k, v := range mapOfCities {
 		log.Printf("sendWeatherEmails: city %s => %+v", k, v)
 	}
+	mapMu.RUnlock()
 	log.Println("sendWeatherEmails: start")
 
-	rows, err := DB.Query("SELECT email, cities FROM users")
+	recipients, err := userDB.recipients(loadCtx, recipientFilter{})
 	if err != nil {
 		log.Printf("sendWeatherEmails: select error: %v", err)
 		return fmt.Errorf("sendWeatherEmails: select error: %w", err)
 	}
-	defer rows.Close()
-
-	mapOfCityWeatherForecast := make(map[string][]forecastAPIResp)
 
-	rows.Columns()
+	mapOfCityWeatherForecast := make(map[string][]ForecastPoint)
 
-	for rows.Next() {
-		var email string
-		var cities []string
-		if err := rows.Scan(&email, pq.Array(&cities)); err != nil {
-			log.Printf("sendWeatherEmails: row scan error: %v", err)
-			continue
+	for _, r := range recipients {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sendWeatherEmails: %w", ctx.Err())
 		}
+		email, cities, labels := r.email, r.cities, r.labels
 
 		log.Printf("sendWeatherEmails: processing user %s with cities %v", email, cities)
 
-		var forecastParts [][]forecastAPIResp
-
-		for _, city := range cities {
-			if val, ok := mapOfCityWeatherForecast[city]; !ok {
-				cityData, ok := mapOfCities[city]
-				if !ok {
-					log.Printf("sendWeatherEmails: city %s not found in mapOfCities", city)
-					continue
-				}
-				forecast, err := getWeatherForecast(cityData)
-				if err != nil {
-					log.Printf("sendWeatherEmails: getWeatherForecast error for city %s: %v", city, err)
-					continue
-				}
-				mapOfCityWeatherForecast[city] = forecast
-				forecastParts = append(forecastParts, forecast)
-			} else {
-				forecastParts = append(forecastParts, val)
-			}
-		}
-
-		if len(forecastParts) == 0 {
-			log.Printf("sendWeatherEmails: no valid cities for user %s", email)
-			continue
-		}
-
-		body, err := createEmailBody(forecastParts, cities)
+		task, err := dailyForecastTask(ctx, email, cities, labels, mapOfCityWeatherForecast)
 		if err != nil {
-			log.Printf("sendWeatherEmails: createEmailBody error for %s: %v", email, err)
+			log.Printf("sendWeatherEmails: %v", err)
 			continue
 		}
 
-		task := EmailTask{
-			To:      email,
-			Subject: "Ежедневный прогноз погоды",
-			Body:    body,
-			Type:    "daily_forecast",
-			Meta:    map[string]interface{}{"sent_by": "weather_service"},
-		}
-
-		ctxPub, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		ctxPub, cancel := context.WithTimeout(ctx, 5*time.Second)
 		defer cancel()
 
 		if err := publishEmailTask(ctxPub, task); err != nil {
@@ -327,36 +459,71 @@ func sendWeatherEmails() error {
 	return nil
 }
 
-func startPeriodicEmailSending(intervalSeconds int) {
-	log.Println("start_periodic_email_sending")
-
-	go func() {
-		ticker := time.NewTicker(time.Duration(intervalSeconds) * time.Second)
-		defer ticker.Stop()
+// dailyForecastTask renders the daily forecast email of a user. Forecasts are
+// fetched once per city and kept in cache for the next users.
+func dailyForecastTask(ctx context.Context, email string, cities []string, labels pointLabels, cache map[string][]ForecastPoint) (EmailTask, error) {
+	var forecastParts [][]ForecastPoint
+	var forecastCities []string
+
+	for _, city := range cities {
+		mapMu.RLock()
+		cityData, ok := mapOfCities[city]
+		mapMu.RUnlock()
+		if !ok {
+			log.Printf("dailyForecastTask: city %s not found in mapOfCities", city)
+			continue
+		}
 
-		for range ticker.C {
-			if err := sendWeatherEmails(); err != nil {
-				log.Printf("Periodic email sending error: %v", err)
-			} else {
-				log.Println("Periodic email sending: Emails sent successfully")
+		if val, ok := cache[city]; !ok {
+			fetchCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			issuedAt := time.Now()
+			forecast, err := weatherProvider.Forecast(fetchCtx, cityData)
+			cancel()
+			if err != nil {
+				log.Printf("dailyForecastTask: getWeatherForecast error for city %s: %v", city, err)
+				continue
 			}
+			if err := saveForecast(cityData.ID, issuedAt, forecast); err != nil {
+				log.Printf("dailyForecastTask: %v", err)
+			}
+			cache[city] = forecast
+			forecastParts = append(forecastParts, forecast)
+			forecastCities = append(forecastCities, subscriptionName(cityData.ID, labels))
+		} else {
+			forecastParts = append(forecastParts, val)
+			forecastCities = append(forecastCities, subscriptionName(cityData.ID, labels))
 		}
-	}()
+	}
+
+	if len(forecastParts) == 0 {
+		return EmailTask{}, fmt.Errorf("dailyForecastTask: no valid cities for user %s", email)
+	}
+
+	data, images, err := createEmailBody(forecastParts, forecastCities)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("dailyForecastTask: createEmailBody error for %s: %w", email, err)
+	}
+
+	task, err := newEmailTask(email, "Ежедневный прогноз погоды", "daily_forecast", data)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("dailyForecastTask: render error for %s: %w", email, err)
+	}
+	task.Inline = images
+	return task, nil
+}
+
+func welcomeEmailTask(userEmail string) (EmailTask, error) {
+	task, err := newEmailTask(userEmail, "Добро пожаловать в WeatherService!", "welcome", nil)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("welcomeEmailTask: render error: %w", err)
+	}
+	return task, nil
 }
 
 func publishWelcomeEmail(ctx context.Context, userEmail string) error {
-	body := `<html>
-		<body>
-			<h1>Добро пожаловать в WeatherService!</h1>
-			<p>Спасибо за регистрацию — мы будем присылать обновления по погоде в выбранных тобой городах.</p>
-		</body>
-	</html>`
-	task := EmailTask{
-		To:      userEmail,
-		Subject: "Добро пожаловать в WeatherService!",
-		Body:    body,
-		Type:    "welcome",
-		Meta:    map[string]interface{}{"sent_by": "weather_service"},
+	task, err := welcomeEmailTask(userEmail)
+	if err != nil {
+		return fmt.Errorf("PublishWelcomeEmail: %w", err)
 	}
 
 	ctxPub, cancel := context.WithTimeout(ctx, 5*time.Second)
@@ -369,11 +536,31 @@ func publishWelcomeEmail(ctx context.Context, userEmail string) error {
 	return nil
 }
 
-func createEmailBody(forecastParts [][]forecastAPIResp, cities []string) (string, error) {
-	body := `<html>
-        <body>
-            <h1>Привет!</h1>
-            <p>Вот твой ежедневный прогноз погоды:</p>`
+type dailyForecastEmail struct {
+	Cities []cityForecastEmail
+}
+
+type cityForecastEmail struct {
+	Name     string
+	ChartCID string
+	MinTemp  float32
+	MaxTemp  float32
+	MaxWind  float32
+	Entries  []forecastEntryEmail
+}
+
+type forecastEntryEmail struct {
+	Time        time.Time
+	Temp        float32
+	FeelsLike   float32
+	Pressure    float32
+	WindSpeed   float32
+	Description string
+}
+
+func createEmailBody(forecastParts [][]ForecastPoint, cities []string) (dailyForecastEmail, []InlineImage, error) {
+	var data dailyForecastEmail
+	var images []InlineImage
 
 	for i, forecast := range forecastParts {
 		if len(forecast) == 0 {
@@ -381,27 +568,41 @@ func createEmailBody(forecastParts [][]forecastAPIResp, cities []string) (string
 		}
 
 		log.Printf("createEmailBody: forecast for city %s with %d entries", cities[i], len(forecast))
-		body += fmt.Sprintf("<h2><b>%s</b></h2>", cities[i])
-		body += "<ul>"
+		city := cityForecastEmail{Name: cities[i], MinTemp: forecast[0].Temp, MaxTemp: forecast[0].Temp}
+		temps := make([]float32, 0, len(forecast))
+		winds := make([]float32, 0, len(forecast))
 
 		for _, entry := range forecast {
-			t := time.Unix(entry.Dt, 0).Format("02 Jan 15:04")
-			desc := "N/A"
-			if len(entry.Weather) > 0 {
-				desc = entry.Weather[0].Description
-			}
-			body += fmt.Sprintf(
-				"<li>%s: %.1f°C (ощущается как %.1f°C), давление %.1f мм.рт.ст, ветер %.1f м/с, %s</li>",
-				t, entry.Main.Temp, entry.Main.FeelsLike, float32(entry.Main.Pressure)*0.75, entry.Wind.Speed, desc,
-			)
+			temps = append(temps, entry.Temp)
+			winds = append(winds, entry.WindSpeed)
+			city.MinTemp = min(city.MinTemp, entry.Temp)
+			city.MaxTemp = max(city.MaxTemp, entry.Temp)
+			city.MaxWind = max(city.MaxWind, entry.WindSpeed)
+
+			city.Entries = append(city.Entries, forecastEntryEmail{
+				Time:        entry.Time,
+				Temp:        entry.Temp,
+				FeelsLike:   entry.FeelsLike,
+				Pressure:    float32(entry.Pressure),
+				WindSpeed:   entry.WindSpeed,
+				Description: entry.Description,
+			})
 		}
-		body += "</ul>"
+
+		chart, err := renderForecastChart(temps, winds)
+		if err != nil {
+			log.Printf("createEmailBody: chart for city %s: %v", cities[i], err)
+		} else {
+			city.ChartCID = fmt.Sprintf("chart-%d.png", i)
+			images = append(images, InlineImage{CID: city.ChartCID, ContentType: "image/png", Data: chart})
+		}
+
+		data.Cities = append(data.Cities, city)
 	}
 
-	body += `
-            <p>Спасибо, что используешь наш сервис!</p>
-        </body>
-    </html>`
+	if len(data.Cities) == 0 {
+		return dailyForecastEmail{}, nil, errors.New("createEmailBody: no forecast data")
+	}
 
-	return body, nil
+	return data, images, nil
 }
@@ -0,0 +1,163 @@
+package weatherservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Observation is a provider-independent snapshot of the current weather.
+// Precipitation is in mm over the last hour, visibility in metres and
+// ConditionID uses the OpenWeather condition codes whatever the provider.
+type Observation struct {
+	Time        time.Time `json:"time"`
+	Temp        float32   `json:"temp"`
+	FeelsLike   float32   `json:"feels_like"`
+	Pressure    int16     `json:"pressure"`
+	Humidity    uint8     `json:"humidity"`
+	Clouds      uint8     `json:"clouds"`
+	Visibility  uint32    `json:"visibility"`
+	WindSpeed   float32   `json:"wind_speed"`
+	WindDeg     int16     `json:"wind_deg"`
+	WindGust    float32   `json:"wind_gust"`
+	Rain1h      float32   `json:"rain_1h"`
+	Snow1h      float32   `json:"snow_1h"`
+	ConditionID uint16    `json:"condition_id"`
+	Sunrise     time.Time `json:"sunrise"`
+	Sunset      time.Time `json:"sunset"`
+	Provider    string    `json:"provider"`
+	// Source is observationSourceLive for polled observations and
+	// observationSourceBackfill for history fetched for a new city.
+	Source string `json:"source"`
+}
+
+const (
+	observationSourceLive     = "live"
+	observationSourceBackfill = "backfill"
+)
+
+// ForecastPoint is a single hourly step of a forecast.
+type ForecastPoint struct {
+	Time        time.Time
+	Temp        float32
+	FeelsLike   float32
+	Pressure    int16
+	WindSpeed   float32
+	Description string
+	Provider    string
+}
+
+// WeatherProvider is an upstream weather API.
+type WeatherProvider interface {
+	Name() string
+	CurrentWeather(ctx context.Context, city CityType) (Observation, error)
+	// Forecast returns the hourly forecast for the next 24 hours.
+	Forecast(ctx context.Context, city CityType) ([]ForecastPoint, error)
+	// Geocode resolves a city name into candidates, best match first.
+	Geocode(ctx context.Context, name string) ([]CityType, error)
+}
+
+// HistoryProvider returns past hourly observations.
+type HistoryProvider interface {
+	Name() string
+	History(ctx context.Context, city CityType, from, to time.Time) ([]Observation, error)
+}
+
+var (
+	weatherProvider WeatherProvider
+	historyProvider HistoryProvider = openMeteoProvider{}
+)
+
+// InitWeatherProviders builds the fallback chain from WEATHER_PROVIDERS, a
+// comma separated list of provider names tried in order.
+func InitWeatherProviders() error {
+	names := os.Getenv("WEATHER_PROVIDERS")
+	if names == "" {
+		names = "openweather,openmeteo"
+	}
+
+	var chain providerChain
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "openweather":
+			if apiKey == "" {
+				log.Println("InitWeatherProviders: API_WEATHER_KEY is empty, skipping openweather")
+				continue
+			}
+			// OPENWEATHER_BASE_URL points the provider at e.g. the
+			// fakeweather server during development
+			chain = append(chain, openWeatherProvider{baseURL: strings.TrimRight(os.Getenv("OPENWEATHER_BASE_URL"), "/")})
+		case "openmeteo":
+			chain = append(chain, openMeteoProvider{})
+		case "":
+		default:
+			return fmt.Errorf("InitWeatherProviders: unknown provider %q", name)
+		}
+	}
+
+	if len(chain) == 0 {
+		return errors.New("InitWeatherProviders: no weather providers configured")
+	}
+
+	weatherProvider = chain
+	log.Printf("InitWeatherProviders: using %s", chain.Name())
+	return nil
+}
+
+// providerChain tries each provider in order and returns the first success.
+type providerChain []WeatherProvider
+
+func (c providerChain) Name() string {
+	names := make([]string, 0, len(c))
+	for _, p := range c {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ">")
+}
+
+func (c providerChain) CurrentWeather(ctx context.Context, city CityType) (Observation, error) {
+	var errs []error
+	for _, p := range c {
+		obs, err := p.CurrentWeather(ctx, city)
+		if err == nil {
+			obs.Provider = p.Name()
+			return obs, nil
+		}
+		log.Printf("providerChain: %s current weather for %s failed: %v", p.Name(), city.Name, err)
+		errs = append(errs, err)
+	}
+	return Observation{}, errors.Join(errs...)
+}
+
+func (c providerChain) Forecast(ctx context.Context, city CityType) ([]ForecastPoint, error) {
+	var errs []error
+	for _, p := range c {
+		forecast, err := p.Forecast(ctx, city)
+		if err == nil {
+			for i := range forecast {
+				forecast[i].Provider = p.Name()
+			}
+			return forecast, nil
+		}
+		log.Printf("providerChain: %s forecast for %s failed: %v", p.Name(), city.Name, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c providerChain) Geocode(ctx context.Context, name string) ([]CityType, error) {
+	var errs []error
+	for _, p := range c {
+		cities, err := p.Geocode(ctx, name)
+		if err == nil {
+			return cities, nil
+		}
+		log.Printf("providerChain: %s geocode for %s failed: %v", p.Name(), name, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,207 @@
+package weatherservice
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+type weeklySummaryEmail struct {
+	From   time.Time
+	To     time.Time
+	Cities []cityWeeklyStats
+}
+
+type cityWeeklyStats struct {
+	Name          string
+	MinTemp       float32
+	MaxTemp       float32
+	AvgTemp       float32
+	WindiestDay   time.Time
+	WindiestSpeed float32
+	HasPrevious   bool
+	AvgTempChange float32
+}
+
+// weeklyStats aggregates the last 7 days of weather_metrics for the given
+// city IDs and compares the average temperature with the 7 days before that.
+// Cities without observations in the last week are not returned.
+func (clickhouseStore) weeklyStats(ctx context.Context, cities []string) (map[string]cityWeeklyStats, error) {
+	result := make(map[string]cityWeeklyStats)
+	if len(cities) == 0 {
+		return result, nil
+	}
+
+	rows, err := ClickhouseConn.Query(ctx, `
+		SELECT
+			city_id,
+			minIf(temp, timestamp >= now() - INTERVAL 7 DAY),
+			maxIf(temp, timestamp >= now() - INTERVAL 7 DAY),
+			avgIf(temp, timestamp >= now() - INTERVAL 7 DAY),
+			avgIf(temp, timestamp < now() - INTERVAL 7 DAY),
+			countIf(timestamp >= now() - INTERVAL 7 DAY),
+			countIf(timestamp < now() - INTERVAL 7 DAY)
+		FROM weather_metrics
+		WHERE city_id IN (?) AND timestamp >= now() - INTERVAL 14 DAY
+		GROUP BY city_id`, cities)
+	if err != nil {
+		return nil, fmt.Errorf("weeklyStats: select stats: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var city string
+		var minTemp, maxTemp float32
+		var avgTemp, prevAvgTemp float64
+		var cnt, prevCnt uint64
+
+		if err := rows.Scan(&city, &minTemp, &maxTemp, &avgTemp, &prevAvgTemp, &cnt, &prevCnt); err != nil {
+			return nil, fmt.Errorf("weeklyStats: scan stats: %w", err)
+		}
+		if cnt == 0 {
+			continue
+		}
+
+		stats := cityWeeklyStats{
+			MinTemp:     minTemp,
+			MaxTemp:     maxTemp,
+			AvgTemp:     float32(avgTemp),
+			HasPrevious: prevCnt > 0 && !math.IsNaN(prevAvgTemp),
+		}
+		if stats.HasPrevious {
+			stats.AvgTempChange = float32(avgTemp - prevAvgTemp)
+		}
+		result[city] = stats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("weeklyStats: rows: %w", err)
+	}
+
+	windRows, err := ClickhouseConn.Query(ctx, `
+		SELECT city_id, argMax(day, wind), max(wind)
+		FROM (
+			SELECT city_id, toDate(timestamp) AS day, max(wind_speed) AS wind
+			FROM weather_metrics
+			WHERE city_id IN (?) AND timestamp >= now() - INTERVAL 7 DAY
+			GROUP BY city_id, day
+		)
+		GROUP BY city_id`, cities)
+	if err != nil {
+		return nil, fmt.Errorf("weeklyStats: select windiest day: %w", err)
+	}
+	defer windRows.Close()
+
+	for windRows.Next() {
+		var city string
+		var day time.Time
+		var wind float32
+
+		if err := windRows.Scan(&city, &day, &wind); err != nil {
+			return nil, fmt.Errorf("weeklyStats: scan windiest day: %w", err)
+		}
+		if stats, ok := result[city]; ok {
+			stats.WindiestDay = day
+			stats.WindiestSpeed = wind
+			result[city] = stats
+		}
+	}
+
+	return result, windRows.Err()
+}
+
+// weeklySummaryTask renders the weekly summary of a user for the week ending
+// at now from the stats of metricsStore.weeklyStats.
+func weeklySummaryTask(r recipient, stats map[string]cityWeeklyStats, now time.Time) (EmailTask, error) {
+	data := weeklySummaryEmail{From: now.AddDate(0, 0, -7), To: now}
+	for _, city := range r.cities {
+		if s, ok := stats[city]; ok {
+			s.Name = subscriptionName(city, r.labels)
+			data.Cities = append(data.Cities, s)
+		}
+	}
+	if len(data.Cities) == 0 {
+		return EmailTask{}, fmt.Errorf("weeklySummaryTask: no data for user %s", r.email)
+	}
+
+	task, err := newEmailTask(r.email, "Погода за неделю", "weekly_summary", data)
+	if err != nil {
+		return EmailTask{}, fmt.Errorf("weeklySummaryTask: render error for %s: %w", r.email, err)
+	}
+	return task, nil
+}
+
+// sendWeeklySummaries sends the summary to users whose last one is a week
+// old. The last send time is set in the transaction that queues the summary,
+// so restarts do not cause duplicates or skipped weeks.
+func sendWeeklySummaries(ctx context.Context) error {
+	log.Println("sendWeeklySummaries: start")
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	recipients, err := userDB.recipients(ctx, recipientFilter{weeklyDue: true})
+	if err != nil {
+		return fmt.Errorf("sendWeeklySummaries: select error: %w", err)
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	uniqueCities := make(map[string]struct{})
+	for _, r := range recipients {
+		for _, city := range r.cities {
+			uniqueCities[city] = struct{}{}
+		}
+	}
+	cityList := make([]string, 0, len(uniqueCities))
+	for city := range uniqueCities {
+		cityList = append(cityList, city)
+	}
+
+	stats, err := metricsDB.weeklyStats(ctx, cityList)
+	if err != nil {
+		return fmt.Errorf("sendWeeklySummaries: %w", err)
+	}
+
+	now := time.Now()
+	for _, r := range recipients {
+		if ctx.Err() != nil {
+			return fmt.Errorf("sendWeeklySummaries: %w", ctx.Err())
+		}
+		task, err := weeklySummaryTask(r, stats, now)
+		if err != nil {
+			log.Printf("sendWeeklySummaries: %v", err)
+			continue
+		}
+
+		if err := userDB.queueWeeklySummary(ctx, r.email, task); err != nil {
+			log.Printf("sendWeeklySummaries: queue error for %s: %v", r.email, err)
+			continue
+		}
+		log.Printf("sendWeeklySummaries: email task queued for %s", r.email)
+	}
+
+	return nil
+}
+
+func (postgresStore) queueWeeklySummary(ctx context.Context, email string, summary EmailTask) error {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET weekly_digest_sent_at = now() WHERE email = $1", email); err != nil {
+		return err
+	}
+	if err := queueEmailTask(ctx, tx, summary); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	wakeOutboxRelay()
+	return nil
+}
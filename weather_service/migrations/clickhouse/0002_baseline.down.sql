@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS cities;
+DROP TABLE IF EXISTS collection_runs;
+DROP TABLE IF EXISTS weather_metrics;
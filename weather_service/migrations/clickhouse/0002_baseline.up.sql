@@ -0,0 +1,56 @@
+-- Schema as it was created ad hoc by createTables. Everything is IF NOT
+-- EXISTS so databases created before migrations pass through unchanged.
+
+CREATE TABLE IF NOT EXISTS weather_metrics (
+    timestamp DateTime,
+    city String,
+    temp Float32,
+    app_temp Float32,
+    pressure Int16,
+    wind_speed Float32,
+    wind_deg Int16
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY timestamp;
+
+CREATE TABLE IF NOT EXISTS collection_runs (
+    run_id UUID,
+    started_at DateTime64(3),
+    finished_at DateTime64(3),
+    total UInt32,
+    succeeded UInt32,
+    failed UInt32,
+    failed_cities Array(String),
+    errors Array(String)
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(started_at)
+ORDER BY started_at;
+
+CREATE TABLE IF NOT EXISTS cities (
+    id String,
+    name String,
+    country String,
+    state String,
+    kind LowCardinality(String) DEFAULT 'city',
+    lat Float32,
+    lon Float32,
+    updated_at DateTime DEFAULT now()
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY (id);
+
+-- rows written before providers became pluggable all came from OpenWeather
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS provider LowCardinality(String) DEFAULT 'openweather';
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS city_id String DEFAULT '' AFTER city;
+ALTER TABLE cities ADD COLUMN IF NOT EXISTS kind LowCardinality(String) DEFAULT 'city' AFTER state;
+
+-- detailed observation fields; rows collected before they existed keep the
+-- defaults, which read as "no data" rather than as measured zeros
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS humidity UInt8 DEFAULT 0 AFTER pressure;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS clouds UInt8 DEFAULT 0 AFTER humidity;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS visibility UInt32 DEFAULT 0 AFTER clouds;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS wind_gust Float32 DEFAULT 0 AFTER wind_deg;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS rain_1h Float32 DEFAULT 0 AFTER wind_gust;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS snow_1h Float32 DEFAULT 0 AFTER rain_1h;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS condition_id UInt16 DEFAULT 0 AFTER snow_1h;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS sunrise DateTime DEFAULT 0 AFTER condition_id;
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS sunset DateTime DEFAULT 0 AFTER sunrise;
@@ -0,0 +1,4 @@
+DROP VIEW IF EXISTS weather_metrics_daily_mv;
+DROP VIEW IF EXISTS weather_metrics_hourly_mv;
+DROP TABLE IF EXISTS weather_metrics_daily;
+DROP TABLE IF EXISTS weather_metrics_hourly;
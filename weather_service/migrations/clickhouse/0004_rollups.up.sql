@@ -0,0 +1,124 @@
+-- Hourly and daily rollups of weather_metrics, filled by materialized views on
+-- every insert. Precipitation stays an average hourly rate (mm/h), like the
+-- raw rain_1h/snow_1h samples.
+
+CREATE TABLE IF NOT EXISTS weather_metrics_hourly (
+    city_id String,
+    hour DateTime,
+    temp_min SimpleAggregateFunction(min, Float32),
+    temp_max SimpleAggregateFunction(max, Float32),
+    temp_avg AggregateFunction(avg, Float32),
+    app_temp_avg AggregateFunction(avg, Float32),
+    pressure_avg AggregateFunction(avg, Int16),
+    humidity_avg AggregateFunction(avg, UInt8),
+    wind_speed_avg AggregateFunction(avg, Float32),
+    wind_speed_max SimpleAggregateFunction(max, Float32),
+    wind_gust_max SimpleAggregateFunction(max, Float32),
+    rain_1h_avg AggregateFunction(avg, Float32),
+    snow_1h_avg AggregateFunction(avg, Float32),
+    samples SimpleAggregateFunction(sum, UInt64)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYYYYMM(hour)
+ORDER BY (city_id, hour);
+
+CREATE TABLE IF NOT EXISTS weather_metrics_daily (
+    city_id String,
+    day Date,
+    temp_min SimpleAggregateFunction(min, Float32),
+    temp_max SimpleAggregateFunction(max, Float32),
+    temp_avg AggregateFunction(avg, Float32),
+    app_temp_avg AggregateFunction(avg, Float32),
+    pressure_avg AggregateFunction(avg, Int16),
+    humidity_avg AggregateFunction(avg, UInt8),
+    wind_speed_avg AggregateFunction(avg, Float32),
+    wind_speed_max SimpleAggregateFunction(max, Float32),
+    wind_gust_max SimpleAggregateFunction(max, Float32),
+    rain_1h_avg AggregateFunction(avg, Float32),
+    snow_1h_avg AggregateFunction(avg, Float32),
+    samples SimpleAggregateFunction(sum, UInt64)
+) ENGINE = AggregatingMergeTree()
+PARTITION BY toYear(day)
+ORDER BY (city_id, day);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS weather_metrics_hourly_mv TO weather_metrics_hourly AS
+SELECT
+    city_id,
+    toStartOfHour(timestamp) AS hour,
+    min(temp) AS temp_min,
+    max(temp) AS temp_max,
+    avgState(temp) AS temp_avg,
+    avgState(app_temp) AS app_temp_avg,
+    avgState(pressure) AS pressure_avg,
+    avgState(humidity) AS humidity_avg,
+    avgState(wind_speed) AS wind_speed_avg,
+    max(wind_speed) AS wind_speed_max,
+    max(wind_gust) AS wind_gust_max,
+    avgState(rain_1h) AS rain_1h_avg,
+    avgState(snow_1h) AS snow_1h_avg,
+    count() AS samples
+FROM weather_metrics
+WHERE city_id != ''
+GROUP BY city_id, hour;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS weather_metrics_daily_mv TO weather_metrics_daily AS
+SELECT
+    city_id,
+    toDate(timestamp) AS day,
+    min(temp) AS temp_min,
+    max(temp) AS temp_max,
+    avgState(temp) AS temp_avg,
+    avgState(app_temp) AS app_temp_avg,
+    avgState(pressure) AS pressure_avg,
+    avgState(humidity) AS humidity_avg,
+    avgState(wind_speed) AS wind_speed_avg,
+    max(wind_speed) AS wind_speed_max,
+    max(wind_gust) AS wind_gust_max,
+    avgState(rain_1h) AS rain_1h_avg,
+    avgState(snow_1h) AS snow_1h_avg,
+    count() AS samples
+FROM weather_metrics
+WHERE city_id != ''
+GROUP BY city_id, day;
+
+-- Backfill from the raw rows collected so far. Migrations run before this
+-- replica starts collecting; rows another replica inserts while the migration
+-- runs can be counted twice in their hour, which only shifts averages.
+INSERT INTO weather_metrics_hourly
+SELECT
+    city_id,
+    toStartOfHour(timestamp) AS hour,
+    min(temp),
+    max(temp),
+    avgState(temp),
+    avgState(app_temp),
+    avgState(pressure),
+    avgState(humidity),
+    avgState(wind_speed),
+    max(wind_speed),
+    max(wind_gust),
+    avgState(rain_1h),
+    avgState(snow_1h),
+    count()
+FROM weather_metrics
+WHERE city_id != ''
+GROUP BY city_id, hour;
+
+INSERT INTO weather_metrics_daily
+SELECT
+    city_id,
+    toDate(timestamp) AS day,
+    min(temp),
+    max(temp),
+    avgState(temp),
+    avgState(app_temp),
+    avgState(pressure),
+    avgState(humidity),
+    avgState(wind_speed),
+    max(wind_speed),
+    max(wind_gust),
+    avgState(rain_1h),
+    avgState(snow_1h),
+    count()
+FROM weather_metrics
+WHERE city_id != ''
+GROUP BY city_id, day;
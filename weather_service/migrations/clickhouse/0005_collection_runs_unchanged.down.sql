@@ -0,0 +1 @@
+ALTER TABLE collection_runs DROP COLUMN IF EXISTS unchanged;
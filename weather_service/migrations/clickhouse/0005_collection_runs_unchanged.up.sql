@@ -0,0 +1,2 @@
+-- cities whose observation had not changed since the previous poll
+ALTER TABLE collection_runs ADD COLUMN IF NOT EXISTS unchanged UInt32 DEFAULT 0 AFTER succeeded;
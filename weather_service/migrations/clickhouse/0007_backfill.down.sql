@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS backfill_progress;
+ALTER TABLE weather_metrics DROP COLUMN IF EXISTS source;
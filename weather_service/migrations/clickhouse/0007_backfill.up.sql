@@ -0,0 +1,14 @@
+-- where an observation came from: 'live' polls or 'backfill' of a new city
+ALTER TABLE weather_metrics ADD COLUMN IF NOT EXISTS source LowCardinality(String) DEFAULT 'live' AFTER provider;
+
+CREATE TABLE IF NOT EXISTS backfill_progress (
+    city_id String,
+    range_from DateTime,
+    range_to DateTime,
+    done_until DateTime,
+    status LowCardinality(String),
+    rows UInt64,
+    error String,
+    updated_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY city_id;
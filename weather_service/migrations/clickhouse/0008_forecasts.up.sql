@@ -0,0 +1,15 @@
+-- every forecast fetched for the daily emails, kept to measure accuracy
+CREATE TABLE IF NOT EXISTS forecasts (
+    city_id String,
+    issued_at DateTime,
+    target_time DateTime,
+    lead_hours UInt16,
+    temp Float32,
+    feels_like Float32,
+    pressure Int16,
+    wind_speed Float32,
+    description String,
+    provider LowCardinality(String)
+) ENGINE = ReplacingMergeTree()
+PARTITION BY toYYYYMM(target_time)
+ORDER BY (city_id, target_time, issued_at);
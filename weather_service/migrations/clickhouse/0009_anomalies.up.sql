@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS anomalies (
+    city_id String,
+    observed_at DateTime,
+    detected_at DateTime DEFAULT now(),
+    metric LowCardinality(String),
+    value Float32,
+    baseline_mean Float32,
+    baseline_stddev Float32,
+    z_score Float32,
+    samples UInt32
+) ENGINE = MergeTree()
+PARTITION BY toYYYYMM(observed_at)
+ORDER BY (city_id, observed_at);
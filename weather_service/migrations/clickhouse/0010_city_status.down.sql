@@ -0,0 +1,2 @@
+ALTER TABLE cities DROP COLUMN IF EXISTS merged_into;
+ALTER TABLE cities DROP COLUMN IF EXISTS status;
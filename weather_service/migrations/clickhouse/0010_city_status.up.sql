@@ -0,0 +1,4 @@
+-- registry lifecycle: active cities are polled, paused ones have no
+-- subscribers, retired and merged ones are kept only for their history
+ALTER TABLE cities ADD COLUMN IF NOT EXISTS status LowCardinality(String) DEFAULT 'active' AFTER kind;
+ALTER TABLE cities ADD COLUMN IF NOT EXISTS merged_into String DEFAULT '' AFTER status;
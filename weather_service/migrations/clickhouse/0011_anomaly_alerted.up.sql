@@ -0,0 +1,3 @@
+-- anomalies that were emailed; the alert cooldown is read from here, so it
+-- survives restarts and leader changes
+ALTER TABLE anomalies ADD COLUMN IF NOT EXISTS alerted UInt8 DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE backfill_progress DROP COLUMN IF EXISTS next_attempt_at;
+ALTER TABLE backfill_progress DROP COLUMN IF EXISTS attempts;
@@ -0,0 +1,3 @@
+-- failed chunks are retried with backoff instead of failing the backfill
+ALTER TABLE backfill_progress ADD COLUMN IF NOT EXISTS attempts UInt32 DEFAULT 0 AFTER error;
+ALTER TABLE backfill_progress ADD COLUMN IF NOT EXISTS next_attempt_at DateTime DEFAULT 0 AFTER attempts;
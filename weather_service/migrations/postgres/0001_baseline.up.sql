@@ -0,0 +1,11 @@
+-- Schema as it was created ad hoc by InitPostgres.
+
+CREATE TABLE IF NOT EXISTS users (
+    email VARCHAR(255) NOT NULL PRIMARY KEY,
+    password VARCHAR(255) NOT NULL,
+    cities TEXT[] DEFAULT '{}'
+);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS weekly_digest BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS weekly_digest_sent_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS point_labels JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anomaly_alerts BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,8 @@
+-- current leader of each background job, refreshed by its heartbeat; the
+-- election itself uses advisory locks
+CREATE TABLE IF NOT EXISTS job_leaders (
+    job TEXT NOT NULL PRIMARY KEY,
+    replica TEXT NOT NULL,
+    acquired_at TIMESTAMPTZ NOT NULL,
+    heartbeat_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,17 @@
+-- history of background job runs; manual triggers are inserted as
+-- 'requested' and picked up by the replica leading the job
+CREATE TABLE IF NOT EXISTS job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    job TEXT NOT NULL,
+    trigger TEXT NOT NULL,
+    status TEXT NOT NULL,
+    replica TEXT NOT NULL DEFAULT '',
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    duration_ms BIGINT,
+    error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS job_runs_job_id ON job_runs (job, id DESC);
+CREATE INDEX IF NOT EXISTS job_runs_requested ON job_runs (job) WHERE status = 'requested';
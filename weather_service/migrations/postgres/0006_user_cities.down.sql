@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS user_cities;
+DROP TABLE IF EXISTS cities;
@@ -0,0 +1,27 @@
+-- subscriptions as rows instead of the users.cities array; cities mirrors
+-- the ClickHouse registry so that user_cities can reference it
+CREATE TABLE IF NOT EXISTS cities (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    state TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL DEFAULT 'city',
+    status TEXT NOT NULL DEFAULT 'active',
+    merged_into TEXT NOT NULL DEFAULT '',
+    lat REAL NOT NULL,
+    lon REAL NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS user_cities (
+    user_email VARCHAR(255) NOT NULL REFERENCES users (email) ON DELETE CASCADE ON UPDATE CASCADE,
+    city_id TEXT NOT NULL REFERENCES cities (id),
+    nickname TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    alerts BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_email, city_id)
+);
+
+-- "who is subscribed to X"; the primary key serves lookups by user
+CREATE INDEX IF NOT EXISTS user_cities_city_id ON user_cities (city_id);
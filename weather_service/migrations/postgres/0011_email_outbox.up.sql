@@ -0,0 +1,14 @@
+-- email tasks written in the transaction of the change that caused them and
+-- published to RabbitMQ by the outbox relay; sent rows are kept for a while
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    task JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_error TEXT NOT NULL DEFAULT '',
+    sent_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS email_outbox_pending ON email_outbox (next_attempt_at, id) WHERE sent_at IS NULL;
+CREATE INDEX IF NOT EXISTS email_outbox_sent ON email_outbox (sent_at) WHERE sent_at IS NOT NULL;
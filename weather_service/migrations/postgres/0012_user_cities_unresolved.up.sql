@@ -0,0 +1,14 @@
+-- users.cities entries that 0007_copy_user_cities could not resolve to a
+-- registered city, listed for an operator to re-subscribe or discard
+CREATE TABLE IF NOT EXISTS user_cities_unresolved (
+    user_email VARCHAR(255) NOT NULL REFERENCES users (email) ON DELETE CASCADE ON UPDATE CASCADE,
+    entry TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_email, entry)
+);
+
+INSERT INTO user_cities_unresolved (user_email, entry, position)
+SELECT u.email, s.id, s.n - 1
+FROM users u, unnest(u.cities) WITH ORDINALITY AS s(id, n)
+WHERE NOT EXISTS (SELECT 1 FROM cities c WHERE c.id = s.id)
+ON CONFLICT (user_email, entry) DO NOTHING;
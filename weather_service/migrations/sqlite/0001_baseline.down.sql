@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS email_queue;
+DROP TABLE IF EXISTS backfill_progress;
+DROP TABLE IF EXISTS anomalies;
+DROP TABLE IF EXISTS forecasts;
+DROP TABLE IF EXISTS weather_metrics;
+DROP TABLE IF EXISTS job_runs;
+DROP TABLE IF EXISTS user_cities;
+DROP TABLE IF EXISTS cities;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,128 @@
+-- Everything of sqlite mode in one file: the Postgres tables, the ClickHouse
+-- tables without the rollups, which are computed on read, and the queue of
+-- the built-in mail worker. Times are stored as UTC text, so they compare
+-- as strings.
+
+CREATE TABLE IF NOT EXISTS users (
+    email TEXT NOT NULL PRIMARY KEY,
+    password TEXT NOT NULL,
+    weekly_digest BOOLEAN NOT NULL DEFAULT FALSE,
+    weekly_digest_sent_at DATETIME,
+    anomaly_alerts BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS cities (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    country TEXT NOT NULL DEFAULT '',
+    state TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL DEFAULT 'city',
+    status TEXT NOT NULL DEFAULT 'active',
+    merged_into TEXT NOT NULL DEFAULT '',
+    lat REAL NOT NULL,
+    lon REAL NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS user_cities (
+    user_email TEXT NOT NULL REFERENCES users (email) ON DELETE CASCADE ON UPDATE CASCADE,
+    city_id TEXT NOT NULL REFERENCES cities (id),
+    nickname TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0,
+    alerts BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (user_email, city_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_cities_city_id ON user_cities (city_id);
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job TEXT NOT NULL,
+    trigger TEXT NOT NULL,
+    status TEXT NOT NULL,
+    replica TEXT NOT NULL DEFAULT '',
+    requested_at DATETIME NOT NULL,
+    started_at DATETIME,
+    finished_at DATETIME,
+    duration_ms INTEGER,
+    error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS job_runs_job_id ON job_runs (job, id DESC);
+
+-- one row per city and time: a repeated observation replaces the old one
+CREATE TABLE IF NOT EXISTS weather_metrics (
+    city_id TEXT NOT NULL,
+    timestamp DATETIME NOT NULL,
+    temp REAL NOT NULL,
+    app_temp REAL NOT NULL,
+    pressure INTEGER NOT NULL,
+    humidity INTEGER NOT NULL,
+    clouds INTEGER NOT NULL,
+    visibility INTEGER NOT NULL,
+    wind_speed REAL NOT NULL,
+    wind_deg INTEGER NOT NULL,
+    wind_gust REAL NOT NULL,
+    rain_1h REAL NOT NULL,
+    snow_1h REAL NOT NULL,
+    condition_id INTEGER NOT NULL,
+    sunrise DATETIME NOT NULL,
+    sunset DATETIME NOT NULL,
+    provider TEXT NOT NULL,
+    source TEXT NOT NULL DEFAULT 'live',
+    PRIMARY KEY (city_id, timestamp)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS weather_metrics_timestamp ON weather_metrics (timestamp);
+
+CREATE TABLE IF NOT EXISTS forecasts (
+    city_id TEXT NOT NULL,
+    issued_at DATETIME NOT NULL,
+    target_time DATETIME NOT NULL,
+    lead_hours INTEGER NOT NULL,
+    temp REAL NOT NULL,
+    feels_like REAL NOT NULL,
+    pressure INTEGER NOT NULL,
+    wind_speed REAL NOT NULL,
+    description TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    PRIMARY KEY (city_id, target_time, issued_at)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS anomalies (
+    city_id TEXT NOT NULL,
+    observed_at DATETIME NOT NULL,
+    detected_at DATETIME NOT NULL,
+    metric TEXT NOT NULL,
+    value REAL NOT NULL,
+    baseline_mean REAL NOT NULL,
+    baseline_stddev REAL NOT NULL,
+    z_score REAL NOT NULL,
+    samples INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS anomalies_observed_at ON anomalies (observed_at);
+
+CREATE TABLE IF NOT EXISTS backfill_progress (
+    city_id TEXT NOT NULL PRIMARY KEY,
+    range_from DATETIME NOT NULL,
+    range_to DATETIME NOT NULL,
+    done_until DATETIME NOT NULL,
+    status TEXT NOT NULL,
+    rows INTEGER NOT NULL,
+    error TEXT NOT NULL DEFAULT '',
+    updated_at DATETIME NOT NULL
+);
+
+-- email tasks waiting for the mail worker; sent tasks are deleted
+CREATE TABLE IF NOT EXISTS email_queue (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS email_queue_next_attempt_at ON email_queue (next_attempt_at);
@@ -0,0 +1,2 @@
+-- anomalies that were emailed, for the alert cooldown
+ALTER TABLE anomalies ADD COLUMN alerted INTEGER NOT NULL DEFAULT 0;
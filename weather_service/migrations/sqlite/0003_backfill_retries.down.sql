@@ -0,0 +1,2 @@
+ALTER TABLE backfill_progress DROP COLUMN next_attempt_at;
+ALTER TABLE backfill_progress DROP COLUMN attempts;
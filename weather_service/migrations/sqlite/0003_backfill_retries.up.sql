@@ -0,0 +1,3 @@
+-- failed chunks are retried with backoff instead of failing the backfill
+ALTER TABLE backfill_progress ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE backfill_progress ADD COLUMN next_attempt_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';